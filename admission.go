@@ -0,0 +1,114 @@
+package kuiperbelt
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const admissionSweepInterval = time.Minute
+
+// admission limits the number of concurrent connections and the rate of connect requests.
+type admission struct {
+	limit          ConnectionLimit
+	trustedProxies []*net.IPNet
+
+	mu        sync.Mutex
+	total     int
+	rate      *tokenBucket
+	clients   map[string]*clientAdmission
+	lastSweep time.Time
+}
+
+// clientAdmission is the admission state of a client IP address.
+type clientAdmission struct {
+	connections int
+	rate        *tokenBucket
+	last        time.Time
+}
+
+func newAdmission(limit ConnectionLimit, trustedProxies []*net.IPNet) *admission {
+	return &admission{
+		limit:          limit,
+		trustedProxies: trustedProxies,
+		rate:           newTokenBucket(limit.ConnectRate, limit.ConnectBurst),
+		clients:        make(map[string]*clientAdmission),
+	}
+}
+
+// admit reports whether a connection from ip is accepted.
+// If accepted, release must be called when the connection is finished.
+// Otherwise, retryAfter is the duration to wait before retrying.
+func (a *admission) admit(ip string, now time.Time) (release func(), retryAfter time.Duration, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep(now)
+
+	client, ok := a.clients[ip]
+	if !ok {
+		client = &clientAdmission{
+			rate: newTokenBucket(a.limit.ConnectRatePerIP, a.limit.ConnectBurstPerIP),
+		}
+		a.clients[ip] = client
+	}
+	client.last = now
+
+	if max := a.limit.MaxConnectionsPerIP; max > 0 && client.connections >= max {
+		return nil, a.limit.RetryAfter, "max_connections_per_ip"
+	}
+	if max := a.limit.MaxConnections; max > 0 && a.total >= max {
+		return nil, a.limit.RetryAfter, "max_connections"
+	}
+	if !client.rate.allowAt(now) {
+		return nil, client.rate.delayAt(now), "connect_rate_per_ip"
+	}
+	if !a.rate.allowAt(now) {
+		// the client is not charged for the connection rejected by the global rate.
+		client.rate.refund()
+		return nil, a.rate.delayAt(now), "connect_rate"
+	}
+
+	client.connections++
+	a.total++
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			client.connections--
+			a.total--
+		})
+	}
+	return release, 0, ""
+}
+
+// sweep removes the states of clients without connections.
+// A state is kept until its token bucket is filled up so that the rate limit is not reset.
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < admissionSweepInterval {
+		return
+	}
+	a.lastSweep = now
+	var fill time.Duration
+	if a.limit.ConnectRatePerIP > 0 {
+		fill = time.Duration(float64(a.limit.ConnectBurstPerIP) / a.limit.ConnectRatePerIP * float64(time.Second))
+	}
+	for ip, client := range a.clients {
+		if client.connections == 0 && now.Sub(client.last) >= fill {
+			delete(a.clients, ip)
+		}
+	}
+}
+
+// rejectConnect responds 503 with Retry-After header.
+func rejectConnect(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,129 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission__MaxConnections(t *testing.T) {
+	a := newAdmission(ConnectionLimit{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+		RetryAfter:          5 * time.Second,
+	}, nil)
+	now := time.Now()
+
+	r1, _, _ := a.admit("192.168.1.1", now)
+	r2, _, _ := a.admit("192.168.1.1", now)
+	if r1 == nil || r2 == nil {
+		t.Fatal("connections under the limit must be admitted")
+	}
+	release, retryAfter, reason := a.admit("192.168.1.1", now)
+	if release != nil || reason != "max_connections_per_ip" || retryAfter != 5*time.Second {
+		t.Errorf("unexpected admission over the per-IP limit: %s %s", reason, retryAfter)
+	}
+
+	r3, _, _ := a.admit("192.168.1.2", now)
+	if r3 == nil {
+		t.Fatal("connection from the other IP must be admitted")
+	}
+	if release, _, reason := a.admit("192.168.1.3", now); release != nil || reason != "max_connections" {
+		t.Errorf("unexpected admission over the global limit: %s", reason)
+	}
+
+	r1()
+	r1() // release is idempotent
+	if release, _, _ := a.admit("192.168.1.1", now); release == nil {
+		t.Error("connection must be admitted after released")
+	}
+	if release, _, reason := a.admit("192.168.1.3", now); release != nil || reason != "max_connections" {
+		t.Errorf("released twice: %s", reason)
+	}
+}
+
+func TestAdmission__ConnectRate(t *testing.T) {
+	a := newAdmission(ConnectionLimit{
+		ConnectRate:       10,
+		ConnectBurst:      3,
+		ConnectRatePerIP:  1,
+		ConnectBurstPerIP: 1,
+	}, nil)
+	now := time.Now()
+
+	if release, _, _ := a.admit("192.168.1.1", now); release == nil {
+		t.Fatal("first connection must be admitted")
+	}
+	release, retryAfter, reason := a.admit("192.168.1.1", now)
+	if release != nil || reason != "connect_rate_per_ip" || retryAfter != time.Second {
+		t.Errorf("unexpected admission over the per-IP rate: %s %s", reason, retryAfter)
+	}
+	a.admit("192.168.1.2", now)
+	a.admit("192.168.1.3", now)
+	release, retryAfter, reason = a.admit("192.168.1.4", now)
+	if release != nil || reason != "connect_rate" || retryAfter != 100*time.Millisecond {
+		t.Errorf("unexpected admission over the global rate: %s %s", reason, retryAfter)
+	}
+	// the per-IP token is not used by the connection rejected by the global rate.
+	release, _, reason = a.admit("192.168.1.4", now.Add(100*time.Millisecond))
+	if release == nil {
+		t.Fatalf("connection must be admitted after the global rate is filled: %s", reason)
+	}
+	release()
+
+	// the states of clients without connections are swept after the bucket is filled.
+	a.admit("192.168.1.5", now.Add(admissionSweepInterval))
+	if _, ok := a.clients["192.168.1.4"]; ok {
+		t.Error("client without connections is not swept")
+	}
+	if _, ok := a.clients["192.168.1.1"]; !ok {
+		t.Error("client with connections is swept")
+	}
+}
+
+func TestWebSocketServer__Handler__Rejected(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.ConnectionLimit = ConnectionLimit{
+		ConnectRatePerIP:  0.1,
+		ConnectBurstPerIP: 1,
+		RetryAfter:        time.Second,
+	}
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+
+	for i, status := range []int{http.StatusSwitchingProtocols, http.StatusServiceUnavailable} {
+		req, err := newTestWebSocketRequest(tc.URL)
+		if err != nil {
+			t.Fatal("cannot create request error:", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("to server upgrade request unexpected error:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("unexpected status code of request #%d: %d", i, resp.StatusCode)
+		}
+		if i == 0 {
+			callbackServer.mu.Lock()
+			callbackServer.isCallbacked = false
+			callbackServer.mu.Unlock()
+		}
+	}
+
+	if callbackServer.IsCallbacked() {
+		t.Error("connect callback is called for rejected request")
+	}
+	if st.ConnectRejects() != 1 {
+		t.Errorf("unexpected rejects: %d", st.ConnectRejects())
+	}
+}
@@ -0,0 +1,203 @@
+package kuiperbelt
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Envelope is a message published through a Backplane.
+type Envelope struct {
+	// Sessions are the target session keys. Empty means all sessions.
+	Sessions []string `json:"sessions,omitempty"`
+	// Metadata filters all sessions by their metadata if Sessions is empty.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Channel filters the sessions by the channel they subscribe to. Empty means no filter.
+	Channel     string `json:"channel,omitempty"`
+	Body        []byte `json:"body"`
+	ContentType string `json:"content_type"`
+	// Origin is the endpoint of the node published the envelope.
+	Origin string `json:"origin"`
+	// ExceptOrigin is true if the node of Origin has delivered the message to its sessions.
+	ExceptOrigin bool   `json:"except_origin,omitempty"`
+	TraceParent  string `json:"traceparent,omitempty"`
+	TraceState   string `json:"tracestate,omitempty"`
+}
+
+// Message returns the Message in the envelope.
+func (e Envelope) Message() Message {
+	return Message{
+		Body:        e.Body,
+		ContentType: e.ContentType,
+		TraceParent: e.TraceParent,
+		TraceState:  e.TraceState,
+	}
+}
+
+// Backplane is a message bus shared by nodes.
+// An envelope published by a node is delivered to the subscribers of all nodes including itself.
+type Backplane interface {
+	Publish(ctx context.Context, e Envelope) error
+	// Subscribe calls handler for each envelope until ctx is canceled.
+	Subscribe(ctx context.Context, handler func(Envelope)) error
+}
+
+// MemoryBackplane is a Backplane in process.
+// It is shared by nodes in the same process, and useful for testing.
+type MemoryBackplane struct {
+	mu       sync.RWMutex
+	handlers map[*func(Envelope)]struct{}
+}
+
+// NewMemoryBackplane returns a new MemoryBackplane.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		handlers: make(map[*func(Envelope)]struct{}),
+	}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, e Envelope) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for h := range b.handlers {
+		(*h)(e)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(ctx context.Context, handler func(Envelope)) error {
+	b.mu.Lock()
+	b.handlers[&handler] = struct{}{}
+	b.mu.Unlock()
+
+	<-ctx.Done()
+
+	b.mu.Lock()
+	delete(b.handlers, &handler)
+	b.mu.Unlock()
+	return ctx.Err()
+}
+
+// newBackplane returns the Backplane by the configuration. If the backplane is disabled, it returns nil.
+func newBackplane(c BackplaneConfig) Backplane {
+	switch c.Type {
+	case "redis":
+		return NewRedisBackplane(c.Addr, c.Password, c.Channel, c.Timeout)
+	}
+	return nil
+}
+
+// PublishHandlerFunc handles POST /publish request.
+// The message is delivered to the sessions in all nodes through the backplane.
+// If the session header is missing, the message is broadcasted to all sessions.
+// If the channel header is set, the message is delivered to the sessions subscribing to the channel among them.
+func (p *Proxy) PublishHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != "POST" {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"errors":[{"error":"required POST method"}],"result":"NG"}`)
+		return
+	}
+	if p.Backplane == nil {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"errors":[{"error":"backplane is disabled"}],"result":"NG"}`)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"result":"NG"}`)
+		return
+	}
+	parent, _ := parseTraceContext(r.Header)
+	span := p.tracer.StartSpan("publish", spanKindServer, parent)
+	defer span.End()
+
+	e := Envelope{
+		Sessions:    r.Header[p.Config.SessionHeader],
+		Channel:     strings.TrimSpace(r.Header.Get(CHANNEL_HEADER_NAME)),
+		Body:        buf,
+		ContentType: r.Header.Get("Content-Type"),
+		Origin:      p.Config.Endpoint,
+		TraceParent: span.ctx.Traceparent(),
+		TraceState:  span.ctx.State,
+	}
+	if err := p.Backplane.Publish(r.Context(), e); err != nil {
+		Log.Error("failed publish to backplane", zap.Error(err))
+		span.SetError(err)
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, `{"errors":[{"error":"failed publish to backplane"}],"result":"NG"}`)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, `{"result":"OK"}`)
+}
+
+// SubscribeBackplane delivers envelopes from the backplane to the sessions of this node until ctx is canceled.
+func (p *Proxy) SubscribeBackplane(ctx context.Context) error {
+	return p.Backplane.Subscribe(ctx, p.deliverEnvelope)
+}
+
+func (p *Proxy) deliverEnvelope(e Envelope) {
+	if e.ExceptOrigin && e.Origin == p.Config.Endpoint {
+		return
+	}
+	var ss []Session
+	if len(e.Sessions) == 0 {
+		ss = p.sessionsWithMetadata(e.Metadata)
+	} else {
+		ss = make([]Session, 0, len(e.Sessions))
+		for _, key := range e.Sessions {
+			if s, err := p.Pool.Get(key); err == nil {
+				ss = append(ss, s)
+			}
+		}
+	}
+	if e.Channel != "" {
+		ss = filterChannel(ss, e.Channel)
+	}
+	if len(ss) == 0 {
+		return
+	}
+
+	message := e.Message()
+	if p.Config.Compression.Enabled && len(ss) > 1 {
+		message = prepareMessage(message)
+	}
+	go func() {
+		ctx := context.Background()
+		if p.Config.SendTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.Config.SendTimeout)
+			defer cancel()
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(ss))
+		for _, s := range ss {
+			s := s
+			go func() {
+				defer wg.Done()
+				if err := p.sendMessage(ctx, s, message); err != nil {
+					Log.Debug("failed deliver envelope",
+						zap.Error(err),
+						zap.String("session", s.Key()),
+					)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+}
@@ -0,0 +1,105 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyPublishHandlerFunc__MemoryBackplane(t *testing.T) {
+	b := NewMemoryBackplane()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var pool1, pool2 SessionPool
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	s2 := &TestSession{key: "fugafuga", send: make(chan Message, 4)}
+	s3 := &TestSession{key: "piyopiyo", send: make(chan Message, 4)}
+	pool1.Add(s1)
+	pool2.Add(s2)
+	pool2.Add(s3)
+
+	p1 := NewProxy(TestConfig, NewStats(), &pool1)
+	p1.Backplane = b
+	p2 := NewProxy(TestConfig, NewStats(), &pool2)
+	p2.Backplane = b
+	go p1.SubscribeBackplane(ctx)
+	go p2.SubscribeBackplane(ctx)
+	for i := 0; i < 50; i++ {
+		b.mu.RLock()
+		n := len(b.handlers)
+		b.mu.RUnlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(p1.PublishHandlerFunc))
+	defer ts.Close()
+
+	// broadcast to all sessions
+	req, _ := http.NewRequest("POST", ts.URL, bytes.NewBufferString("broadcast"))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("publish request unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	for _, s := range []*TestSession{s1, s2, s3} {
+		select {
+		case msg := <-s.send:
+			if string(msg.Body) != "broadcast" || msg.ContentType != "application/octet-stream" {
+				t.Errorf("%s receives unexpected message: %+v", s.Key(), msg)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s does not receive broadcast", s.Key())
+		}
+	}
+
+	// publish to a session in the other node
+	req, _ = http.NewRequest("POST", ts.URL, bytes.NewBufferString("targeted"))
+	req.Header.Add(TestConfig.SessionHeader, "fugafuga")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("publish request unexpected error:", err)
+	}
+	resp.Body.Close()
+	select {
+	case msg := <-s2.send:
+		if string(msg.Body) != "targeted" {
+			t.Errorf("unexpected message: %s", string(msg.Body))
+		}
+	case <-time.After(time.Second):
+		t.Error("targeted session does not receive message")
+	}
+	select {
+	case msg := <-s1.send:
+		t.Errorf("not targeted session receives message: %s", string(msg.Body))
+	case msg := <-s3.send:
+		t.Errorf("not targeted session receives message: %s", string(msg.Body))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProxyPublishHandlerFunc__Disabled(t *testing.T) {
+	var pool SessionPool
+	p := NewProxy(TestConfig, NewStats(), &pool)
+	ts := httptest.NewServer(http.HandlerFunc(p.PublishHandlerFunc))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, "text/plain", bytes.NewBufferString("broadcast"))
+	if err != nil {
+		t.Fatal("publish request unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+}
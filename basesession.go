@@ -0,0 +1,307 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// baseSession is the state of a session shared by all transports.
+type baseSession struct {
+	key      string
+	server   *WebSocketServer
+	config   sessionConfig // overridden by the connect callback
+	send     chan Message
+	closed   uint32 // accessed atomically
+	closedch chan struct{}
+	// transport is "websocket", "sse" or "polling".
+	transport   string
+	subprotocol string
+
+	connectedAt time.Time
+	closedAt    time.Time
+	info        connectInfo
+	// metadata is attached by the connect callback. It is immutable after connected.
+	metadata sessionMetadata
+	// channels are subscribed by the connect callback. It is immutable after connected.
+	channels sessionChannels
+
+	// accessed atomically
+	sentMessages     int64
+	sentBytes        int64
+	receivedMessages int64
+	receivedBytes    int64
+	rtt              int64 // nanoseconds of the last round-trip time. 0 for transports without pings.
+
+	mu          sync.Mutex
+	closeReason closeReason
+}
+
+func (s *WebSocketServer) newBaseSession(key, transport string, sc sessionConfig) baseSession {
+	return baseSession{
+		key:       key,
+		server:    s,
+		config:    sc,
+		send:      make(chan Message, sc.SendQueueSize),
+		closedch:  make(chan struct{}),
+		transport: transport,
+
+		connectedAt: time.Now(),
+	}
+}
+
+// closeReason describes why a session is closed.
+type closeReason struct {
+	// Initiator is one of "client", "server", "idle" and "error".
+	Initiator string
+	// Code is the close code of the close frame. 0 means no close frame.
+	Code int
+	// Text is the reason in the close frame.
+	Text string
+}
+
+// setCloseReason records the reason of closing. Only the first reason is recorded.
+func (s *baseSession) setCloseReason(initiator string, code int, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeReason.Initiator != "" {
+		return
+	}
+	s.closeReason = closeReason{Initiator: initiator, Code: code, Text: text}
+}
+
+func (s *baseSession) getCloseReason() closeReason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeReason
+}
+
+func (s *baseSession) logClose() {
+	reason := s.getCloseReason()
+	s.server.sessionLog.Info("session close",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.String("user_agent", s.info.UserAgent),
+		zap.Duration("duration", time.Since(s.connectedAt)),
+		zap.Int64("sent_messages", atomic.LoadInt64(&s.sentMessages)),
+		zap.Int64("sent_bytes", atomic.LoadInt64(&s.sentBytes)),
+		zap.Int64("received_messages", atomic.LoadInt64(&s.receivedMessages)),
+		zap.Int64("received_bytes", atomic.LoadInt64(&s.receivedBytes)),
+		zap.Int("close_code", reason.Code),
+		zap.String("close_reason", reason.Text),
+		zap.String("close_initiator", reason.Initiator),
+	)
+}
+
+// Key returns the session key.
+func (s *baseSession) Key() string {
+	return s.key
+}
+
+// Send returns the channel for sending messages.
+func (s *baseSession) Send() chan<- Message {
+	if atomic.LoadUint32(&s.closed) != 0 {
+		return nil
+	}
+	return s.send
+}
+
+// close marks the session as closed and removes it from the pool.
+// It reports whether the session is closed by this call.
+func (s *baseSession) close(callback bool) bool {
+	if atomic.SwapUint32(&s.closed, 1) != 0 {
+		return false
+	}
+	s.closedAt = time.Now()
+	s.server.deleteSession(s.key)
+	close(s.closedch)
+	s.server.Stats.SessionLifetimeEvent(s.closedAt.Sub(s.connectedAt))
+	s.logClose()
+	if s.server.events != nil {
+		payload := s.closeCallbackPayload()
+		s.server.events.publish(&streamEvent{Type: "close", Session: s.key, Close: &payload})
+	}
+	if callback && s.server.Config.Callback.Close != "" {
+		s.server.Stats.ClosingEvent()
+		go s.sendCloseCallback()
+	}
+	return true
+}
+
+func (s *baseSession) Closed() <-chan struct{} {
+	return s.closedch
+}
+
+// closeCallbackPayload is the body of the close callback.
+type closeCallbackPayload struct {
+	sessionInspection
+	Endpoint string    `json:"endpoint"`
+	ClosedAt time.Time `json:"closed_at"`
+	// Duration is the lifetime of the session in seconds.
+	Duration float64 `json:"duration"`
+	// Initiator is one of "client", "server", "idle" and "error".
+	Initiator string `json:"initiator"`
+	// Code is the close code. 0 means no close frame.
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func (s *baseSession) closeCallbackPayload() closeCallbackPayload {
+	reason := s.getCloseReason()
+	return closeCallbackPayload{
+		sessionInspection: s.inspect(),
+		Endpoint:          s.server.Config.Endpoint,
+		ClosedAt:          s.closedAt,
+		Duration:          s.closedAt.Sub(s.connectedAt).Seconds(),
+		Initiator:         reason.Initiator,
+		Code:              reason.Code,
+		Reason:            reason.Text,
+	}
+}
+
+func (s *baseSession) sendCloseCallback() {
+	defer s.server.Stats.ClosedEvent()
+	body, err := json.Marshal(s.closeCallbackPayload())
+	if err != nil {
+		Log.Error("cannot marshal close callback payload.",
+			zap.Error(err),
+			zap.String("session", s.Key()),
+		)
+		return
+	}
+	req, err := http.NewRequest("POST", s.server.Config.Callback.Close, bytes.NewReader(body))
+	if err != nil {
+		Log.Error("cannot create close callback request.",
+			zap.Error(err),
+			zap.String("session", s.Key()),
+		)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add(s.server.Config.SessionHeader, s.Key())
+	s.metadata.setHeader(req.Header)
+	if protocol := s.subprotocol; protocol != "" {
+		req.Header.Set(SUBPROTOCOL_HEADER_NAME, protocol)
+	}
+	for name, value := range s.server.Config.ProxySetHeader {
+		if value == "" {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Close = s.server.shouldDisconnectCallbackRequest()
+	if timeout := s.server.Config.Callback.Timeout; timeout != 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	span := s.server.tracer.StartSpan("callback close", spanKindClient, traceContext{})
+	defer span.End()
+	span.SetAttribute("kuiperbelt.session", s.Key())
+	span.ctx.inject(req.Header)
+
+	start := time.Now()
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		s.server.Stats.CallbackEvent("close", 0, time.Since(start))
+		span.SetError(err)
+		Log.Error("failed send close callback request.",
+			zap.Error(err),
+			zap.String("session", s.Key()),
+		)
+		return
+	}
+	defer resp.Body.Close()
+	s.server.Stats.CallbackEvent("close", resp.StatusCode, time.Since(start))
+	span.SetStatusCode(resp.StatusCode)
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Log.Error("invalid close callback status.",
+			zap.String("session", s.Key()),
+			zap.String("status", resp.Status),
+			zap.String("error", err.Error()),
+		)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		Log.Error("invalid close callback status.",
+			zap.String("session", s.Key()),
+			zap.String("status", resp.Status),
+			zap.String("error", string(buf)),
+		)
+		return
+	}
+
+	Log.Info("success close callback.",
+		zap.String("session", s.Key()),
+	)
+}
+
+// receive passes a message from the client to the receiver.
+// A failure of the receiver is logged, and an error is returned only when the message cannot be read.
+func (s *baseSession) receive(ctx context.Context, msgType int, r io.Reader) error {
+	h := http.Header{
+		s.server.Config.SessionHeader: {s.Key()},
+	}
+	s.metadata.setHeader(h)
+	if s.subprotocol != "" {
+		h.Set(SUBPROTOCOL_HEADER_NAME, s.subprotocol)
+	}
+	if s.server.taps.tapped(s.Key()) {
+		// buffer the message to mirror it to the observers.
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		s.server.taps.publish(newTapEvent(s.Key(), "receive", msgType, messageContentType(msgType), b))
+		r = bytes.NewReader(b)
+	}
+	cr := &countingReader{r: r}
+	m := newReceivedMessage(msgType, h, cr)
+	var span *span
+	if s.server.Config.Callback.Receive != "" && s.server.events == nil {
+		// each message from a client starts a new trace.
+		span = s.server.tracer.StartSpan("callback receive", spanKindClient, traceContext{})
+		span.SetAttribute("kuiperbelt.session", s.Key())
+		span.ctx.inject(h)
+	}
+	start := time.Now()
+	err := s.server.receiver.Receive(ctx, m)
+	s.server.Stats.MessageSizeEvent("receive", cr.n)
+	atomic.AddInt64(&s.receivedMessages, 1)
+	atomic.AddInt64(&s.receivedBytes, int64(cr.n))
+	if span != nil {
+		s.server.Stats.CallbackEvent("receive", callbackStatus(err), time.Since(start))
+		span.SetStatusCode(callbackStatus(err))
+		span.End()
+	}
+	if err != nil {
+		Log.Error(
+			"receive callback failed",
+			zap.Error(err),
+		)
+	}
+	return nil
+}
+
+// sent records a message sent to the client.
+func (s *baseSession) sent(messageType int, contentType string, bs []byte) {
+	s.server.Stats.MessageSizeEvent("send", len(bs))
+	atomic.AddInt64(&s.sentMessages, 1)
+	atomic.AddInt64(&s.sentBytes, int64(len(bs)))
+	if s.server.taps.tapped(s.Key()) {
+		s.server.taps.publish(newTapEvent(s.Key(), "send", messageType, contentType, bs))
+	}
+}
@@ -0,0 +1,74 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// CHANNELS_HEADER_NAME is the header of the connect callback response having the channels
+	// which the session subscribes to, separated by comma.
+	CHANNELS_HEADER_NAME = "X-Kuiperbelt-Channels"
+	// CHANNEL_HEADER_NAME is the header of /publish request to publish the message to the channel.
+	CHANNEL_HEADER_NAME = "X-Kuiperbelt-Channel"
+)
+
+// sessionChannels is the set of the channels subscribed by a session.
+type sessionChannels map[string]struct{}
+
+// parseChannels returns the channels in the headers. It returns nil if there is no channel.
+func parseChannels(h http.Header) sessionChannels {
+	var cs sessionChannels
+	for _, value := range h[CHANNELS_HEADER_NAME] {
+		for _, channel := range strings.Split(value, ",") {
+			channel = strings.TrimSpace(channel)
+			if channel == "" {
+				continue
+			}
+			if cs == nil {
+				cs = sessionChannels{}
+			}
+			cs[channel] = struct{}{}
+		}
+	}
+	return cs
+}
+
+func (cs sessionChannels) has(channel string) bool {
+	_, ok := cs[channel]
+	return ok
+}
+
+// list returns the sorted channels.
+func (cs sessionChannels) list() []string {
+	if len(cs) == 0 {
+		return nil
+	}
+	channels := make([]string, 0, len(cs))
+	for channel := range cs {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// subscriber is a session which subscribes to channels.
+type subscriber interface {
+	subscribes(channel string) bool
+}
+
+func (s *baseSession) subscribes(channel string) bool {
+	return s.channels.has(channel)
+}
+
+// filterChannel returns the sessions subscribing to the channel.
+func filterChannel(ss []Session, channel string) []Session {
+	filtered := make([]Session, 0, len(ss))
+	for _, s := range ss {
+		if sub, ok := s.(subscriber); ok && sub.subscribes(channel) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
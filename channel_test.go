@@ -0,0 +1,124 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseChannels(t *testing.T) {
+	h := http.Header{}
+	h.Add(CHANNELS_HEADER_NAME, "room.1, room.2")
+	h.Add(CHANNELS_HEADER_NAME, " ,news")
+	cs := parseChannels(h)
+	if !reflect.DeepEqual(cs.list(), []string{"news", "room.1", "room.2"}) {
+		t.Errorf("unexpected channels: %v", cs.list())
+	}
+	if !cs.has("room.1") || cs.has("room.3") {
+		t.Errorf("unexpected channels: %v", cs.list())
+	}
+	if cs := parseChannels(http.Header{}); cs != nil || cs.has("news") {
+		t.Errorf("channels must be nil without headers: %v", cs)
+	}
+}
+
+func TestProxyPublishHandlerFunc__Channel(t *testing.T) {
+	b := NewMemoryBackplane()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the connect callback subscribes the sessions to the channels in the query.
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(TestConfig.SessionHeader, r.Header.Get(testRequestSessionHeader))
+		w.Header().Set(CHANNELS_HEADER_NAME, r.URL.Query().Get("channels"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tcc.Close()
+
+	var pool1, pool2 SessionPool
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	server := NewWebSocketServer(c, NewStats(), &pool2)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	pool1.Add(s1)
+	c1 := TestConfig
+	c1.Endpoint = "node1"
+	p1 := NewProxy(c1, NewStats(), &pool1)
+	p1.Backplane = b
+	c2 := TestConfig
+	c2.Endpoint = "node2"
+	p2 := NewProxy(c2, NewStats(), &pool2)
+	p2.Backplane = b
+	go p1.SubscribeBackplane(ctx)
+	go p2.SubscribeBackplane(ctx)
+	for i := 0; i < 50; i++ {
+		b.mu.RLock()
+		n := len(b.handlers)
+		b.mu.RUnlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	conns := make(map[string]*websocket.Conn)
+	for key, channels := range map[string]string{"fugafuga": "room.1,news", "piyopiyo": "room.2"} {
+		h := http.Header{}
+		h.Set(testRequestSessionHeader, key)
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/connect?channels="+channels, h)
+		if err != nil {
+			t.Fatal("cannot connect:", err)
+		}
+		defer conn.Close()
+		conns[key] = conn
+	}
+	for i := 0; i < 50 && len(pool2.List()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(p1.PublishHandlerFunc))
+	defer ts.Close()
+	req, _ := http.NewRequest("POST", ts.URL, bytes.NewBufferString("to room.1"))
+	req.Header.Set(CHANNEL_HEADER_NAME, "room.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("publish request unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+
+	conns["fugafuga"].SetReadDeadline(time.Now().Add(time.Second))
+	if _, body, err := conns["fugafuga"].ReadMessage(); err != nil || string(body) != "to room.1" {
+		t.Errorf("subscriber receives unexpected message: %s %v", body, err)
+	}
+	conns["piyopiyo"].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, body, err := conns["piyopiyo"].ReadMessage(); err == nil {
+		t.Errorf("not subscriber receives message: %s", body)
+	}
+	select {
+	case msg := <-s1.send:
+		t.Errorf("session without channels receives message: %s", msg.Body)
+	default:
+	}
+
+	session, err := pool2.Get("fugafuga")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if channels := session.(inspector).inspect().Channels; !reflect.DeepEqual(channels, []string{"news", "room.1"}) {
+		t.Errorf("unexpected channels: %v", channels)
+	}
+}
@@ -0,0 +1,380 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The headers of the callbacks. They are the same as kuiperbelt.
+const (
+	endpointHeader       = "X-Kuiperbelt-Endpoint"
+	subprotocolsHeader   = "X-Kuiperbelt-Subprotocols"
+	subprotocolHeader    = "X-Kuiperbelt-Subprotocol"
+	metadataHeaderPrefix = "X-Kuiperbelt-Meta-"
+	channelsHeader       = "X-Kuiperbelt-Channels"
+	idleTimeoutHeader    = "X-Kuiperbelt-Idle-Timeout"
+	sendQueueSizeHeader  = "X-Kuiperbelt-Send-Queue-Size"
+	maxMessageSizeHeader = "X-Kuiperbelt-Max-Message-Size"
+	inboundRateHeader    = "X-Kuiperbelt-Inbound-Rate"
+	inboundBurstHeader   = "X-Kuiperbelt-Inbound-Burst"
+)
+
+// ConnectRequest is a request of the connect callback.
+// The request has the headers and the query of the client request.
+type ConnectRequest struct {
+	*http.Request
+	// Endpoint is the endpoint of kuiperbelt node accepting the client.
+	Endpoint string
+	// Subprotocols are the WebSocket subprotocols requested by the client.
+	Subprotocols []string
+}
+
+// ConnectResponse is a response of the connect callback to accept the client.
+// The zero values of the overrides are not sent, so the configuration of kuiperbelt is used.
+type ConnectResponse struct {
+	// Session is the key of the session. It is required.
+	Session string
+	// Subprotocol must be one of the subprotocols requested by the client.
+	Subprotocol string
+	// Metadata is attached to the session, and replayed on the establish, receive and close callbacks.
+	Metadata map[string]string
+	// Channels are subscribed by the session. A message published to a channel is delivered to its subscribers.
+	Channels []string
+
+	IdleTimeout    time.Duration
+	SendQueueSize  int
+	MaxMessageSize int64
+	InboundRate    float64
+	InboundBurst   int
+
+	// ContentType and Body are the first message to the client.
+	ContentType string
+	Body        []byte
+}
+
+// EstablishRequest is a request of the establish callback.
+type EstablishRequest struct {
+	Session  string
+	Endpoint string
+	Metadata map[string]string
+}
+
+// ReceivedMessage is a request of the receive callback. It is a message from the client.
+type ReceivedMessage struct {
+	Session     string
+	Endpoint    string
+	Subprotocol string
+	Metadata    map[string]string
+	// ContentType is "text/plain" for a text message, or "application/octet-stream" for a binary message.
+	ContentType string
+	Body        []byte
+}
+
+// Binary reports whether the message is a binary message.
+func (m *ReceivedMessage) Binary() bool {
+	return m.ContentType == "application/octet-stream"
+}
+
+// ClosedSession is a request of the close callback.
+type ClosedSession struct {
+	Session          string            `json:"session"`
+	Transport        string            `json:"transport"`
+	RemoteAddr       string            `json:"remote_addr"`
+	UserAgent        string            `json:"user_agent"`
+	Origin           string            `json:"origin,omitempty"`
+	Subprotocol      string            `json:"subprotocol,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	ConnectedAt      time.Time         `json:"connected_at"`
+	SentMessages     int64             `json:"sent_messages"`
+	SentBytes        int64             `json:"sent_bytes"`
+	ReceivedMessages int64             `json:"received_messages"`
+	ReceivedBytes    int64             `json:"received_bytes"`
+	RTT              float64           `json:"rtt"`
+	Endpoint         string            `json:"endpoint"`
+	ClosedAt         time.Time         `json:"closed_at"`
+	// Duration is the lifetime of the session in seconds.
+	Duration float64 `json:"duration"`
+	// Initiator is one of "client", "server", "idle" and "error".
+	Initiator string `json:"initiator"`
+	// Code is the close code. 0 means no close frame.
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// CallbackError is an unsuccessful response of a callback.
+// The status and the message of the connect callback are responded to the client.
+type CallbackError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *CallbackError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.StatusCode)
+	}
+	return e.Message
+}
+
+// Reject returns an error to respond the status from a callback.
+func Reject(statusCode int, message string) error {
+	return &CallbackError{StatusCode: statusCode, Message: message}
+}
+
+// Callback implements the callback handlers of a backend application.
+// Each handler is registered to the path of the callback URL, e.g.
+//
+//	http.HandleFunc("/connect", cb.ServeConnect)
+//
+// The functions return *CallbackError by Reject to respond the status. The other errors are 500.
+type Callback struct {
+	// SessionHeader must be the same as `session_header` in the configuration of kuiperbelt.
+	// The default is DefaultSessionHeader.
+	SessionHeader string
+
+	Connect   func(*ConnectRequest) (*ConnectResponse, error)
+	Establish func(*EstablishRequest) error
+	Receive   func(*ReceivedMessage) error
+	Close     func(*ClosedSession) error
+}
+
+func (cb *Callback) sessionHeader() string {
+	if cb.SessionHeader == "" {
+		return DefaultSessionHeader
+	}
+	return cb.SessionHeader
+}
+
+// ServeConnect handles the connect callback.
+func (cb *Callback) ServeConnect(w http.ResponseWriter, r *http.Request) {
+	if cb.Connect == nil {
+		http.NotFound(w, r)
+		return
+	}
+	res, err := cb.Connect(parseConnectRequest(r))
+	if err != nil {
+		writeCallbackError(w, err)
+		return
+	}
+	if res == nil || res.Session == "" {
+		writeCallbackError(w, errors.New("session key is missing"))
+		return
+	}
+	res.write(w, cb.sessionHeader())
+}
+
+// ServeEstablish handles the establish callback.
+func (cb *Callback) ServeEstablish(w http.ResponseWriter, r *http.Request) {
+	if cb.Establish == nil {
+		http.NotFound(w, r)
+		return
+	}
+	req := &EstablishRequest{
+		Session:  r.Header.Get(cb.sessionHeader()),
+		Endpoint: r.Header.Get(endpointHeader),
+		Metadata: parseMetadata(r.Header),
+	}
+	if err := cb.Establish(req); err != nil {
+		writeCallbackError(w, err)
+		return
+	}
+	writeOK(w)
+}
+
+// ServeReceive handles the receive callback.
+func (cb *Callback) ServeReceive(w http.ResponseWriter, r *http.Request) {
+	if cb.Receive == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeCallbackError(w, Reject(http.StatusBadRequest, err.Error()))
+		return
+	}
+	m := &ReceivedMessage{
+		Session:     r.Header.Get(cb.sessionHeader()),
+		Endpoint:    r.Header.Get(endpointHeader),
+		Subprotocol: r.Header.Get(subprotocolHeader),
+		Metadata:    parseMetadata(r.Header),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+	}
+	if err := cb.Receive(m); err != nil {
+		writeCallbackError(w, err)
+		return
+	}
+	writeOK(w)
+}
+
+// ServeClose handles the close callback.
+func (cb *Callback) ServeClose(w http.ResponseWriter, r *http.Request) {
+	if cb.Close == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer r.Body.Close()
+	var s ClosedSession
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeCallbackError(w, Reject(http.StatusBadRequest, "invalid close callback payload"))
+		return
+	}
+	if s.Session == "" {
+		s.Session = r.Header.Get(cb.sessionHeader())
+	}
+	if err := cb.Close(&s); err != nil {
+		writeCallbackError(w, err)
+		return
+	}
+	writeOK(w)
+}
+
+func parseConnectRequest(r *http.Request) *ConnectRequest {
+	req := &ConnectRequest{
+		Request:  r,
+		Endpoint: r.Header.Get(endpointHeader),
+	}
+	for _, p := range strings.Split(r.Header.Get(subprotocolsHeader), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			req.Subprotocols = append(req.Subprotocols, p)
+		}
+	}
+	return req
+}
+
+func (res *ConnectResponse) write(w http.ResponseWriter, sessionHeader string) {
+	h := w.Header()
+	h.Set(sessionHeader, res.Session)
+	if res.Subprotocol != "" {
+		h.Set(subprotocolHeader, res.Subprotocol)
+	}
+	for key, value := range res.Metadata {
+		h.Set(metadataHeaderPrefix+key, value)
+	}
+	if len(res.Channels) > 0 {
+		h.Set(channelsHeader, strings.Join(res.Channels, ","))
+	}
+	if res.IdleTimeout != 0 {
+		h.Set(idleTimeoutHeader, res.IdleTimeout.String())
+	}
+	if res.SendQueueSize != 0 {
+		h.Set(sendQueueSizeHeader, strconv.Itoa(res.SendQueueSize))
+	}
+	if res.MaxMessageSize != 0 {
+		h.Set(maxMessageSizeHeader, strconv.FormatInt(res.MaxMessageSize, 10))
+	}
+	if res.InboundRate != 0 {
+		h.Set(inboundRateHeader, strconv.FormatFloat(res.InboundRate, 'f', -1, 64))
+	}
+	if res.InboundBurst != 0 {
+		h.Set(inboundBurstHeader, strconv.Itoa(res.InboundBurst))
+	}
+	if res.ContentType != "" {
+		h.Set("Content-Type", res.ContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(res.Body)
+}
+
+// parseConnectResponse parses the response of the connect callback as kuiperbelt does.
+func parseConnectResponse(h http.Header, body []byte, sessionHeader string) (*ConnectResponse, error) {
+	res := &ConnectResponse{
+		Session:     h.Get(sessionHeader),
+		Subprotocol: h.Get(subprotocolHeader),
+		Metadata:    parseMetadata(h),
+		ContentType: h.Get("Content-Type"),
+		Body:        body,
+	}
+	if res.Session == "" {
+		return nil, errors.Errorf("%s header is missing", sessionHeader)
+	}
+	for _, value := range h[channelsHeader] {
+		for _, channel := range strings.Split(value, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				res.Channels = append(res.Channels, channel)
+			}
+		}
+	}
+	if v := h.Get(idleTimeoutHeader); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, errors.Errorf("invalid %s: %q", idleTimeoutHeader, v)
+		}
+		res.IdleTimeout = d
+	}
+	if v := h.Get(sendQueueSizeHeader); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s: %q", sendQueueSizeHeader, v)
+		}
+		res.SendQueueSize = n
+	}
+	if v := h.Get(maxMessageSizeHeader); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s: %q", maxMessageSizeHeader, v)
+		}
+		res.MaxMessageSize = n
+	}
+	if v := h.Get(inboundRateHeader); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return nil, errors.Errorf("invalid %s: %q", inboundRateHeader, v)
+		}
+		res.InboundRate = rate
+	}
+	if v := h.Get(inboundBurstHeader); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s: %q", inboundBurstHeader, v)
+		}
+		res.InboundBurst = n
+	}
+	return res, nil
+}
+
+// parseMetadata returns the metadata in the headers. It returns nil if there is no metadata.
+func parseMetadata(h http.Header) map[string]string {
+	var md map[string]string
+	for name, values := range h {
+		if !strings.HasPrefix(name, metadataHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		key := name[len(metadataHeaderPrefix):]
+		if key == "" {
+			continue
+		}
+		if md == nil {
+			md = map[string]string{}
+		}
+		md[key] = values[0]
+	}
+	return md
+}
+
+func setMetadata(h http.Header, md map[string]string) {
+	for key, value := range md {
+		h.Set(metadataHeaderPrefix+key, value)
+	}
+}
+
+func writeOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	io.WriteString(w, `{"result":"OK"}`)
+}
+
+func writeCallbackError(w http.ResponseWriter, err error) {
+	if e, ok := errors.Cause(err).(*CallbackError); ok {
+		http.Error(w, e.Error(), e.StatusCode)
+		return
+	}
+	// the body of the connect callback is responded to the client, so the error is not exposed.
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
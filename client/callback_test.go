@@ -0,0 +1,200 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kuiperbelt/kuiperbelt"
+)
+
+func TestVerifier__Connect(t *testing.T) {
+	cb := &Callback{
+		Connect: func(r *ConnectRequest) (*ConnectResponse, error) {
+			if r.URL.Query().Get("token") != "secret" {
+				return nil, Reject(http.StatusForbidden, "invalid token")
+			}
+			if r.Endpoint != "localhost:9180" || !reflect.DeepEqual(r.Subprotocols, []string{"v1", "v2"}) {
+				return nil, fmt.Errorf("unexpected request: %+v", r)
+			}
+			return &ConnectResponse{
+				Session:       "hogehoge",
+				Subprotocol:   "v2",
+				Metadata:      map[string]string{"Tenant": "acme"},
+				Channels:      []string{"room.1", "news"},
+				IdleTimeout:   time.Minute,
+				SendQueueSize: 10,
+				InboundRate:   0.5,
+				ContentType:   "application/json",
+				Body:          []byte(`{"hello":"world"}`),
+			}, nil
+		},
+	}
+	var v Verifier
+
+	r := httptest.NewRequest(http.MethodGet, "/connect?token=secret", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "v1, v2")
+	res, err := v.Connect(http.HandlerFunc(cb.ServeConnect), r)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := &ConnectResponse{
+		Session:       "hogehoge",
+		Subprotocol:   "v2",
+		Metadata:      map[string]string{"Tenant": "acme"},
+		Channels:      []string{"room.1", "news"},
+		IdleTimeout:   time.Minute,
+		SendQueueSize: 10,
+		InboundRate:   0.5,
+		ContentType:   "application/json",
+		Body:          []byte(`{"hello":"world"}`),
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected response: %+v", res)
+	}
+
+	// the subprotocol must be requested by the client.
+	r = httptest.NewRequest(http.MethodGet, "/connect?token=secret", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "v1")
+	if _, err := v.Connect(http.HandlerFunc(cb.ServeConnect), r); err == nil {
+		t.Error("subprotocol not requested must be invalid")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/connect", nil)
+	_, err = v.Connect(http.HandlerFunc(cb.ServeConnect), r)
+	if e, ok := err.(*CallbackError); !ok || e.StatusCode != http.StatusForbidden || e.Message != "invalid token" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	// a response without the session header is invalid.
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if _, err := v.Connect(h, httptest.NewRequest(http.MethodGet, "/connect", nil)); err == nil {
+		t.Error("response without session header must be invalid")
+	}
+}
+
+func TestVerifier__Callbacks(t *testing.T) {
+	var (
+		established *EstablishRequest
+		received    *ReceivedMessage
+		closed      *ClosedSession
+	)
+	cb := &Callback{
+		SessionHeader: "X-Session",
+		Establish: func(r *EstablishRequest) error {
+			established = r
+			return nil
+		},
+		Receive: func(m *ReceivedMessage) error {
+			if !m.Binary() {
+				return Reject(http.StatusBadRequest, "binary message only")
+			}
+			received = m
+			return nil
+		},
+		Close: func(s *ClosedSession) error {
+			closed = s
+			return nil
+		},
+	}
+	v := Verifier{SessionHeader: "X-Session", Endpoint: "ws.example.com"}
+	md := map[string]string{"Tenant": "acme"}
+
+	if err := v.Establish(http.HandlerFunc(cb.ServeEstablish), &EstablishRequest{Session: "hogehoge", Metadata: md}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if expected := (&EstablishRequest{Session: "hogehoge", Endpoint: "ws.example.com", Metadata: md}); !reflect.DeepEqual(established, expected) {
+		t.Errorf("unexpected establish request: %+v", established)
+	}
+
+	m := &ReceivedMessage{Session: "hogehoge", Metadata: md, Subprotocol: "v1", ContentType: "application/octet-stream", Body: []byte{0x00, 0x01}}
+	if err := v.Receive(http.HandlerFunc(cb.ServeReceive), m); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if received == nil || received.Session != "hogehoge" || received.Subprotocol != "v1" || !reflect.DeepEqual(received.Body, m.Body) || received.Metadata["Tenant"] != "acme" {
+		t.Errorf("unexpected received message: %+v", received)
+	}
+	err := v.Receive(http.HandlerFunc(cb.ServeReceive), &ReceivedMessage{Session: "hogehoge", Body: []byte("hello")})
+	if e, ok := err.(*CallbackError); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	s := &ClosedSession{Session: "hogehoge", Transport: "websocket", Initiator: "client", Code: 1000, Reason: "bye"}
+	if err := v.Close(http.HandlerFunc(cb.ServeClose), s); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if closed == nil || closed.Session != "hogehoge" || closed.Endpoint != "ws.example.com" || closed.Code != 1000 || closed.Initiator != "client" {
+		t.Errorf("unexpected closed session: %+v", closed)
+	}
+
+	// the callback not implemented
+	if err := v.Establish(http.HandlerFunc((&Callback{}).ServeEstablish), &EstablishRequest{Session: "hogehoge"}); err == nil {
+		t.Error("callback not implemented must fail")
+	}
+}
+
+// TestCallback__Server checks the callback handlers with kuiperbelt.
+func TestCallback__Server(t *testing.T) {
+	closed := make(chan *ClosedSession, 1)
+	cb := &Callback{
+		Connect: func(r *ConnectRequest) (*ConnectResponse, error) {
+			return &ConnectResponse{
+				Session:     r.URL.Query().Get("session"),
+				Metadata:    map[string]string{"Tenant": "acme"},
+				ContentType: "text/plain",
+				Body:        []byte("hello"),
+			}, nil
+		},
+		Close: func(s *ClosedSession) error {
+			closed <- s
+			return nil
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", cb.ServeConnect)
+	mux.HandleFunc("/close", cb.ServeClose)
+	callback := httptest.NewServer(mux)
+	defer callback.Close()
+
+	f, err := ioutil.TempFile("", "kuiperbelt-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "callback:\n  connect: %s/connect\n  close: %s/close\nendpoint: ws.example.com\n", callback.URL, callback.URL)
+	f.Close()
+	c, err := kuiperbelt.NewConfig(f.Name())
+	if err != nil {
+		t.Fatal("cannot load config:", err)
+	}
+	var pool kuiperbelt.SessionPool
+	server := kuiperbelt.NewWebSocketServer(*c, kuiperbelt.NewStats(), &pool)
+	ts := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/connect?session=hogehoge", nil)
+	if err != nil {
+		t.Fatal("cannot connect:", err)
+	}
+	if _, body, err := conn.ReadMessage(); err != nil || string(body) != "hello" {
+		t.Errorf("unexpected hello message: %s %v", body, err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	conn.Close()
+
+	select {
+	case s := <-closed:
+		if s.Session != "hogehoge" || s.Endpoint != "ws.example.com" || s.Initiator != "client" || s.Metadata["Tenant"] != "acme" {
+			t.Errorf("unexpected closed session: %+v", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("close callback is not called")
+	}
+}
@@ -0,0 +1,298 @@
+// Package client is a client of the backend API of kuiperbelt.
+// It also has helpers to implement and verify the callback handlers of backend applications.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSessionHeader is the default name of the header having session keys.
+	DefaultSessionHeader = "X-Kuiperbelt-Session"
+	// DefaultBulkConcurrency is the default number of concurrent requests in Bulk.
+	DefaultBulkConcurrency = 8
+
+	closeCodeHeader   = "X-Kuiperbelt-Close-Code"
+	closeReasonHeader = "X-Kuiperbelt-Close-Reason"
+
+	// unixHost is the host of the request URL over a UNIX domain socket.
+	unixHost = "kuiperbelt"
+)
+
+// Path is the paths of the backend API. They must be the same as `path` in the configuration of kuiperbelt.
+type Path struct {
+	Send  string
+	Close string
+	Stats string
+}
+
+// Client sends requests to the backend API of kuiperbelt.
+type Client struct {
+	// SessionHeader must be the same as `session_header` in the configuration of kuiperbelt.
+	SessionHeader string
+	Path          Path
+	// BulkConcurrency is the maximum number of concurrent requests in Bulk.
+	BulkConcurrency int
+	HTTPClient      *http.Client
+
+	baseURL string
+}
+
+// Message is a message to the sessions.
+type Message struct {
+	Sessions    []string
+	ContentType string
+	Body        []byte
+}
+
+// New returns a client of the endpoint.
+// The endpoint is a URL like "http://localhost:9180", or a UNIX domain socket like "unix:///var/run/kuiperbelt.sock".
+func New(endpoint string) (*Client, error) {
+	c := &Client{
+		SessionHeader: DefaultSessionHeader,
+		Path: Path{
+			Send:  "/send",
+			Close: "/close",
+			Stats: "/stats",
+		},
+		BulkConcurrency: DefaultBulkConcurrency,
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid endpoint")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		c.baseURL = strings.TrimSuffix(u.String(), "/")
+		c.HTTPClient = new(http.Client)
+	case "unix":
+		sock := u.Path
+		if sock == "" {
+			sock = u.Opaque
+		}
+		if sock == "" {
+			return nil, errors.Errorf("socket path is missing: %s", endpoint)
+		}
+		c.baseURL = "http://" + unixHost
+		c.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sock)
+				},
+			},
+		}
+	default:
+		return nil, errors.Errorf("unsupported endpoint: %s", endpoint)
+	}
+	return c, nil
+}
+
+// Send sends the message to the sessions by POST /send.
+// If the message is not delivered to some sessions, it returns *Error.
+func (c *Client) Send(ctx context.Context, m Message) error {
+	req, err := c.newRequest(ctx, c.Path.Send, m)
+	if err != nil {
+		return err
+	}
+	return c.do(req)
+}
+
+// Close sends the last message to the sessions and closes them by POST /close.
+// code and reason are the close frame. If code is 0, kuiperbelt uses 1000 (normal closure).
+func (c *Client) Close(ctx context.Context, m Message, code int, reason string) error {
+	req, err := c.newRequest(ctx, c.Path.Close, m)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		req.Header.Set(closeCodeHeader, strconv.Itoa(code))
+	}
+	if reason != "" {
+		req.Header.Set(closeReasonHeader, reason)
+	}
+	return c.do(req)
+}
+
+// Bulk sends the messages concurrently. It returns the errors in the same order as the messages.
+// An error is nil if the message is delivered to all of the sessions.
+func (c *Client) Bulk(ctx context.Context, ms []Message) []error {
+	errs := make([]error, len(ms))
+	n := c.BulkConcurrency
+	if n <= 0 {
+		n = DefaultBulkConcurrency
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, m := range ms {
+		i, m := i, m
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.Send(ctx, m)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Stats is the statistics of kuiperbelt responded by GET /stats.
+type Stats struct {
+	Connections        int64   `json:"connections"`
+	TotalConnections   int64   `json:"total_connections"`
+	TotalMessages      int64   `json:"total_messages"`
+	ConnectErrors      int64   `json:"connect_errors"`
+	MessageErrors      int64   `json:"message_errors"`
+	ClosingConnections int64   `json:"closing_connections"`
+	ConnectRejects     int64   `json:"connect_rejects"`
+	InboundRateLimited int64   `json:"inbound_rate_limited"`
+	InboundTooLarge    int64   `json:"inbound_too_large"`
+	CompressionRatio   float64 `json:"compression_ratio"`
+	PongTimeouts       int64   `json:"pong_timeouts"`
+	ConnectCacheHits   int64   `json:"connect_cache_hits"`
+	ConnectCacheMisses int64   `json:"connect_cache_misses"`
+	OriginRejects      int64   `json:"origin_rejects"`
+}
+
+// Stats gets the statistics by GET /stats.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+c.Path.Stats, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create stats request")
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed stats request")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read stats response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp.StatusCode, body)
+	}
+	var s Stats
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, errors.Wrap(err, "cannot decode stats response")
+	}
+	return &s, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, path string, m Message) (*http.Request, error) {
+	if len(m.Sessions) == 0 {
+		return nil, errors.New("sessions are missing")
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(m.Body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	for _, key := range m.Sessions {
+		req.Header.Add(c.SessionHeader, key)
+	}
+	if m.ContentType != "" {
+		req.Header.Set("Content-Type", m.ContentType)
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (c *Client) do(req *http.Request) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed request")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "cannot read response")
+	}
+	e := newError(resp.StatusCode, body)
+	if e.StatusCode == http.StatusOK && e.Result == "OK" && len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SessionError is an error of a session in the response.
+// Session is empty if the error is of the request.
+type SessionError struct {
+	Session string `json:"session"`
+	Message string `json:"error"`
+}
+
+func (e SessionError) Error() string {
+	if e.Session == "" {
+		return e.Message
+	}
+	return e.Session + ": " + e.Message
+}
+
+// Error is an unsuccessful response of the backend API.
+type Error struct {
+	StatusCode int
+	// Result is "OK" if the message is delivered to the other sessions, or "NG".
+	Result string
+	Errors []SessionError
+}
+
+// newError decodes the response. The body which is not the result of kuiperbelt is an error of the request.
+func newError(statusCode int, body []byte) *Error {
+	var res struct {
+		Errors []SessionError `json:"errors"`
+		Result string         `json:"result"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.Result == "" {
+		res.Result = "NG"
+		res.Errors = nil
+		if msg := strings.TrimSpace(string(body)); msg != "" {
+			res.Errors = []SessionError{{Message: msg}}
+		}
+	}
+	return &Error{
+		StatusCode: statusCode,
+		Result:     res.Result,
+		Errors:     res.Errors,
+	}
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, se := range e.Errors {
+		msgs = append(msgs, se.Error())
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, http.StatusText(e.StatusCode))
+	}
+	return "kuiperbelt: " + strings.Join(msgs, ", ")
+}
+
+// Partial reports whether the message is delivered to the sessions except the errors.
+func (e *Error) Partial() bool {
+	return e.Result == "OK"
+}
+
+// Sessions returns the keys of the sessions which the message is not delivered to.
+func (e *Error) Sessions() []string {
+	var keys []string
+	for _, se := range e.Errors {
+		if se.Session != "" {
+			keys = append(keys, se.Session)
+		}
+	}
+	return keys
+}
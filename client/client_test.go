@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kuiperbelt/kuiperbelt"
+)
+
+type testSession struct {
+	key    string
+	send   chan kuiperbelt.Message
+	closed chan struct{}
+}
+
+func newTestSession(key string) *testSession {
+	return &testSession{
+		key:    key,
+		send:   make(chan kuiperbelt.Message, 4),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *testSession) Send() chan<- kuiperbelt.Message { return s.send }
+func (s *testSession) Key() string                     { return s.key }
+func (s *testSession) Close() error                    { return nil }
+func (s *testSession) Closed() <-chan struct{}         { return s.closed }
+
+func testProxy(strict bool, keys ...string) (*kuiperbelt.Proxy, map[string]*testSession) {
+	var pool kuiperbelt.SessionPool
+	sessions := map[string]*testSession{}
+	for _, key := range keys {
+		s := newTestSession(key)
+		pool.Add(s)
+		sessions[key] = s
+	}
+	c := kuiperbelt.Config{
+		SessionHeader:   DefaultSessionHeader,
+		StrictBroadcast: strict,
+	}
+	return kuiperbelt.NewProxy(c, kuiperbelt.NewStats(), &pool), sessions
+}
+
+func testHandler(p *kuiperbelt.Proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", p.SendHandlerFunc)
+	mux.HandleFunc("/close", p.CloseHandlerFunc)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		p.Stats.Dump(w)
+	})
+	return mux
+}
+
+func testServer(p *kuiperbelt.Proxy) *httptest.Server {
+	return httptest.NewServer(testHandler(p))
+}
+
+func TestClient__Send(t *testing.T) {
+	p, sessions := testProxy(false, "hogehoge", "fugafuga")
+	ts := testServer(p)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal("cannot create client:", err)
+	}
+	ctx := context.Background()
+
+	err = c.Send(ctx, Message{
+		Sessions:    []string{"hogehoge", "fugafuga"},
+		ContentType: "application/json",
+		Body:        []byte(`{"hello":"world"}`),
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, s := range sessions {
+		if m := <-s.send; string(m.Body) != `{"hello":"world"}` || m.ContentType != "application/json" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	}
+
+	err = c.Send(ctx, Message{Sessions: []string{"hogehoge", "piyopiyo"}, Body: []byte("hello")})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if !e.Partial() || !reflect.DeepEqual(e.Sessions(), []string{"piyopiyo"}) {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	<-sessions["hogehoge"].send
+
+	if err := c.Send(ctx, Message{Body: []byte("hello")}); err == nil {
+		t.Error("message without sessions must fail")
+	}
+}
+
+func TestClient__SendStrict(t *testing.T) {
+	p, sessions := testProxy(true, "hogehoge")
+	ts := testServer(p)
+	defer ts.Close()
+	c, _ := New(ts.URL)
+
+	err := c.Send(context.Background(), Message{Sessions: []string{"hogehoge", "piyopiyo"}, Body: []byte("hello")})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if e.Partial() || e.StatusCode != http.StatusBadRequest || !reflect.DeepEqual(e.Sessions(), []string{"piyopiyo"}) {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	if len(sessions["hogehoge"].send) != 0 {
+		t.Error("message must not be sent in strict broadcast")
+	}
+}
+
+func TestClient__Close(t *testing.T) {
+	p, sessions := testProxy(false, "hogehoge")
+	ts := testServer(p)
+	defer ts.Close()
+	c, _ := New(ts.URL)
+	ctx := context.Background()
+
+	err := c.Close(ctx, Message{Sessions: []string{"hogehoge"}, Body: []byte("bye")}, 4000, "maintenance")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	m := <-sessions["hogehoge"].send
+	if !m.LastWord || string(m.Body) != "bye" || m.CloseCode != 4000 || m.CloseReason != "maintenance" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+
+	err = c.Close(ctx, Message{Sessions: []string{"hogehoge"}}, 2000, "")
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadRequest || len(e.Errors) != 1 || e.Errors[0].Message != "invalid close code: 2000" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestClient__Bulk(t *testing.T) {
+	p, sessions := testProxy(false, "hogehoge", "fugafuga")
+	ts := testServer(p)
+	defer ts.Close()
+	c, _ := New(ts.URL)
+	c.BulkConcurrency = 2
+
+	errs := c.Bulk(context.Background(), []Message{
+		{Sessions: []string{"hogehoge"}, Body: []byte("1")},
+		{Sessions: []string{"piyopiyo"}, Body: []byte("2")},
+		{Sessions: []string{"fugafuga"}, Body: []byte("3")},
+	})
+	if len(errs) != 3 || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if m := <-sessions["hogehoge"].send; string(m.Body) != "1" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if m := <-sessions["fugafuga"].send; string(m.Body) != "3" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
+
+func TestClient__UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kuiperbelt-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "kuiperbelt.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	p, _ := testProxy(false, "hogehoge")
+	ts := httptest.NewUnstartedServer(testHandler(p))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	c, err := New("unix://" + sock)
+	if err != nil {
+		t.Fatal("cannot create client:", err)
+	}
+	ctx := context.Background()
+	if err := c.Send(ctx, Message{Sessions: []string{"hogehoge"}, Body: []byte("hello")}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats.TotalMessages != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestNew__InvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"ftp://localhost", "unix://", "localhost:9180"} {
+		if _, err := New(endpoint); err == nil {
+			t.Errorf("%s must be invalid", endpoint)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Verifier calls callback handlers with the requests as kuiperbelt sends, and verifies the responses.
+// It is for tests of backend applications.
+type Verifier struct {
+	// SessionHeader must be the same as `session_header` in the configuration of kuiperbelt.
+	// The default is DefaultSessionHeader.
+	SessionHeader string
+	// Endpoint is sent in X-Kuiperbelt-Endpoint header. The default is "localhost:9180".
+	Endpoint string
+}
+
+func (v *Verifier) sessionHeader() string {
+	if v.SessionHeader == "" {
+		return DefaultSessionHeader
+	}
+	return v.SessionHeader
+}
+
+func (v *Verifier) endpoint() string {
+	if v.Endpoint == "" {
+		return "localhost:9180"
+	}
+	return v.Endpoint
+}
+
+// Connect calls the connect callback handler with the request of a client.
+// The subprotocols in Sec-WebSocket-Protocol header of the request are sent in X-Kuiperbelt-Subprotocols header.
+// A response except 200 is returned as *CallbackError.
+func (v *Verifier) Connect(h http.Handler, r *http.Request) (*ConnectResponse, error) {
+	req := r.Clone(r.Context())
+	var protocols []string
+	for _, p := range strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	for name := range req.Header {
+		n := strings.ToLower(name)
+		if n == "connection" || n == "upgrade" || strings.HasPrefix(n, "sec-websocket") {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set(endpointHeader, v.endpoint())
+	if len(protocols) > 0 {
+		req.Header.Set(subprotocolsHeader, strings.Join(protocols, ", "))
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return nil, &CallbackError{StatusCode: w.Code, Message: strings.TrimSpace(w.Body.String())}
+	}
+	res, err := parseConnectResponse(w.Header(), w.Body.Bytes(), v.sessionHeader())
+	if err != nil {
+		return nil, err
+	}
+	if res.Subprotocol != "" && !hasString(protocols, res.Subprotocol) {
+		return nil, errors.Errorf("subprotocol %q is not requested by the client", res.Subprotocol)
+	}
+	return res, nil
+}
+
+// Establish calls the establish callback handler.
+func (v *Verifier) Establish(h http.Handler, req *EstablishRequest) error {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(v.sessionHeader(), req.Session)
+	setMetadata(r.Header, req.Metadata)
+	r.Header.Set(endpointHeader, v.endpoint())
+	return serve(h, r)
+}
+
+// Receive calls the receive callback handler with the message from a client.
+// If the content type of the message is empty, it is "text/plain".
+func (v *Verifier) Receive(h http.Handler, m *ReceivedMessage) error {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(m.Body))
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set(endpointHeader, v.endpoint())
+	r.Header.Set(v.sessionHeader(), m.Session)
+	setMetadata(r.Header, m.Metadata)
+	if m.Subprotocol != "" {
+		r.Header.Set(subprotocolHeader, m.Subprotocol)
+	}
+	return serve(h, r)
+}
+
+// Close calls the close callback handler.
+func (v *Verifier) Close(h http.Handler, s *ClosedSession) error {
+	payload := *s
+	if payload.Endpoint == "" {
+		payload.Endpoint = v.endpoint()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal close callback payload")
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(v.sessionHeader(), s.Session)
+	setMetadata(r.Header, s.Metadata)
+	if s.Subprotocol != "" {
+		r.Header.Set(subprotocolHeader, s.Subprotocol)
+	}
+	return serve(h, r)
+}
+
+// serve calls the handler, and returns *CallbackError if the response is not 200.
+func serve(h http.Handler, r *http.Request) error {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return &CallbackError{StatusCode: w.Code, Message: strings.TrimSpace(w.Body.String())}
+	}
+	return nil
+}
+
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// FORWARDED_HEADER_NAME marks a request forwarded by another node in cluster mode.
+	// Forwarded requests are never forwarded again.
+	FORWARDED_HEADER_NAME = "X-Kuiperbelt-Forwarded"
+)
+
+var clusterClient = &http.Client{
+	Transport: &http.Transport{
+		MaxIdleConnsPerHost: CALLBACK_CLIENT_MAX_CONNS_PER_HOST,
+		IdleConnTimeout:     callbackPersistentLimit,
+	},
+}
+
+// SessionDirectory maps session keys to the endpoints of nodes holding the sessions.
+type SessionDirectory interface {
+	// Register records that the session is held by the node of endpoint.
+	Register(ctx context.Context, key, endpoint string) error
+	// Unregister removes the session if it is held by the node of endpoint.
+	Unregister(ctx context.Context, key, endpoint string) error
+	// Lookup returns the endpoints of nodes holding the sessions. Unknown keys are not included.
+	Lookup(ctx context.Context, keys []string) (map[string]string, error)
+}
+
+// MemoryDirectory is a SessionDirectory in memory.
+// It is shared by nodes in the same process, and useful for testing.
+type MemoryDirectory struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+// NewMemoryDirectory returns a new MemoryDirectory.
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		m: make(map[string]string),
+	}
+}
+
+func (d *MemoryDirectory) Register(ctx context.Context, key, endpoint string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = endpoint
+	return nil
+}
+
+func (d *MemoryDirectory) Unregister(ctx context.Context, key, endpoint string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.m[key] == endpoint {
+		delete(d.m, key)
+	}
+	return nil
+}
+
+func (d *MemoryDirectory) Lookup(ctx context.Context, keys []string) (map[string]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	found := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if endpoint, ok := d.m[key]; ok {
+			found[key] = endpoint
+		}
+	}
+	return found, nil
+}
+
+// PeerDirectory is a SessionDirectory which asks the peer nodes whether they hold the sessions.
+// Each node knows its own sessions, so Register and Unregister do nothing.
+type PeerDirectory struct {
+	config Config
+	peers  func() []string
+}
+
+// NewPeerDirectory returns a new PeerDirectory. peers returns the endpoints of the other nodes.
+func NewPeerDirectory(c Config, peers func() []string) *PeerDirectory {
+	return &PeerDirectory{
+		config: c,
+		peers:  peers,
+	}
+}
+
+func (d *PeerDirectory) Register(ctx context.Context, key, endpoint string) error {
+	return nil
+}
+
+func (d *PeerDirectory) Unregister(ctx context.Context, key, endpoint string) error {
+	return nil
+}
+
+func (d *PeerDirectory) Lookup(ctx context.Context, keys []string) (map[string]string, error) {
+	if d.config.Cluster.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.Cluster.Timeout)
+		defer cancel()
+	}
+
+	found := make(map[string]string, len(keys))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range d.peers() {
+		peer := peer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions, err := d.lookupPeer(ctx, peer, keys)
+			if err != nil {
+				Log.Warn("failed lookup sessions",
+					zap.Error(err),
+					zap.String("peer", peer),
+				)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for key, endpoint := range sessions {
+				found[key] = endpoint
+			}
+		}()
+	}
+	wg.Wait()
+	return found, nil
+}
+
+func (d *PeerDirectory) lookupPeer(ctx context.Context, peer string, keys []string) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+d.config.Path.ClusterLookup, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create lookup request")
+	}
+	req = req.WithContext(ctx)
+	for _, key := range keys {
+		req.Header.Add(d.config.SessionHeader, key)
+	}
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed post lookup request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrap(errCallbackResponseNotOK(resp.StatusCode), "unsuccessful post lookup request")
+	}
+	var res struct {
+		Sessions map[string]string `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "cannot decode lookup response")
+	}
+	return res.Sessions, nil
+}
+
+// ClusterLookupHandlerFunc handles POST /cluster/lookup request.
+// It responds the sessions held by this node among the requested session keys.
+func (p *Proxy) ClusterLookupHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"errors":[{"error":"required POST method"}],"result":"NG"}`)
+		return
+	}
+	sessions := make(map[string]string)
+	for _, key := range r.Header[p.Config.SessionHeader] {
+		if _, err := p.Pool.Get(key); err == nil {
+			sessions[key] = p.Config.Endpoint
+		}
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Sessions map[string]string `json:"sessions"`
+		Result   string            `json:"result"`
+	}{
+		Sessions: sessions,
+		Result:   "OK",
+	})
+}
+
+// resolveRemoteSessions looks up the nodes holding the sessions not found in this node.
+// It returns the session keys grouped by the endpoint and the errors of sessions not found in the cluster.
+// A request forwarded from the other node, having header FORWARDED_HEADER_NAME, is not forwarded again.
+func (p *Proxy) resolveRemoteSessions(ctx context.Context, header http.Header, se sessionErrors) (map[string][]string, sessionErrors) {
+	if p.Directory == nil || header.Get(FORWARDED_HEADER_NAME) != "" || len(se) == 0 {
+		return nil, se
+	}
+
+	keys := make([]string, 0, len(se))
+	for _, e := range se {
+		keys = append(keys, e.Session)
+	}
+	found, err := p.Directory.Lookup(ctx, keys)
+	if err != nil {
+		Log.Error("failed lookup session directory", zap.Error(err))
+		return nil, se
+	}
+
+	remote := make(map[string][]string)
+	rest := make(sessionErrors, 0, len(se))
+	for _, e := range se {
+		endpoint, ok := found[e.Session]
+		if !ok || endpoint == p.Config.Endpoint {
+			rest = append(rest, e)
+			continue
+		}
+		remote[endpoint] = append(remote[endpoint], e.Session)
+	}
+	return remote, rest
+}
+
+// forward forwards the request of path having header to the node of endpoint and returns the errors of the sessions.
+func (p *Proxy) forward(ctx context.Context, path string, header http.Header, endpoint string, keys []string, body []byte, tc traceContext) []sessionError {
+	errorsOf := func(err error) []sessionError {
+		Log.Error("failed forward request",
+			zap.Error(err),
+			zap.String("endpoint", endpoint),
+		)
+		se := make([]sessionError, 0, len(keys))
+		for _, key := range keys {
+			se = append(se, sessionError{Error: err.Error(), Session: key})
+		}
+		return se
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return errorsOf(errors.Wrap(err, "cannot create forward request"))
+	}
+	req = req.WithContext(ctx)
+	for _, name := range []string{"Content-Type", CLOSE_CODE_HEADER_NAME, CLOSE_REASON_HEADER_NAME} {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	for _, key := range keys {
+		req.Header.Add(p.Config.SessionHeader, key)
+	}
+	req.Header.Set(FORWARDED_HEADER_NAME, p.Config.Endpoint)
+	tc.inject(req.Header)
+
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return errorsOf(errors.Wrap(err, "failed post forward request"))
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Errors []sessionError `json:"errors"`
+		Result string         `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return errorsOf(errors.Wrap(err, "cannot decode forward response"))
+	}
+	if resp.StatusCode != http.StatusOK && len(res.Errors) == 0 {
+		return errorsOf(errors.Wrap(errCallbackResponseNotOK(resp.StatusCode), "unsuccessful post forward request"))
+	}
+	return res.Errors
+}
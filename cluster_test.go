@@ -0,0 +1,129 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testNode struct {
+	proxy  *Proxy
+	pool   *SessionPool
+	server *httptest.Server
+}
+
+func newTestNode(c Config) *testNode {
+	var pool SessionPool
+	n := &testNode{pool: &pool}
+	mux := http.NewServeMux()
+	n.server = httptest.NewServer(mux)
+	c.Endpoint = strings.TrimPrefix(n.server.URL, "http://")
+	c.Cluster.Enabled = true
+	n.proxy = NewProxy(c, NewStats(), &pool)
+	mux.HandleFunc(c.Path.Send, n.proxy.SendHandlerFunc)
+	mux.HandleFunc(c.Path.Close, n.proxy.CloseHandlerFunc)
+	mux.HandleFunc(c.Path.ClusterLookup, n.proxy.ClusterLookupHandlerFunc)
+	return n
+}
+
+func (n *testNode) endpoint() string {
+	return n.proxy.Config.Endpoint
+}
+
+func testClusterSend(t *testing.T, url string, keys ...string) (int, sessionErrors) {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString("test message"))
+	if err != nil {
+		t.Fatal("proxy handler new request unexpected error:", err)
+	}
+	for _, key := range keys {
+		req.Header.Add(TestConfig.SessionHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("proxy handler request unexpected error:", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Errors sessionErrors `json:"errors"`
+		Result string        `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal("proxy handler response unexpected error:", err)
+	}
+	return resp.StatusCode, result.Errors
+}
+
+func TestCluster__MemoryDirectory(t *testing.T) {
+	d := NewMemoryDirectory()
+	a := newTestNode(TestConfig)
+	defer a.server.Close()
+	b := newTestNode(TestConfig)
+	defer b.server.Close()
+	a.proxy.Directory = d
+	b.proxy.Directory = d
+
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	s2 := &TestSession{key: "fugafuga", send: make(chan Message, 4)}
+	a.pool.Add(s1)
+	d.Register(context.Background(), s1.Key(), a.endpoint())
+	b.pool.Add(s2)
+	d.Register(context.Background(), s2.Key(), b.endpoint())
+
+	status, errs := testClusterSend(t, a.server.URL+TestConfig.Path.Send, "hogehoge", "fugafuga", "not-exist")
+	if status != http.StatusOK {
+		t.Errorf("unexpected status: %d", status)
+	}
+	if len(errs) != 1 || errs[0].Session != "not-exist" {
+		t.Errorf("unexpected errors: %+v", errs)
+	}
+	for _, s := range []*TestSession{s1, s2} {
+		select {
+		case msg := <-s.send:
+			if string(msg.Body) != "test message" {
+				t.Errorf("%s receives unexpected message: %s", s.Key(), string(msg.Body))
+			}
+		default:
+			t.Errorf("%s does not receive message", s.Key())
+		}
+	}
+
+	// a session removed from the pool but left in the directory.
+	b.pool.Delete(s2.Key())
+	_, errs = testClusterSend(t, a.server.URL+TestConfig.Path.Close, "fugafuga")
+	if len(errs) != 1 || errs[0].Session != "fugafuga" || errs[0].Error != errSessionNotFound.Error() {
+		t.Errorf("unexpected errors from forwarded node: %+v", errs)
+	}
+
+	d.Unregister(context.Background(), s2.Key(), a.endpoint())
+	if found, _ := d.Lookup(context.Background(), []string{s2.Key()}); found[s2.Key()] != b.endpoint() {
+		t.Error("session held by other node must not be unregistered")
+	}
+}
+
+func TestCluster__PeerDirectory(t *testing.T) {
+	a := newTestNode(TestConfig)
+	defer a.server.Close()
+	b := newTestNode(TestConfig)
+	defer b.server.Close()
+	a.proxy.Directory = NewPeerDirectory(a.proxy.Config, func() []string { return []string{b.endpoint()} })
+
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	b.pool.Add(s1)
+
+	status, errs := testClusterSend(t, a.server.URL+TestConfig.Path.Send, "hogehoge")
+	if status != http.StatusOK || len(errs) != 0 {
+		t.Errorf("unexpected response: %d %+v", status, errs)
+	}
+	select {
+	case msg := <-s1.send:
+		if string(msg.Body) != "test message" {
+			t.Errorf("unexpected message: %s", string(msg.Body))
+		}
+	default:
+		t.Error("session in the peer does not receive message")
+	}
+}
@@ -0,0 +1,77 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// offersDeflate reports whether the client offers permessage-deflate extension.
+func offersDeflate(h http.Header) bool {
+	for _, v := range h["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(v, ",") {
+			if i := strings.Index(ext, ";"); i >= 0 {
+				ext = ext[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(ext), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countingConn is a net.Conn counting written bytes.
+type countingConn struct {
+	net.Conn
+	written int64 // accessed atomically
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Written() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// countingHijacker is a http.ResponseWriter hijacking the connection as a countingConn.
+// It is used to measure the bytes on the wire of compressed messages.
+type countingHijacker struct {
+	http.ResponseWriter
+}
+
+func (h countingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("kuiperbelt: response does not implement http.Hijacker")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn}, rw, nil
+}
+
+// prepareMessage returns the message which is marshaled and compressed once for sending to many sessions.
+func prepareMessage(message Message) Message {
+	bs, messageType, err := messageMarshal(message)
+	if err != nil {
+		return message
+	}
+	pm, err := websocket.NewPreparedMessage(messageType, bs)
+	if err != nil {
+		Log.Error("cannot prepare message", zap.Error(err))
+		return message
+	}
+	message.prepared = pm
+	return message
+}
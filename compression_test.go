@@ -0,0 +1,102 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOffersDeflate(t *testing.T) {
+	tests := []struct {
+		header string
+		expect bool
+	}{
+		{"", false},
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"x-webkit-deflate-frame, permessage-deflate; server_no_context_takeover", true},
+		{"x-webkit-deflate-frame", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Sec-WebSocket-Extensions", tt.header)
+		}
+		if got := offersDeflate(h); got != tt.expect {
+			t.Errorf("unexpected result of %q: %t", tt.header, got)
+		}
+	}
+}
+
+func TestWebSocketServer__Compression(t *testing.T) {
+	var pool SessionPool
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(TestConfig.SessionHeader, r.Header.Get(testRequestSessionHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.Compression = Compression{Enabled: true, Level: 1, Threshold: 64}
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	p := NewProxy(c, st, &pool)
+	tp := httptest.NewServer(http.HandlerFunc(p.SendHandlerFunc))
+	defer tp.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	var conns []*websocket.Conn
+	for _, key := range []string{"hogehoge", "fugafuga"} {
+		conn, resp, err := dialer.Dial(wsURL, http.Header{
+			testRequestSessionHeader: []string{key},
+		})
+		if err != nil {
+			t.Fatal("cannot connect error:", err)
+		}
+		defer conn.Close()
+		if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(ext, "permessage-deflate") {
+			t.Fatalf("compression is not negotiated: %q", ext)
+		}
+		conns = append(conns, conn)
+	}
+
+	for i := 0; i < 50 && len(pool.List()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// broadcast a message over the threshold.
+	body := strings.Repeat(`{"message":"hello"}`, 100)
+	req, _ := http.NewRequest("POST", tp.URL, bytes.NewBufferString(body))
+	req.Header.Add(TestConfig.SessionHeader, "hogehoge")
+	req.Header.Add(TestConfig.SessionHeader, "fugafuga")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("send request unexpected error:", err)
+	}
+	resp.Body.Close()
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("cannot read message:", err)
+		}
+		if string(got) != body {
+			t.Errorf("unexpected message: %s", got)
+		}
+	}
+
+	ratio := st.CompressionRatio()
+	if ratio <= 0 || ratio >= 0.5 {
+		t.Errorf("unexpected compression ratio: %f", ratio)
+	}
+}
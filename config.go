@@ -1,6 +1,7 @@
 package kuiperbelt
 
 import (
+	"compress/flate"
 	"fmt"
 	"net"
 	"os"
@@ -20,6 +21,7 @@ var (
 	validOriginPolicies = []string{
 		"same_origin",
 		"same_hostname",
+		"allowlist",
 		"none",
 	}
 )
@@ -35,9 +37,28 @@ type Config struct {
 	SendTimeout       time.Duration     `yaml:"send_timeout"`
 	SendQueueSize     int               `yaml:"send_queue_size"`
 	OriginPolicy      string            `yaml:"origin_policy"`
+	OriginAllowlist   []string          `yaml:"origin_allowlist"`
 	IdleTimeout       time.Duration     `yaml:"idle_timeout"`
+	PingInterval      time.Duration     `yaml:"ping_interval"`
+	PongTimeout       time.Duration     `yaml:"pong_timeout"`
 	SuppressAccessLog bool              `yaml:"suppress_access_log"`
 	Path              Path              `yaml:"path"`
+	Trace             Trace             `yaml:"trace"`
+	SessionLog        SessionLog        `yaml:"session_log"`
+	AccessLog         AccessLog         `yaml:"access_log"`
+	TrustedProxies    []string          `yaml:"trusted_proxies"`
+	Admin             Admin             `yaml:"admin"`
+	Cluster           Cluster           `yaml:"cluster"`
+	Backplane         BackplaneConfig   `yaml:"backplane"`
+	ConnectionLimit   ConnectionLimit   `yaml:"connection_limit"`
+	InboundLimit      InboundLimit      `yaml:"inbound_limit"`
+	Compression       Compression       `yaml:"compression"`
+	JWT               JWTAuth           `yaml:"jwt"`
+	ConnectCache      ConnectCache      `yaml:"connect_cache"`
+	SSE               SSE               `yaml:"sse"`
+	LongPolling       LongPolling       `yaml:"long_polling"`
+	EventStream       EventStream       `yaml:"event_stream"`
+	GRPC              GRPC              `yaml:"grpc"`
 }
 
 type Callback struct {
@@ -54,6 +75,214 @@ type Path struct {
 	Stats   string `yaml:"stats"`
 	Send    string `yaml:"send"`
 	Ping    string `yaml:"ping"`
+	Metrics string `yaml:"metrics"`
+	Tap     string `yaml:"tap"`
+	Session string `yaml:"session"`
+	// SSE and SSEMessage are the endpoints of Server-Sent Events transport.
+	SSE        string `yaml:"sse"`
+	SSEMessage string `yaml:"sse_message"`
+	// Poll is the endpoint of long-polling transport.
+	Poll string `yaml:"poll"`
+	// Events is the endpoint of the event stream for backend consumers.
+	Events string `yaml:"events"`
+
+	ClusterLookup  string `yaml:"cluster_lookup"`
+	ClusterMembers string `yaml:"cluster_members"`
+	ClusterGossip  string `yaml:"cluster_gossip"`
+	Publish        string `yaml:"publish"`
+}
+
+// Cluster is the configuration of cluster mode.
+// In cluster mode, /send and /close requests for sessions held by other nodes are forwarded to them.
+type Cluster struct {
+	Enabled bool `yaml:"enabled"`
+	// Peers are the endpoints of the other nodes.
+	Peers   []string      `yaml:"peers"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Seeds are the endpoints of nodes to join the cluster by gossip.
+	// If set, the members found by gossip are used instead of Peers.
+	Seeds []string `yaml:"seeds"`
+	// Token is a bearer token of gossip between nodes. If empty, the admin token is used.
+	Token          string        `yaml:"token"`
+	GossipInterval time.Duration `yaml:"gossip_interval"`
+	// SuspectTimeout and DeadTimeout are durations since the last heartbeat
+	// to regard a member as suspect and dead.
+	SuspectTimeout time.Duration `yaml:"suspect_timeout"`
+	DeadTimeout    time.Duration `yaml:"dead_timeout"`
+}
+
+// Admin is the configuration of admin APIs.
+type Admin struct {
+	// Token is a bearer token to access admin APIs. If empty, admin APIs are disabled.
+	Token string `yaml:"token"`
+	// TapRate is the maximum number of events per second to an observer of /debug/tap.
+	TapRate  float64 `yaml:"tap_rate"`
+	TapBurst int     `yaml:"tap_burst"`
+}
+
+// Trace is the configuration of exporting spans to an OpenTelemetry collector.
+type Trace struct {
+	// Endpoint is the base URL of OTLP/HTTP collector. e.g. "http://localhost:4318"
+	Endpoint      string            `yaml:"endpoint"`
+	ServiceName   string            `yaml:"service_name"`
+	Headers       map[string]string `yaml:"headers"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+}
+
+// AccessLog is the configuration of the access log of backend APIs.
+type AccessLog struct {
+	// Path is a file to write the access log. If empty, the access log is written by the default logger.
+	Path string `yaml:"path"`
+	// Format is "ltsv" or "json".
+	Format string `yaml:"format"`
+}
+
+// SessionLog is the configuration of session lifecycle logs.
+type SessionLog struct {
+	// Format is "json" or "console". If empty, the session lifecycle logs are written by the default logger.
+	Format   string      `yaml:"format"`
+	Sampling LogSampling `yaml:"sampling"`
+}
+
+// LogSampling is the configuration of log sampling.
+// In each second, the first Initial entries with the same message are logged,
+// and after that every Thereafter-th entry is logged. 0 disables sampling.
+type LogSampling struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
+// ConnectionLimit is the configuration of admission control of connect requests.
+// Rejected requests receive 503 before the connect callback. 0 means unlimited.
+type ConnectionLimit struct {
+	MaxConnections      int `yaml:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// ConnectRate is the maximum number of connect requests per second.
+	ConnectRate       float64 `yaml:"connect_rate"`
+	ConnectBurst      int     `yaml:"connect_burst"`
+	ConnectRatePerIP  float64 `yaml:"connect_rate_per_ip"`
+	ConnectBurstPerIP int     `yaml:"connect_burst_per_ip"`
+	// RetryAfter is the value of Retry-After header when the number of connections exceeds the limit.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// InboundLimit is the configuration of limits of messages from a client in each session.
+type InboundLimit struct {
+	// MaxMessageSize is the maximum size of a message in bytes. 0 means unlimited.
+	MaxMessageSize int64 `yaml:"max_message_size"`
+	// Rate is the maximum number of messages per second. 0 means unlimited.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Policy is "drop", "notify" or "close". It decides how to handle a message over the limits.
+	//   drop:   the message is discarded.
+	//   notify: the message is discarded, and an error message is sent to the client.
+	//   close:  the session is closed with 1008 (rate) or 1009 (size).
+	Policy string `yaml:"policy"`
+}
+
+// Compression is the configuration of permessage-deflate extension.
+type Compression struct {
+	Enabled bool `yaml:"enabled"`
+	// Level is from -2 (huffman only) to 9 (best compression). The default is 1 (best speed).
+	Level int `yaml:"level"`
+	// Threshold is the minimum size in bytes of a message to be compressed.
+	Threshold int `yaml:"threshold"`
+}
+
+// JWTAuth is the configuration of authentication of connect requests by JWT.
+// A token is verified locally, and the session key and the metadata are taken from the claims.
+type JWTAuth struct {
+	Enabled bool `yaml:"enabled"`
+	// Query is the name of the query parameter having a token. The default is "token".
+	Query string `yaml:"query"`
+	// Header is the name of the header having a token. "Bearer " prefix is trimmed. The default is "Authorization".
+	Header string `yaml:"header"`
+	// HMACKeys are the secrets for HS256, HS384 and HS512 keyed by kid.
+	// Tokens without kid are verified by any of the keys.
+	HMACKeys map[string]string `yaml:"hmac_keys"`
+	// JWKSFile is a path of JSON Web Key Set having RSA and ECDSA public keys.
+	// It is reloaded at JWKSReloadInterval when modified. The default interval is 1 minute.
+	JWKSFile           string        `yaml:"jwks_file"`
+	JWKSReloadInterval time.Duration `yaml:"jwks_reload_interval"`
+	// Issuer and Audience are checked with iss and aud claims if not empty.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// Leeway is the allowed clock skew for exp and nbf claims.
+	Leeway time.Duration `yaml:"leeway"`
+	// SessionClaim is the claim of the session key. The default is "sub".
+	SessionClaim string `yaml:"session_claim"`
+	// MetadataClaims maps the metadata names to the claims. e.g. {"User-Id": "sub", "Roles": "roles"}
+	MetadataClaims map[string]string `yaml:"metadata_claims"`
+	// SkipConnectCallback skips the connect callback for authenticated requests.
+	SkipConnectCallback bool `yaml:"skip_connect_callback"`
+	// Expiry is "close" or "warn". It decides how to handle the session when the token expires.
+	//   close: the session is closed with 1008.
+	//   warn:  an error message is sent to the client.
+	Expiry string `yaml:"expiry"`
+}
+
+// ConnectCache is the configuration of caching decisions of the connect callback.
+// The status, the session key and the metadata of the callback response are cached,
+// and the connect requests with the same credentials skip the callback.
+type ConnectCache struct {
+	Enabled bool `yaml:"enabled"`
+	// Headers and Queries are the request headers and query parameters making the cache key.
+	Headers []string `yaml:"headers"`
+	Queries []string `yaml:"queries"`
+	// TTL is the lifetime of decisions without Cache-Control: max-age in the callback response.
+	// 0 means only the responses with max-age are cached.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxEntries is the maximum number of cached decisions. The default is 10000.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// SSE is the configuration of Server-Sent Events transport.
+type SSE struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// LongPolling is the configuration of long-polling transport.
+type LongPolling struct {
+	Enabled bool `yaml:"enabled"`
+	// Timeout is the maximum duration of a poll waiting for messages. The default is 30s.
+	Timeout time.Duration `yaml:"timeout"`
+	// Gap is the maximum duration between polls. The session is closed if no poll comes within it. The default is 1m.
+	Gap time.Duration `yaml:"gap"`
+	// MaxMessages is the maximum number of messages in a response of a poll. The default is 100.
+	MaxMessages int `yaml:"max_messages"`
+}
+
+// EventStream is the configuration of the stream of events to backend consumers.
+// If enabled, messages from clients are delivered to the consumers instead of the receive callback.
+type EventStream struct {
+	Enabled bool `yaml:"enabled"`
+	// Token is a bearer token of consumers. If empty, the admin token is used.
+	Token string `yaml:"token"`
+	// BufferSize is the number of events queued while all consumers are busy. The default is 1000.
+	BufferSize int `yaml:"buffer_size"`
+	// MaxInFlight is the maximum number of events not acknowledged by a consumer. The default is 100.
+	MaxInFlight int `yaml:"max_in_flight"`
+}
+
+// GRPC is the configuration of gRPC server of the backend API.
+// Requests are authorized by the admin token.
+type GRPC struct {
+	Enabled bool `yaml:"enabled"`
+	// Port is the port of gRPC server. The default is "9181".
+	Port string `yaml:"port"`
+	// Sock is the path of UNIX domain socket. If set, it is used instead of Port.
+	Sock string `yaml:"sock"`
+}
+
+// BackplaneConfig is the configuration of the message bus shared by nodes.
+type BackplaneConfig struct {
+	// Type is "redis". If empty, the backplane is disabled.
+	Type     string `yaml:"type"`
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	Channel  string `yaml:"channel"`
+	// Timeout is the timeout of a request to the backplane, including a publish. The default is 1s.
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 func NewConfig(filename string) (*Config, error) {
@@ -106,6 +335,38 @@ func tryBindDefaultToConfig(c *Config) (*Config, error) {
 		)
 	}
 
+	if c.OriginPolicy == "allowlist" {
+		if len(c.OriginAllowlist) == 0 {
+			return nil, fmt.Errorf("origin_allowlist is required by origin_policy allowlist")
+		}
+		if _, err := newOriginMatcher(c.OriginAllowlist); err != nil {
+			return nil, err
+		}
+	}
+
+	switch c.SessionLog.Format {
+	case "", "json", "console":
+	default:
+		return nil, fmt.Errorf("session_log.format is invalid. availables: [json, console] got: %s",
+			c.SessionLog.Format,
+		)
+	}
+
+	switch c.AccessLog.Format {
+	case "":
+		if c.AccessLog.Path != "" {
+			c.AccessLog.Format = "ltsv"
+		}
+	case "ltsv", "json":
+	default:
+		return nil, fmt.Errorf("access_log.format is invalid. availables: [ltsv, json] got: %s",
+			c.AccessLog.Format,
+		)
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return nil, err
+	}
+
 	if c.Path.Connect == "" {
 		c.Path.Connect = "/connect"
 	}
@@ -121,6 +382,195 @@ func tryBindDefaultToConfig(c *Config) (*Config, error) {
 	if c.Path.Ping == "" {
 		c.Path.Ping = "/ping"
 	}
+	if c.Path.Metrics == "" {
+		c.Path.Metrics = "/metrics"
+	}
+	if c.Path.Tap == "" {
+		c.Path.Tap = "/debug/tap"
+	}
+	if c.Path.Session == "" {
+		c.Path.Session = "/debug/session"
+	}
+	if c.Path.SSE == "" {
+		c.Path.SSE = "/sse"
+	}
+	if c.Path.SSEMessage == "" {
+		c.Path.SSEMessage = "/sse/message"
+	}
+	if c.Path.Poll == "" {
+		c.Path.Poll = "/poll"
+	}
+	if c.Path.Events == "" {
+		c.Path.Events = "/events"
+	}
+	if c.Path.ClusterLookup == "" {
+		c.Path.ClusterLookup = "/cluster/lookup"
+	}
+	if c.Path.ClusterMembers == "" {
+		c.Path.ClusterMembers = "/cluster/members"
+	}
+	if c.Path.ClusterGossip == "" {
+		c.Path.ClusterGossip = "/cluster/gossip"
+	}
+	if c.Path.Publish == "" {
+		c.Path.Publish = "/publish"
+	}
+
+	if c.Cluster.Enabled {
+		if len(c.Cluster.Seeds) > 0 && c.Cluster.Token == "" && c.Admin.Token == "" {
+			return nil, fmt.Errorf("cluster.token or admin.token is required by gossip")
+		}
+		if c.Cluster.GossipInterval == 0 {
+			c.Cluster.GossipInterval = time.Second
+		}
+		if c.Cluster.SuspectTimeout == 0 {
+			c.Cluster.SuspectTimeout = 5 * c.Cluster.GossipInterval
+		}
+		if c.Cluster.DeadTimeout == 0 {
+			c.Cluster.DeadTimeout = 2 * c.Cluster.SuspectTimeout
+		}
+	}
+
+	switch c.Backplane.Type {
+	case "":
+	case "redis":
+		if c.Backplane.Addr == "" {
+			c.Backplane.Addr = "localhost:6379"
+		}
+		if c.Backplane.Channel == "" {
+			c.Backplane.Channel = "kuiperbelt"
+		}
+		if c.Backplane.Timeout == 0 {
+			c.Backplane.Timeout = defaultBackplaneTimeout
+		}
+	default:
+		return nil, fmt.Errorf("backplane.type is invalid. availables: [redis] got: %s",
+			c.Backplane.Type,
+		)
+	}
+
+	if c.PingInterval != 0 && c.PongTimeout == 0 {
+		c.PongTimeout = c.PingInterval
+	}
+
+	if c.ConnectionLimit.RetryAfter == 0 {
+		c.ConnectionLimit.RetryAfter = time.Second
+	}
+	if c.ConnectionLimit.ConnectBurst == 0 {
+		c.ConnectionLimit.ConnectBurst = int(c.ConnectionLimit.ConnectRate)
+	}
+	if c.ConnectionLimit.ConnectBurstPerIP == 0 {
+		c.ConnectionLimit.ConnectBurstPerIP = int(c.ConnectionLimit.ConnectRatePerIP)
+	}
+
+	if c.InboundLimit.Burst == 0 {
+		c.InboundLimit.Burst = int(c.InboundLimit.Rate)
+	}
+	switch c.InboundLimit.Policy {
+	case "":
+		c.InboundLimit.Policy = "drop"
+	case "drop", "notify", "close":
+	default:
+		return nil, fmt.Errorf("inbound_limit.policy is invalid. availables: [drop, notify, close] got: %s",
+			c.InboundLimit.Policy,
+		)
+	}
+
+	if c.Compression.Enabled {
+		if c.Compression.Level == 0 {
+			c.Compression.Level = flate.BestSpeed
+		}
+		if c.Compression.Level < flate.HuffmanOnly || c.Compression.Level > flate.BestCompression {
+			return nil, fmt.Errorf("compression.level is invalid. availables: [-2..9] got: %d",
+				c.Compression.Level,
+			)
+		}
+	}
+
+	if c.JWT.Enabled {
+		if len(c.JWT.HMACKeys) == 0 && c.JWT.JWKSFile == "" {
+			return nil, fmt.Errorf("jwt.hmac_keys or jwt.jwks_file is required")
+		}
+		if c.JWT.Query == "" {
+			c.JWT.Query = "token"
+		}
+		if c.JWT.Header == "" {
+			c.JWT.Header = "Authorization"
+		}
+		if c.JWT.JWKSReloadInterval == 0 {
+			c.JWT.JWKSReloadInterval = time.Minute
+		}
+		if c.JWT.SessionClaim == "" {
+			c.JWT.SessionClaim = "sub"
+		}
+		switch c.JWT.Expiry {
+		case "":
+			c.JWT.Expiry = "close"
+		case "close", "warn":
+		default:
+			return nil, fmt.Errorf("jwt.expiry is invalid. availables: [close, warn] got: %s",
+				c.JWT.Expiry,
+			)
+		}
+	}
+
+	if c.ConnectCache.Enabled {
+		if len(c.ConnectCache.Headers) == 0 && len(c.ConnectCache.Queries) == 0 {
+			return nil, fmt.Errorf("connect_cache.headers or connect_cache.queries is required")
+		}
+		if c.ConnectCache.MaxEntries == 0 {
+			c.ConnectCache.MaxEntries = 10000
+		}
+	}
+
+	if c.LongPolling.Timeout == 0 {
+		c.LongPolling.Timeout = 30 * time.Second
+	}
+	if c.LongPolling.Gap == 0 {
+		c.LongPolling.Gap = time.Minute
+	}
+	if c.LongPolling.MaxMessages == 0 {
+		c.LongPolling.MaxMessages = 100
+	}
+
+	if c.EventStream.Enabled {
+		if c.EventStream.Token == "" && c.Admin.Token == "" {
+			return nil, fmt.Errorf("event_stream.token or admin.token is required")
+		}
+		if c.EventStream.BufferSize == 0 {
+			c.EventStream.BufferSize = 1000
+		}
+		if c.EventStream.MaxInFlight == 0 {
+			c.EventStream.MaxInFlight = 100
+		}
+	}
+
+	if c.GRPC.Enabled {
+		if c.Admin.Token == "" {
+			return nil, fmt.Errorf("admin.token is required by grpc")
+		}
+		if c.GRPC.Sock == "" && c.GRPC.Port == "" {
+			c.GRPC.Port = "9181"
+		}
+	}
+
+	if c.Admin.Token != "" {
+		if c.Admin.TapRate == 0 {
+			c.Admin.TapRate = 100
+		}
+		if c.Admin.TapBurst == 0 {
+			c.Admin.TapBurst = int(c.Admin.TapRate)
+		}
+	}
+
+	if c.Trace.Endpoint != "" {
+		if c.Trace.ServiceName == "" {
+			c.Trace.ServiceName = "kuiperbelt"
+		}
+		if c.Trace.FlushInterval == 0 {
+			c.Trace.FlushInterval = 5 * time.Second
+		}
+	}
 
 	return c, nil
 }
@@ -44,6 +44,30 @@ var TestConfig = Config{
 		Stats:   "/stats",
 		Ping:    "/ping",
 		Send:    "/send",
+		Metrics: "/metrics",
+		Tap:     "/debug/tap",
+		Session: "/debug/session",
+
+		SSE:        "/sse",
+		SSEMessage: "/sse/message",
+		Poll:       "/poll",
+		Events:     "/events",
+
+		ClusterLookup:  "/cluster/lookup",
+		ClusterMembers: "/cluster/members",
+		ClusterGossip:  "/cluster/gossip",
+		Publish:        "/publish",
+	},
+	ConnectionLimit: ConnectionLimit{
+		RetryAfter: time.Second,
+	},
+	InboundLimit: InboundLimit{
+		Policy: "drop",
+	},
+	LongPolling: LongPolling{
+		Timeout:     30 * time.Second,
+		Gap:         time.Minute,
+		MaxMessages: 100,
 	},
 }
 
@@ -0,0 +1,168 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectDecision is a cached response of the connect callback.
+// It keeps the headers which kuiperbelt uses and the body, to replay the response as the callback.
+type connectDecision struct {
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// connectCache caches decisions of the connect callback keyed by the credentials in requests.
+type connectCache struct {
+	config ConnectCache
+
+	mu      sync.Mutex
+	entries map[string]connectDecision
+}
+
+func newConnectCache(c ConnectCache) *connectCache {
+	if !c.Enabled {
+		return nil
+	}
+	return &connectCache{
+		config:  c,
+		entries: make(map[string]connectDecision),
+	}
+}
+
+// key returns the cache key of the request.
+// It returns an empty string if the request has none of the headers and the query parameters.
+func (c *connectCache) key(r *http.Request) string {
+	h := sha256.New()
+	found := false
+	write := func(kind, name string, values []string) {
+		if len(values) > 0 {
+			found = true
+		}
+		io.WriteString(h, kind+"\x00"+name+"\x00"+strings.Join(values, "\x00")+"\x00\x00")
+	}
+	for _, name := range c.config.Headers {
+		write("header", name, r.Header[http.CanonicalHeaderKey(name)])
+	}
+	query := r.URL.Query()
+	for _, name := range c.config.Queries {
+		write("query", name, query[name])
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *connectCache) get(key string, now time.Time) (connectDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[key]
+	if !ok {
+		return connectDecision{}, false
+	}
+	if !now.Before(d.expiresAt) {
+		delete(c.entries, key)
+		return connectDecision{}, false
+	}
+	return d, true
+}
+
+// store caches the decision in the callback response. Server errors are not cached.
+// It reads the body of the response, and replaces it to be read again.
+func (c *connectCache) store(key string, resp *http.Response, sessionHeader string, now time.Time) {
+	if resp.StatusCode != http.StatusOK && (resp.StatusCode < 400 || resp.StatusCode >= 500) {
+		return
+	}
+	ttl := cacheTTL(resp.Header, c.config.TTL)
+	if ttl <= 0 {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	d := connectDecision{
+		status:    resp.StatusCode,
+		header:    http.Header{},
+		body:      body,
+		expiresAt: now.Add(ttl),
+	}
+	for name, values := range resp.Header {
+		if name == "Content-Type" || name == http.CanonicalHeaderKey(sessionHeader) || strings.HasPrefix(name, "X-Kuiperbelt-") {
+			d.header[name] = append([]string(nil), values...)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		// evict an arbitrary entry if all entries are alive.
+		for k := range c.entries {
+			if len(c.entries) < c.config.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = d
+}
+
+// response returns the connect callback response of the decision.
+func (d connectDecision) response(r *http.Request) *http.Response {
+	h := make(http.Header, len(d.header))
+	for name, values := range d.header {
+		h[name] = append([]string(nil), values...)
+	}
+	return &http.Response{
+		StatusCode: d.status,
+		Header:     h,
+		Body:       ioutil.NopCloser(bytes.NewReader(d.body)),
+		Request:    r,
+	}
+}
+
+// errReader returns the error of reading the body after the bytes read.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// cacheTTL returns the lifetime by Cache-Control header. no-store and no-cache disable caching.
+func cacheTTL(h http.Header, ttl time.Duration) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			sec, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return 0
+			}
+			ttl = time.Duration(sec) * time.Second
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,198 @@
+package kuiperbelt
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		header string
+		expect time.Duration
+	}{
+		{"", time.Minute},
+		{"max-age=10", 10 * time.Second},
+		{"public, max-age=0", 0},
+		{"max-age=10, no-store", 0},
+		{"no-cache", 0},
+		{"max-age=abc", 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Cache-Control", tt.header)
+		}
+		if got := cacheTTL(h, time.Minute); got != tt.expect {
+			t.Errorf("unexpected ttl of %q: %s", tt.header, got)
+		}
+	}
+}
+
+func TestConnectCache(t *testing.T) {
+	c := newConnectCache(ConnectCache{
+		Enabled:    true,
+		Headers:    []string{"Authorization"},
+		Queries:    []string{"token"},
+		TTL:        time.Minute,
+		MaxEntries: 2,
+	})
+	r1 := httptest.NewRequest("GET", "/connect?token=a", nil)
+	r2 := httptest.NewRequest("GET", "/connect?token=b", nil)
+	r3 := httptest.NewRequest("GET", "/connect?token=a", nil)
+	r3.Header.Set("Authorization", "Bearer a")
+	if k := c.key(httptest.NewRequest("GET", "/connect?other=a", nil)); k != "" {
+		t.Errorf("request without credentials must not have a key: %s", k)
+	}
+	k1, k2, k3 := c.key(r1), c.key(r2), c.key(r3)
+	if k1 == "" || k1 == k2 || k1 == k3 || k1 != c.key(httptest.NewRequest("GET", "/connect?token=a&other=b", nil)) {
+		t.Errorf("unexpected keys: %s %s %s", k1, k2, k3)
+	}
+
+	now := time.Now()
+	newResponse := func(status int, body string) *http.Response {
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	}
+	resp := newResponse(http.StatusOK, "hello")
+	resp.Header.Set("X-Kuiperbelt-Session", "hogehoge")
+	resp.Header.Set("X-Kuiperbelt-Meta-User-Id", "42")
+	resp.Header.Set("Content-Type", "text/plain")
+	resp.Header.Set("Set-Cookie", "a=b")
+	c.store(k1, resp, "X-Kuiperbelt-Session", now)
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "hello" {
+		t.Errorf("the body of the stored response must be read again: %q", b)
+	}
+	c.store(k2, newResponse(http.StatusForbidden, "denied"), "X-Kuiperbelt-Session", now)
+	c.store(k3, newResponse(http.StatusBadGateway, ""), "X-Kuiperbelt-Session", now)
+
+	d, ok := c.get(k1, now)
+	if !ok {
+		t.Fatal("decision is not cached")
+	}
+	replayed := d.response(r1)
+	if b, _ := ioutil.ReadAll(replayed.Body); replayed.StatusCode != http.StatusOK || string(b) != "hello" {
+		t.Errorf("unexpected response: %+v %q", replayed, b)
+	}
+	if h := replayed.Header; h.Get("X-Kuiperbelt-Session") != "hogehoge" || h.Get("X-Kuiperbelt-Meta-User-Id") != "42" || h.Get("Content-Type") != "text/plain" || h.Get("Set-Cookie") != "" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+	if d, ok := c.get(k2, now); !ok || d.status != http.StatusForbidden || string(d.body) != "denied" {
+		t.Errorf("denial is not cached: %+v", d)
+	}
+	if _, ok := c.get(k3, now); ok {
+		t.Error("server error must not be cached")
+	}
+	if _, ok := c.get(k1, now.Add(time.Minute)); ok {
+		t.Error("expired decision must not be used")
+	}
+
+	// the entries are limited.
+	for _, k := range []string{"a", "b", "c"} {
+		c.store(k, newResponse(http.StatusOK, ""), "X-Kuiperbelt-Session", now)
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("unexpected entries: %d", len(c.entries))
+	}
+}
+
+func TestWebSocketServer__Handler__ConnectCache(t *testing.T) {
+	var pool SessionPool
+	var called int64
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&called, 1)
+		if r.URL.Query().Get("token") != "valid" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"invalid token"}`))
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set(TestConfig.SessionHeader, "hogehoge")
+		w.Header().Set("X-Kuiperbelt-Meta-User-Id", "42")
+		w.Header().Set(SUBPROTOCOL_HEADER_NAME, "chat.v2")
+		w.Header().Set(IDLE_TIMEOUT_HEADER_NAME, "42s")
+		w.Header().Set(SEND_QUEUE_SIZE_HEADER_NAME, "7")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.ConnectCache = ConnectCache{
+		Enabled:    true,
+		Queries:    []string{"token"},
+		MaxEntries: 10,
+	}
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+
+	// the second connection is accepted by the cached response as the first one.
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}}
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialer.Dial(wsURL+"?token=valid", nil)
+		if err != nil {
+			t.Fatal("cannot connect error:", err)
+		}
+		if p := conn.Subprotocol(); p != "chat.v2" {
+			t.Errorf("unexpected subprotocol of connection %d: %q", i, p)
+		}
+		if mt, body, err := conn.ReadMessage(); err != nil || mt != websocket.TextMessage || string(body) != "hello" {
+			t.Errorf("unexpected first message of connection %d: %d %q %v", i, mt, body, err)
+		}
+		var session *WebSocketSession
+		for j := 0; j < 50; j++ {
+			if s, err := pool.Get("hogehoge"); err == nil {
+				session = s.(*WebSocketSession)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if session == nil {
+			t.Fatal("session is not registered")
+		}
+		if session.metadata["User-Id"] != "42" {
+			t.Errorf("unexpected metadata: %v", session.metadata)
+		}
+		if session.subprotocol != "chat.v2" || session.config.IdleTimeout != 42*time.Second || session.config.SendQueueSize != 7 {
+			t.Errorf("unexpected session of connection %d: %q %+v", i, session.subprotocol, session.config)
+		}
+		conn.Close()
+		<-session.Closed()
+	}
+
+	for i := 0; i < 2; i++ {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?token=invalid", nil)
+		if err == nil {
+			t.Fatal("connection with invalid token must fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.Header.Get("Content-Type") != "application/json" || string(body) != `{"error":"invalid token"}` {
+			t.Errorf("unexpected denial of connection %d: %s %q", i, resp.Header.Get("Content-Type"), body)
+		}
+	}
+
+	if n := atomic.LoadInt64(&called); n != 3 {
+		t.Errorf("unexpected calls of connect callback: %d", n)
+	}
+	if st.ConnectCacheHits() != 1 || st.ConnectCacheMisses() != 3 {
+		t.Errorf("unexpected hits and misses: %d %d", st.ConnectCacheHits(), st.ConnectCacheMisses())
+	}
+}
@@ -0,0 +1,290 @@
+package kuiperbelt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// eventStreamUpgrader rejects cross-origin requests from browsers. Consumers are backend workers without Origin header.
+var eventStreamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// streamEvent is an event delivered to consumers of the event stream.
+type streamEvent struct {
+	ID uint64 `json:"id"`
+	// Type is "connect", "message" or "close".
+	Type    string `json:"type"`
+	Session string `json:"session"`
+
+	// Header, ContentType and Body are of a message from the client as the receive callback.
+	Header      http.Header `json:"header,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	Body        string      `json:"body,omitempty"`
+	// Base64 is true if Body is encoded in base64. Binary messages are encoded.
+	Base64 bool `json:"base64,omitempty"`
+
+	// Info is the state of the session at connect.
+	Info *sessionInspection `json:"info,omitempty"`
+	// Close is the same as the body of the close callback.
+	Close *closeCallbackPayload `json:"close,omitempty"`
+}
+
+// eventHub is a Receiver which delivers messages from clients to the consumers of the event stream.
+// An event is delivered to one of the consumers which has room for it, so events are balanced across consumers.
+// While no consumer is connected, messages are passed to the fallback if it is set.
+// Otherwise, events are queued in the buffer until a consumer connects, and dropped if the buffer is full.
+type eventHub struct {
+	sessionHeader string
+	stats         *Stats
+	events        chan *streamEvent
+	lastID        uint64 // accessed atomically
+	consumers     int64  // accessed atomically
+	// fallback receives messages while no consumer is connected. It is the receive callback if set.
+	fallback Receiver
+}
+
+func newEventHub(c Config, st *Stats) *eventHub {
+	if !c.EventStream.Enabled {
+		return nil
+	}
+	return &eventHub{
+		sessionHeader: c.SessionHeader,
+		stats:         st,
+		events:        make(chan *streamEvent, c.EventStream.BufferSize),
+	}
+}
+
+// Receive queues a message from the client to the consumers.
+// It does not block: the message is dropped and it fails if the queue is full.
+func (h *eventHub) Receive(ctx context.Context, m receivedMessage) error {
+	if h.fallback != nil && atomic.LoadInt64(&h.consumers) == 0 {
+		return h.fallback.Receive(ctx, m)
+	}
+	b, err := ioutil.ReadAll(m.Message)
+	if err != nil {
+		return errors.Wrap(err, "cannot read message")
+	}
+	e := &streamEvent{
+		Type:        "message",
+		Session:     m.Header.Get(h.sessionHeader),
+		Header:      m.Header,
+		ContentType: m.ContentType,
+	}
+	if m.ContentType == messageContentType(websocket.BinaryMessage) {
+		e.Body = base64.StdEncoding.EncodeToString(b)
+		e.Base64 = true
+	} else {
+		e.Body = string(b)
+	}
+	e.ID = atomic.AddUint64(&h.lastID, 1)
+	select {
+	case h.events <- e:
+		return nil
+	default:
+		h.stats.EventDropEvent()
+		return errors.Errorf("event stream is full. message %d is dropped", e.ID)
+	}
+}
+
+// publish queues an event of the session without blocking.
+// It is dropped if the queue is full, or if no consumer is connected while messages are passed to the fallback.
+func (h *eventHub) publish(e *streamEvent) {
+	if h.fallback != nil && atomic.LoadInt64(&h.consumers) == 0 {
+		return
+	}
+	e.ID = atomic.AddUint64(&h.lastID, 1)
+	h.requeue(e)
+}
+
+// requeue queues the event without blocking.
+func (h *eventHub) requeue(e *streamEvent) {
+	select {
+	case h.events <- e:
+	default:
+		h.stats.EventDropEvent()
+		Log.Warn("event stream is full. event is dropped",
+			zap.Uint64("id", e.ID),
+			zap.String("type", e.Type),
+			zap.String("session", e.Session),
+		)
+	}
+}
+
+// eventConsumer is a consumer of the event stream.
+// It has at most maxInFlight events which are not acknowledged.
+type eventConsumer struct {
+	hub    *eventHub
+	credit chan struct{}
+
+	mu       sync.Mutex
+	inflight map[uint64]*streamEvent
+}
+
+func newEventConsumer(h *eventHub, maxInFlight int) *eventConsumer {
+	return &eventConsumer{
+		hub:      h,
+		credit:   make(chan struct{}, maxInFlight),
+		inflight: make(map[uint64]*streamEvent),
+	}
+}
+
+// run writes events to the consumer until ctx is done or write fails.
+// write must call ack when the event is acknowledged.
+func (c *eventConsumer) run(ctx context.Context, write func(*streamEvent) error) {
+	atomic.AddInt64(&c.hub.consumers, 1)
+	defer atomic.AddInt64(&c.hub.consumers, -1)
+	for {
+		// wait for room of the consumer.
+		select {
+		case c.credit <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case e := <-c.hub.events:
+			c.mu.Lock()
+			c.inflight[e.ID] = e
+			c.mu.Unlock()
+			if err := write(e); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ack acknowledges the event, and makes room for the next event.
+func (c *eventConsumer) ack(id uint64) {
+	c.mu.Lock()
+	_, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	if ok {
+		<-c.credit
+	}
+}
+
+// requeue queues the events which are not acknowledged to the other consumers.
+func (c *eventConsumer) requeue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, e := range c.inflight {
+		c.hub.requeue(e)
+		delete(c.inflight, id)
+	}
+}
+
+// EventsHandler handles GET /events request of a backend consumer.
+// The request requires "Authorization: Bearer" header by event_stream.token, or the admin token if it is empty.
+// A WebSocket consumer receives an event in a text message, and acknowledges it by {"ack":<id>}.
+// Otherwise, events are streamed as newline delimited JSON. They are delivered at most once:
+// an event is acknowledged when it is written, so max_in_flight does not apply,
+// and an event written to a consumer which is gone is lost.
+func (s *WebSocketServer) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		http.NotFound(w, r)
+		return
+	}
+	token := s.Config.EventStream.Token
+	if token == "" {
+		token = s.Config.Admin.Token
+	}
+	if token == "" {
+		http.Error(w, "event stream consumer token is not set", http.StatusNotFound)
+		return
+	}
+	if !authorizeBearer(token, w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	maxInFlight := s.Config.EventStream.MaxInFlight
+	if v := r.FormValue("max_in_flight"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max_in_flight", http.StatusBadRequest)
+			return
+		}
+		if n < maxInFlight {
+			maxInFlight = n
+		}
+	}
+	consumer := newEventConsumer(s.events, maxInFlight)
+	defer consumer.requeue()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := eventStreamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			Log.Error("cannot upgrade", zap.Error(err))
+			return
+		}
+		defer conn.Close()
+		Log.Info("event consumer start",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("transport", "websocket"),
+		)
+		defer Log.Info("event consumer end",
+			zap.String("remote_addr", r.RemoteAddr),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			defer cancel()
+			for {
+				var ack struct {
+					Ack uint64 `json:"ack"`
+				}
+				if err := conn.ReadJSON(&ack); err != nil {
+					return
+				}
+				consumer.ack(ack.Ack)
+			}
+		}()
+		consumer.run(ctx, func(e *streamEvent) error {
+			return conn.WriteJSON(e)
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	Log.Info("event consumer start",
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("transport", "http"),
+	)
+	defer Log.Info("event consumer end",
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	consumer.run(r.Context(), func(e *streamEvent) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		flusher.Flush()
+		consumer.ack(e.ID)
+		return nil
+	})
+}
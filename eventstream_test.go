@@ -0,0 +1,262 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testEventMessage(key, body string) receivedMessage {
+	return newReceivedMessage(
+		websocket.TextMessage,
+		http.Header{TestConfig.SessionHeader: {key}},
+		strings.NewReader(body),
+	)
+}
+
+func TestEventHub__FlowControl(t *testing.T) {
+	c := TestConfig
+	c.EventStream = EventStream{Enabled: true, BufferSize: 10, MaxInFlight: 1}
+	hub := newEventHub(c, NewStats())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// a message is queued until a consumer connects.
+	if err := hub.Receive(ctx, testEventMessage("a", "0")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// two consumers with one event in flight.
+	consumers := make([]*eventConsumer, 2)
+	delivered := make(chan *streamEvent, 10)
+	consumerCtx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	for i := range consumers {
+		consumers[i] = newEventConsumer(hub, 1)
+		go func(c *eventConsumer) {
+			defer func() { done <- struct{}{} }()
+			c.run(consumerCtx, func(e *streamEvent) error {
+				delivered <- e
+				return nil
+			})
+		}(consumers[i])
+	}
+	for i := 0; i < 50 && atomic.LoadInt64(&hub.consumers) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err := hub.Receive(ctx, testEventMessage("a", body)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	var events []*streamEvent
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-delivered:
+			events = append(events, e)
+		case <-time.After(time.Second):
+			t.Fatal("event is not delivered")
+		}
+	}
+	if events[0].Type != "message" || events[0].Session != "a" || events[0].ContentType != "text/plain" || events[0].Body != "0" {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+	// the third event waits for an ack.
+	select {
+	case e := <-delivered:
+		t.Fatalf("event over max in flight is delivered: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, c := range consumers {
+		c.ack(events[0].ID)
+		c.ack(events[1].ID)
+	}
+	select {
+	case e := <-delivered:
+		if e.Body != "2" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event is not delivered after ack")
+	}
+
+	// events not acknowledged are queued again.
+	stop()
+	<-done
+	<-done
+	for _, c := range consumers {
+		c.requeue()
+	}
+	select {
+	case e := <-hub.events:
+		if e.Body != "2" {
+			t.Errorf("unexpected requeued event: %+v", e)
+		}
+	default:
+		t.Error("event is not requeued")
+	}
+}
+
+func TestEventHub__Full(t *testing.T) {
+	c := TestConfig
+	c.EventStream = EventStream{Enabled: true, BufferSize: 1, MaxInFlight: 1}
+	st := NewStats()
+	hub := newEventHub(c, st)
+
+	// without consumers nor the fallback, messages over the buffer are dropped without blocking.
+	done := make(chan error, 2)
+	go func() {
+		ctx := context.Background()
+		done <- hub.Receive(ctx, testEventMessage("a", "1"))
+		done <- hub.Receive(ctx, testEventMessage("a", "2"))
+	}()
+	for i, expectErr := range []bool{false, true} {
+		select {
+		case err := <-done:
+			if (err != nil) != expectErr {
+				t.Errorf("unexpected error of message %d: %v", i+1, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("receive blocks with the full buffer")
+		}
+	}
+	hub.publish(&streamEvent{Type: "close", Session: "a"})
+	if st.EventDrops() != 2 {
+		t.Errorf("unexpected event drops: %d", st.EventDrops())
+	}
+	if e := <-hub.events; e.Body != "1" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+type testReceiver struct {
+	messages chan receivedMessage
+}
+
+func (r *testReceiver) Receive(ctx context.Context, m receivedMessage) error {
+	r.messages <- m
+	return nil
+}
+
+func TestEventHub__Fallback(t *testing.T) {
+	c := TestConfig
+	c.EventStream = EventStream{Enabled: true, BufferSize: 10, MaxInFlight: 1}
+	hub := newEventHub(c, NewStats())
+	fallback := &testReceiver{messages: make(chan receivedMessage, 1)}
+	hub.fallback = fallback
+	ctx := context.Background()
+
+	// without consumers, messages are passed to the fallback, and events are dropped.
+	if err := hub.Receive(ctx, testEventMessage("a", "1")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if m := <-fallback.messages; m.Header.Get(TestConfig.SessionHeader) != "a" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	hub.publish(&streamEvent{Type: "connect", Session: "a"})
+	if len(hub.events) != 0 {
+		t.Errorf("event without consumers must be dropped: %d", len(hub.events))
+	}
+
+	atomic.AddInt64(&hub.consumers, 1)
+	if err := hub.Receive(ctx, testEventMessage("a", "2")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(fallback.messages) != 0 || len(hub.events) != 1 {
+		t.Errorf("message must be queued to the consumers: %d %d", len(fallback.messages), len(hub.events))
+	}
+}
+
+func TestWebSocketServer__EventsHandler(t *testing.T) {
+	c := TestConfig
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+	c.Callback.Connect = tcc.URL
+	c.EventStream = EventStream{Enabled: true, Token: "consumer-secret", BufferSize: 10, MaxInFlight: 10}
+
+	var pool SessionPool
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.Path.Connect, server.Handler)
+	mux.HandleFunc(c.Path.Events, server.EventsHandler)
+	tc := httptest.NewServer(mux)
+	defer tc.Close()
+
+	for _, auth := range []string{"", "Bearer invalid"} {
+		req, _ := http.NewRequest(http.MethodGet, tc.URL+c.Path.Events, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("consumer with %q must be unauthorized: %d", auth, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, tc.URL+c.Path.Events, nil)
+	req.Header.Set("Authorization", "Bearer consumer-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("cannot consume events:", err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewScanner(resp.Body)
+	next := func() streamEvent {
+		t.Helper()
+		var e streamEvent
+		if !events.Scan() {
+			t.Fatal("event stream is finished:", events.Err())
+		}
+		if err := json.Unmarshal(events.Bytes(), &e); err != nil {
+			t.Fatal("cannot decode event:", err)
+		}
+		return e
+	}
+	for i := 0; i < 50 && atomic.LoadInt64(&server.events.consumers) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1) + c.Path.Connect
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{testRequestSessionHeader: {"hogehoge"}})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	if e := next(); e.Type != "connect" || e.Session != "hogehoge" || e.Info == nil || e.Info.Transport != "websocket" {
+		t.Errorf("unexpected connect event: %+v", e)
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0x00, 0x01})
+	if e := next(); e.Type != "message" || e.Body != "AAE=" || !e.Base64 || e.ContentType != "application/octet-stream" {
+		t.Errorf("unexpected message event: %+v", e)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	conn.Close()
+	if e := next(); e.Type != "close" || e.Session != "hogehoge" || e.Close == nil || e.Close.Initiator != "client" {
+		t.Errorf("unexpected close event: %+v", e)
+	}
+
+	// a consumer from a browser of another origin is rejected.
+	eventsURL := strings.Replace(tc.URL, "http://", "ws://", -1) + c.Path.Events
+	_, wsResp, err := websocket.DefaultDialer.Dial(eventsURL, http.Header{
+		"Authorization": {"Bearer consumer-secret"},
+		"Origin":        {"http://evil.example.com"},
+	})
+	if err == nil || wsResp == nil || wsResp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin consumer must be rejected: %v %+v", err, wsResp)
+	}
+}
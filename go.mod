@@ -3,7 +3,6 @@ module github.com/kuiperbelt/kuiperbelt
 go 1.13
 
 require (
-	github.com/BurntSushi/toml v0.3.0 // indirect
 	github.com/google/gops v0.3.3
 	github.com/gorilla/websocket v1.4.1
 	github.com/kardianos/osext v0.0.0-20170510131534-ae77be60afb1 // indirect
@@ -13,5 +12,6 @@ require (
 	go.uber.org/atomic v1.2.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.7.1
-	gopkg.in/yaml.v2 v2.1.1 // indirect
+	google.golang.org/grpc v1.36.1
+	google.golang.org/protobuf v1.26.0
 )
@@ -0,0 +1,278 @@
+package kuiperbelt
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kuiperbelt/kuiperbelt/kuiperbeltpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer serves the backend API over gRPC. It shares the sessions with the HTTP API of the Proxy.
+// The service is defined in proto/kuiperbelt.proto.
+// Requests must have the admin token in "authorization" metadata.
+type GRPCServer struct {
+	kuiperbeltpb.UnimplementedKuiperbeltServer
+	proxy *Proxy
+}
+
+func NewGRPCServer(p *Proxy) *GRPCServer {
+	return &GRPCServer{proxy: p}
+}
+
+// Register registers the service to the gRPC server.
+func (s *GRPCServer) Register(gs *grpc.Server) {
+	kuiperbeltpb.RegisterKuiperbeltServer(gs, s)
+}
+
+// Send sends the message to the sessions as POST /send.
+func (s *GRPCServer) Send(ctx context.Context, req *kuiperbeltpb.SendRequest) (*kuiperbeltpb.SendResponse, error) {
+	return s.handle(ctx, "send", func(tc traceContext) (*kuiperbeltpb.SendResponse, error) {
+		if len(req.Sessions) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "sessions are missing")
+		}
+		return s.send(ctx, req, tc), nil
+	})
+}
+
+// SendStream sends messages in bulk. The requests are processed in order.
+// The stream is authorized once at the start.
+func (s *GRPCServer) SendStream(stream kuiperbeltpb.Kuiperbelt_SendStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := s.record(ctx, "send", func(tc traceContext) (*kuiperbeltpb.SendResponse, error) {
+			if len(req.Sessions) == 0 {
+				return &kuiperbeltpb.SendResponse{
+					Id:     req.Id,
+					Errors: []*kuiperbeltpb.SessionError{{Error: "sessions are missing"}},
+				}, nil
+			}
+			return s.send(ctx, req, tc), nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *GRPCServer) send(ctx context.Context, req *kuiperbeltpb.SendRequest, tc traceContext) *kuiperbeltpb.SendResponse {
+	message := Message{
+		Body:        req.Body,
+		ContentType: req.ContentType,
+		TraceParent: tc.Traceparent(),
+		TraceState:  tc.State,
+	}
+	header := make(http.Header)
+	if req.ContentType != "" {
+		header.Set("Content-Type", req.ContentType)
+	}
+	delivered, se := s.proxy.dispatch(ctx, s.proxy.Config.Path.Send, header, req.Sessions, message, tc)
+	return newSendResponse(req.Id, delivered, se)
+}
+
+// Close sends the last message to the sessions, and closes them as POST /close.
+func (s *GRPCServer) Close(ctx context.Context, req *kuiperbeltpb.CloseRequest) (*kuiperbeltpb.SendResponse, error) {
+	return s.handle(ctx, "close", func(tc traceContext) (*kuiperbeltpb.SendResponse, error) {
+		if len(req.Sessions) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "sessions are missing")
+		}
+		code := int(req.Code)
+		if code == 0 {
+			code = websocket.CloseNormalClosure
+		}
+		if !validCloseCode(code) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid close code: %d", req.Code)
+		}
+		if len(req.Reason) > maxCloseReasonSize {
+			return nil, status.Errorf(codes.InvalidArgument, "close reason is too long: %d bytes", len(req.Reason))
+		}
+		message := Message{
+			Body:          req.Body,
+			ContentType:   req.ContentType,
+			LastWord:      true,
+			FromPostClose: true,
+			CloseCode:     code,
+			CloseReason:   req.Reason,
+			TraceParent:   tc.Traceparent(),
+			TraceState:    tc.State,
+		}
+		header := make(http.Header)
+		if req.ContentType != "" {
+			header.Set("Content-Type", req.ContentType)
+		}
+		header.Set(CLOSE_CODE_HEADER_NAME, strconv.Itoa(code))
+		if req.Reason != "" {
+			header.Set(CLOSE_REASON_HEADER_NAME, req.Reason)
+		}
+		delivered, se := s.proxy.dispatch(ctx, s.proxy.Config.Path.Close, header, req.Sessions, message, tc)
+		return newSendResponse("", delivered, se), nil
+	})
+}
+
+// Broadcast sends the message to all sessions having the metadata.
+// The sessions in the other nodes receive it through the backplane if it is enabled.
+// Delivered in the response is the number of the sessions in this node.
+func (s *GRPCServer) Broadcast(ctx context.Context, req *kuiperbeltpb.BroadcastRequest) (*kuiperbeltpb.SendResponse, error) {
+	return s.handle(ctx, "broadcast", func(tc traceContext) (*kuiperbeltpb.SendResponse, error) {
+		if b := s.proxy.Backplane; b != nil {
+			e := Envelope{
+				Metadata:     req.Metadata,
+				Body:         req.Body,
+				ContentType:  req.ContentType,
+				Origin:       s.proxy.Config.Endpoint,
+				ExceptOrigin: true,
+				TraceParent:  tc.Traceparent(),
+				TraceState:   tc.State,
+			}
+			if err := b.Publish(ctx, e); err != nil {
+				Log.Error("failed publish to backplane", zap.Error(err))
+				return nil, status.Error(codes.Unavailable, "failed publish to backplane")
+			}
+		}
+		var keys []string
+		for _, session := range s.proxy.sessionsWithMetadata(req.Metadata) {
+			keys = append(keys, session.Key())
+		}
+		message := Message{
+			Body:        req.Body,
+			ContentType: req.ContentType,
+			TraceParent: tc.Traceparent(),
+			TraceState:  tc.State,
+		}
+		// the other nodes receive the message through the backplane, so the sessions closed
+		// since listed are not looked up in the cluster as a request forwarded by another node.
+		header := make(http.Header)
+		header.Set(FORWARDED_HEADER_NAME, s.proxy.Config.Endpoint)
+		delivered, se := s.proxy.dispatch(ctx, s.proxy.Config.Path.Send, header, keys, message, tc)
+		return newSendResponse("", delivered, se), nil
+	})
+}
+
+// ListSessions returns the sessions in this node having the metadata.
+func (s *GRPCServer) ListSessions(ctx context.Context, req *kuiperbeltpb.ListSessionsRequest) (*kuiperbeltpb.ListSessionsResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	resp := &kuiperbeltpb.ListSessionsResponse{}
+	for _, session := range s.proxy.sessionsWithMetadata(req.Metadata) {
+		pb := &kuiperbeltpb.Session{Session: session.Key()}
+		if i, ok := session.(inspector); ok {
+			in := i.inspect()
+			pb.Transport = in.Transport
+			pb.RemoteAddr = in.RemoteAddr
+			pb.UserAgent = in.UserAgent
+			pb.Origin = in.Origin
+			pb.Subprotocol = in.Subprotocol
+			pb.Metadata = in.Metadata
+			pb.ConnectedAt = timestamppb.New(in.ConnectedAt)
+			pb.SentMessages = in.SentMessages
+			pb.SentBytes = in.SentBytes
+			pb.ReceivedMessages = in.ReceivedMessages
+			pb.ReceivedBytes = in.ReceivedBytes
+		}
+		resp.Sessions = append(resp.Sessions, pb)
+	}
+	return resp, nil
+}
+
+// authorize checks the admin token in "authorization" metadata as "Bearer <token>".
+func (s *GRPCServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token != auth && subtle.ConstantTimeCompare([]byte(token), []byte(s.proxy.Config.Admin.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// handle authorizes the request, and calls f as record.
+func (s *GRPCServer) handle(ctx context.Context, name string, f func(traceContext) (*kuiperbeltpb.SendResponse, error)) (*kuiperbeltpb.SendResponse, error) {
+	return s.record(ctx, name, func(tc traceContext) (*kuiperbeltpb.SendResponse, error) {
+		if err := s.authorize(ctx); err != nil {
+			return nil, err
+		}
+		return f(tc)
+	})
+}
+
+// record calls f in a span of the trace context in the metadata, and records the result as the HTTP handlers.
+func (s *GRPCServer) record(ctx context.Context, name string, f func(traceContext) (*kuiperbeltpb.SendResponse, error)) (*kuiperbeltpb.SendResponse, error) {
+	start := time.Now()
+	header := make(http.Header)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{traceparentHeader, tracestateHeader} {
+		if v := md.Get(key); len(v) > 0 {
+			header.Set(key, v[0])
+		}
+	}
+	parent, _ := parseTraceContext(header)
+	span := s.proxy.tracer.StartSpan("grpc_"+name, spanKindServer, parent)
+
+	resp, err := f(span.ctx)
+	code := s.statusCode(resp, err)
+	s.proxy.Stats.HandlerEvent("grpc_"+name, code, time.Since(start))
+	span.SetStatusCode(code)
+	span.End()
+	return resp, err
+}
+
+// statusCode returns the HTTP status code equivalent to the result of RPC.
+func (s *GRPCServer) statusCode(resp *kuiperbeltpb.SendResponse, err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.Unavailable:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+	for _, e := range resp.Errors {
+		if s.proxy.Config.StrictBroadcast || e.Session == "" {
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusOK
+}
+
+func newSendResponse(id string, delivered int, se sessionErrors) *kuiperbeltpb.SendResponse {
+	resp := &kuiperbeltpb.SendResponse{
+		Id:        id,
+		Delivered: int32(delivered),
+	}
+	for _, e := range se {
+		resp.Errors = append(resp.Errors, &kuiperbeltpb.SessionError{
+			Session: e.Session,
+			Error:   e.Error,
+		})
+	}
+	return resp
+}
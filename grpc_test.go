@@ -0,0 +1,316 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kuiperbelt/kuiperbelt/kuiperbeltpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testGRPCConfig is TestConfig having the admin token required by gRPC.
+func testGRPCConfig() Config {
+	c := TestConfig
+	c.Admin.Token = "secret"
+	return c
+}
+
+// testGRPCContext returns a context having the admin token in the metadata.
+func testGRPCContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+}
+
+func testGRPCClient(t *testing.T, p *Proxy) (kuiperbeltpb.KuiperbeltClient, func()) {
+	ln := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	NewGRPCServer(p).Register(gs)
+	go gs.Serve(ln)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	return kuiperbeltpb.NewKuiperbeltClient(conn), func() {
+		conn.Close()
+		gs.Stop()
+	}
+}
+
+func TestGRPCServer__Send(t *testing.T) {
+	var pool SessionPool
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	s2 := &TestSession{key: "fugafuga", send: make(chan Message, 4)}
+	pool.Add(s1)
+	pool.Add(s2)
+	stats := NewStats()
+	client, stop := testGRPCClient(t, NewProxy(testGRPCConfig(), stats, &pool))
+	defer stop()
+	ctx := testGRPCContext()
+
+	if _, err := client.Send(context.Background(), &kuiperbeltpb.SendRequest{Sessions: []string{"hogehoge"}}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("request without token must be unauthenticated: %v", err)
+	}
+	unauthorized := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer invalid")
+	if _, err := client.ListSessions(unauthorized, &kuiperbeltpb.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("request with invalid token must be unauthenticated: %v", err)
+	}
+
+	resp, err := client.Send(ctx, &kuiperbeltpb.SendRequest{
+		Sessions:    []string{"hogehoge", "fugafuga", "piyopiyo"},
+		Body:        []byte("hello"),
+		ContentType: "text/plain",
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if resp.Delivered != 2 || len(resp.Errors) != 1 || resp.Errors[0].Session != "piyopiyo" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	for _, s := range []*TestSession{s1, s2} {
+		if m := <-s.send; string(m.Body) != "hello" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	}
+
+	if _, err := client.Send(ctx, &kuiperbeltpb.SendRequest{Body: []byte("hello")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("request without sessions must be invalid: %v", err)
+	}
+
+	// bulk sends
+	stream, err := client.SendStream(ctx)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := stream.Send(&kuiperbeltpb.SendRequest{Id: id, Sessions: []string{"hogehoge"}, Body: []byte(id)}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if resp.Id != id || resp.Delivered != 1 {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+		if m := <-s1.send; string(m.Body) != id {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	}
+	stream.CloseSend()
+
+	resp, err = client.Close(ctx, &kuiperbeltpb.CloseRequest{
+		Sessions: []string{"fugafuga"},
+		Body:     []byte("bye"),
+		Code:     4000,
+		Reason:   "maintenance",
+	})
+	if err != nil || resp.Delivered != 1 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+	if m := <-s2.send; !m.LastWord || !m.FromPostClose || m.CloseCode != 4000 || m.CloseReason != "maintenance" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if _, err := client.Close(ctx, &kuiperbeltpb.CloseRequest{Sessions: []string{"fugafuga"}, Code: 2000}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid close code must be rejected: %v", err)
+	}
+
+	var buf bytes.Buffer
+	stats.DumpPrometheus(&buf)
+	for _, expected := range []string{
+		`kuiperbelt_handler_duration_seconds_count{handler="grpc_send",result="ok",code="200"} 3`,
+		`kuiperbelt_handler_duration_seconds_count{handler="grpc_send",result="ng",code="400"} 1`,
+		`kuiperbelt_handler_duration_seconds_count{handler="grpc_send",result="ng",code="401"} 1`,
+		`kuiperbelt_handler_duration_seconds_count{handler="grpc_close",result="ok",code="200"} 1`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("metrics must contain %s", expected)
+		}
+	}
+}
+
+func TestGRPCServer__SendCluster(t *testing.T) {
+	d := NewMemoryDirectory()
+	a := newTestNode(testGRPCConfig())
+	defer a.server.Close()
+	b := newTestNode(TestConfig)
+	defer b.server.Close()
+	a.proxy.Directory = d
+	b.proxy.Directory = d
+
+	s1 := &TestSession{key: "hogehoge", send: make(chan Message, 4)}
+	s2 := &TestSession{key: "fugafuga", send: make(chan Message, 4)}
+	a.pool.Add(s1)
+	d.Register(context.Background(), s1.Key(), a.endpoint())
+	b.pool.Add(s2)
+	d.Register(context.Background(), s2.Key(), b.endpoint())
+
+	client, stop := testGRPCClient(t, a.proxy)
+	defer stop()
+	ctx := testGRPCContext()
+
+	resp, err := client.Send(ctx, &kuiperbeltpb.SendRequest{
+		Sessions: []string{"hogehoge", "fugafuga", "piyopiyo"},
+		Body:     []byte("hello"),
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if resp.Delivered != 2 || len(resp.Errors) != 1 || resp.Errors[0].Session != "piyopiyo" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	for _, s := range []*TestSession{s1, s2} {
+		if m := <-s.send; string(m.Body) != "hello" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	}
+
+	resp, err = client.Close(ctx, &kuiperbeltpb.CloseRequest{Sessions: []string{"fugafuga"}, Code: 4000, Reason: "maintenance"})
+	if err != nil || resp.Delivered != 1 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+	if m := <-s2.send; !m.LastWord || m.CloseCode != 4000 || m.CloseReason != "maintenance" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
+
+func TestGRPCServer__BroadcastBackplane(t *testing.T) {
+	b := NewMemoryBackplane()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var pool1, pool2 SessionPool
+	server := NewWebSocketServer(TestConfig, NewStats(), &pool2)
+	sc := newSessionConfig(TestConfig)
+	sc.SendQueueSize = 4
+	var sessions []*httpSession
+	for key, tenant := range map[string]string{"hogehoge": "acme", "fugafuga": "other"} {
+		s, err := server.newHTTPSession(key, "sse", sc)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s.metadata = sessionMetadata{"Tenant": tenant}
+		pool2.Add(s)
+		sessions = append(sessions, s)
+	}
+	s1 := &TestSession{key: "piyopiyo", send: make(chan Message, 4)}
+	pool1.Add(s1)
+
+	c1 := testGRPCConfig()
+	c1.Endpoint = "node1"
+	p1 := NewProxy(c1, NewStats(), &pool1)
+	p1.Backplane = b
+	c2 := TestConfig
+	c2.Endpoint = "node2"
+	p2 := NewProxy(c2, NewStats(), &pool2)
+	p2.Backplane = b
+	go p1.SubscribeBackplane(ctx)
+	go p2.SubscribeBackplane(ctx)
+	for i := 0; i < 50; i++ {
+		b.mu.RLock()
+		n := len(b.handlers)
+		b.mu.RUnlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client, stop := testGRPCClient(t, p1)
+	defer stop()
+	resp, err := client.Broadcast(testGRPCContext(), &kuiperbeltpb.BroadcastRequest{
+		Body:     []byte("hello"),
+		Metadata: map[string]string{"Tenant": "acme"},
+	})
+	if err != nil || resp.Delivered != 0 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, s := range sessions {
+		expect := 0
+		if s.metadata["Tenant"] == "acme" {
+			expect = 1
+		}
+		if len(s.send) != expect {
+			t.Errorf("unexpected messages to %s: %d", s.Key(), len(s.send))
+		}
+	}
+
+	// the sessions in the node of the request are delivered once.
+	resp, err = client.Broadcast(testGRPCContext(), &kuiperbeltpb.BroadcastRequest{Body: []byte("hello")})
+	if err != nil || resp.Delivered != 1 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(s1.send) != 1 {
+		t.Errorf("unexpected messages to %s: %d", s1.Key(), len(s1.send))
+	}
+}
+
+func TestGRPCServer__Broadcast(t *testing.T) {
+	var pool SessionPool
+	server := NewWebSocketServer(TestConfig, NewStats(), &pool)
+	sc := newSessionConfig(TestConfig)
+	sc.SendQueueSize = 4
+	var sessions []*httpSession
+	for key, tenant := range map[string]string{"hogehoge": "acme", "fugafuga": "acme", "piyopiyo": "other"} {
+		s, err := server.newHTTPSession(key, "sse", sc)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s.metadata = sessionMetadata{"Tenant": tenant}
+		pool.Add(s)
+		sessions = append(sessions, s)
+	}
+	client, stop := testGRPCClient(t, NewProxy(testGRPCConfig(), NewStats(), &pool))
+	defer stop()
+	ctx := testGRPCContext()
+
+	list, err := client.ListSessions(ctx, &kuiperbeltpb.ListSessionsRequest{
+		Metadata: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list.Sessions) != 2 {
+		t.Fatalf("unexpected sessions: %+v", list.Sessions)
+	}
+	for _, s := range list.Sessions {
+		if s.Transport != "sse" || s.Metadata["Tenant"] != "acme" || s.ConnectedAt == nil {
+			t.Errorf("unexpected session: %+v", s)
+		}
+	}
+
+	resp, err := client.Broadcast(ctx, &kuiperbeltpb.BroadcastRequest{
+		Body:     []byte("hello"),
+		Metadata: map[string]string{"Tenant": "acme"},
+	})
+	if err != nil || resp.Delivered != 2 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+	for _, s := range sessions {
+		expect := 0
+		if s.metadata["Tenant"] == "acme" {
+			expect = 1
+		}
+		if len(s.send) != expect {
+			t.Errorf("unexpected messages to %s: %d", s.Key(), len(s.send))
+		}
+	}
+
+	resp, err = client.Broadcast(ctx, &kuiperbeltpb.BroadcastRequest{Body: []byte("hello")})
+	if err != nil || resp.Delivered != 3 {
+		t.Fatalf("unexpected response: %+v %v", resp, err)
+	}
+}
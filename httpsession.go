@@ -0,0 +1,207 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// httpSession is a session over plain HTTP requests for clients which cannot use WebSocket.
+// Messages from the client are posted with the token of the session.
+type httpSession struct {
+	baseSession
+	// token authorizes requests of the client.
+	token   string
+	inbound *tokenBucket
+}
+
+func (s *WebSocketServer) newHTTPSession(key, transport string, sc sessionConfig) (*httpSession, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	return &httpSession{
+		baseSession: s.newBaseSession(key, transport, sc),
+		token:       token,
+		inbound:     newTokenBucket(sc.InboundLimit.Rate, sc.InboundLimit.Burst),
+	}, nil
+}
+
+// newSessionToken returns a random token to authorize requests of the session.
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "cannot generate session token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorize reports whether the token is of the session.
+func (s *httpSession) authorize(token string) bool {
+	return hmac.Equal([]byte(s.token), []byte(token))
+}
+
+// Close closes the session.
+func (s *httpSession) Close() error {
+	s.close(true)
+	return nil
+}
+
+// connectHTTP authenticates a connect request as /connect, and creates the session of the transport.
+// It returns the hello message from the connect callback, which is nil if the callback responds no body.
+// It responds the error and reports false if the request is not accepted.
+// The caller must add the session to the pool.
+func (s *WebSocketServer) connectHTTP(w http.ResponseWriter, r *http.Request, transport string) (*httpSession, *Message, bool) {
+	// the same origin policy as WebSocket upgrades, before the connect callback.
+	if !s.checkOrigin(r) {
+		Log.Info("connect request origin is not allowed",
+			zap.String("origin", r.Header.Get("Origin")),
+			zap.String("transport", transport),
+		)
+		s.Stats.ConnectErrorEvent()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, nil, false
+	}
+	resp, info, sc, ok := s.accept(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	key := resp.Header.Get(s.Config.SessionHeader)
+	metadata := parseMetadata(resp.Header)
+	var b bytes.Buffer
+	_, err := b.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		Log.Error("cannot read connect callback response", zap.Error(err))
+		s.Stats.ConnectErrorEvent()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return nil, nil, false
+	}
+
+	if s.Config.Callback.Establish != "" {
+		// the establish callback belongs to the trace of the connect callback.
+		parent, _ := parseTraceContext(resp.Request.Header)
+		if err := s.establishCallback(key, metadata, parent); err != nil {
+			Log.Error("establish error",
+				zap.Error(err),
+				zap.String("session", key),
+			)
+			s.Stats.ConnectErrorEvent()
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return nil, nil, false
+		}
+	}
+
+	session, err := s.newHTTPSession(key, transport, sc)
+	if err != nil {
+		Log.Error("connect error", zap.Error(err))
+		s.Stats.ConnectErrorEvent()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	session.info = info
+	session.metadata = metadata
+	session.channels = parseChannels(resp.Header)
+	s.sessionLog.Info("session establish",
+		zap.String("session", key),
+		zap.String("remote_addr", info.RemoteAddr),
+		zap.String("user_agent", info.UserAgent),
+		zap.String("transport", transport),
+	)
+
+	var hello *Message
+	if b.Len() > 0 {
+		hello = &Message{
+			Body:        b.Bytes(),
+			ContentType: resp.Header.Get("Content-Type"),
+			Session:     key,
+		}
+	}
+	return session, hello, true
+}
+
+// receiveHTTP passes the body of the request to the receive callback as a message from the client.
+// Content-Type: application/octet-stream is passed as a binary message.
+func (s *WebSocketServer) receiveHTTP(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if !session.inbound.Allow() {
+		session.inboundViolation(inboundRateLimited, websocket.ClosePolicyViolation)
+		http.Error(w, inboundRateLimited, http.StatusTooManyRequests)
+		return
+	}
+	var body io.Reader = r.Body
+	if max := session.config.InboundLimit.MaxMessageSize; max > 0 {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if int64(len(b)) > max {
+			session.inboundViolation(inboundTooLarge, websocket.CloseMessageTooBig)
+			http.Error(w, inboundTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = bytes.NewReader(b)
+	}
+
+	msgType := websocket.TextMessage
+	if ct := r.Header.Get("Content-Type"); strings.HasPrefix(strings.ToLower(ct), "application/octet-stream") {
+		msgType = websocket.BinaryMessage
+	}
+	ctx := r.Context()
+	if timeout := s.Config.Callback.Timeout; timeout != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := session.receive(ctx, msgType, body); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	io.WriteString(w, `{"result":"OK"}`)
+}
+
+// inboundViolation handles a message from the client over the inbound limits by the policy.
+func (s *httpSession) inboundViolation(reason string, code int) {
+	policy := s.config.InboundLimit.Policy
+	s.server.Stats.InboundViolationEvent(reason)
+	s.server.sessionLog.Warn("session inbound limit exceeded",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.String("reason", reason),
+		zap.String("policy", policy),
+	)
+	var message Message
+	switch policy {
+	case "notify":
+		message = Message{
+			Body:        []byte(`{"error":"` + reason + `"}`),
+			ContentType: "application/json",
+			Session:     s.Key(),
+		}
+	case "close":
+		s.setCloseReason("server", code, reason)
+		message = Message{LastWord: true, CloseCode: code, CloseReason: reason}
+	default:
+		return
+	}
+	select {
+	case s.send <- message:
+	default:
+		// the send queue is full.
+		if message.LastWord {
+			s.Close()
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package kuiperbelt
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sessionInspection is the state of a session for admins.
+type sessionInspection struct {
+	Session          string          `json:"session"`
+	Transport        string          `json:"transport"`
+	RemoteAddr       string          `json:"remote_addr"`
+	UserAgent        string          `json:"user_agent"`
+	Origin           string          `json:"origin,omitempty"`
+	Subprotocol      string          `json:"subprotocol,omitempty"`
+	Metadata         sessionMetadata `json:"metadata,omitempty"`
+	Channels         []string        `json:"channels,omitempty"`
+	ConnectedAt      time.Time       `json:"connected_at"`
+	SentMessages     int64           `json:"sent_messages"`
+	SentBytes        int64           `json:"sent_bytes"`
+	ReceivedMessages int64           `json:"received_messages"`
+	ReceivedBytes    int64           `json:"received_bytes"`
+	// RTT is the last round-trip time of the ping in seconds. 0 means not measured.
+	RTT float64 `json:"rtt"`
+}
+
+// inspector is a session which can be inspected by admins.
+type inspector interface {
+	inspect() sessionInspection
+}
+
+func (s *baseSession) inspect() sessionInspection {
+	return sessionInspection{
+		Session:          s.Key(),
+		Transport:        s.transport,
+		RemoteAddr:       s.info.RemoteAddr,
+		UserAgent:        s.info.UserAgent,
+		Origin:           s.info.Origin,
+		Subprotocol:      s.subprotocol,
+		Metadata:         s.metadata,
+		Channels:         s.channels.list(),
+		ConnectedAt:      s.connectedAt,
+		SentMessages:     atomic.LoadInt64(&s.sentMessages),
+		SentBytes:        atomic.LoadInt64(&s.sentBytes),
+		ReceivedMessages: atomic.LoadInt64(&s.receivedMessages),
+		ReceivedBytes:    atomic.LoadInt64(&s.receivedBytes),
+		RTT:              time.Duration(atomic.LoadInt64(&s.rtt)).Seconds(),
+	}
+}
+
+// SessionHandler handles GET /debug/session?session=... request.
+// It responds the state of the session in JSON.
+// Without the session parameter, it responds the sessions having the metadata
+// in meta.<name>=<value> parameters.
+func (s *WebSocketServer) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(s.Config, w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("session") == "" {
+		s.sessionsHandler(w, r)
+		return
+	}
+	session, err := s.Pool.Get(r.FormValue("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	i, ok := session.(inspector)
+	if !ok {
+		http.Error(w, "session cannot be inspected", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(i.inspect())
+}
+
+// sessionsHandler responds the sessions matching the metadata query.
+func (s *WebSocketServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := map[string]string{}
+	for name, values := range r.Form {
+		if strings.HasPrefix(name, "meta.") && len(values) > 0 {
+			query[strings.TrimPrefix(name, "meta.")] = values[0]
+		}
+	}
+	result := []sessionInspection{}
+	for _, session := range s.Pool.List() {
+		i, ok := session.(inspector)
+		if !ok {
+			continue
+		}
+		if inspection := i.inspect(); inspection.Metadata.match(query) {
+			result = append(result, inspection)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,89 @@
+package kuiperbelt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionHandler(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.Admin.Token = "secret"
+	c.PingInterval = 20 * time.Millisecond
+	c.PongTimeout = time.Second
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	th := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer th.Close()
+	ti := httptest.NewServer(http.HandlerFunc(server.SessionHandler))
+	defer ti.Close()
+
+	wsURL := strings.Replace(th.URL, "http://", "ws://", -1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		testRequestSessionHeader: []string{"hogehoge"},
+		"User-Agent":             []string{"kuiperbelt-test"},
+	})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer conn.Close()
+	// read messages to respond pongs.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	inspect := func(key string) (int, sessionInspection) {
+		req, _ := http.NewRequest("GET", ti.URL+"?session="+key, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		defer resp.Body.Close()
+		var result sessionInspection
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal("cannot decode response:", err)
+			}
+		}
+		return resp.StatusCode, result
+	}
+
+	var result sessionInspection
+	for i := 0; i < 50; i++ {
+		var status int
+		status, result = inspect("hogehoge")
+		if status == http.StatusOK && result.RTT > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result.Session != "hogehoge" || result.UserAgent != "kuiperbelt-test" || result.SentMessages != 1 {
+		t.Errorf("unexpected inspection: %+v", result)
+	}
+	if result.RTT <= 0 {
+		t.Errorf("round-trip time is not measured: %+v", result)
+	}
+	if st.PongTimeouts() != 0 {
+		t.Errorf("unexpected pong timeouts: %d", st.PongTimeouts())
+	}
+
+	if status, _ := inspect("not-exist"); status != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown session: %d", status)
+	}
+}
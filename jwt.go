@@ -0,0 +1,459 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256
+	_ "crypto/sha512" // register SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errJWTInvalidSignature = errors.New("invalid signature")
+
+// jwtAuthenticator verifies JWT in connect requests instead of the connect callback.
+type jwtAuthenticator struct {
+	config   JWTAuth
+	hmacKeys map[string][]byte
+	jwks     *jwksFile
+}
+
+func newJWTAuthenticator(c JWTAuth) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{
+		config:   c,
+		hmacKeys: make(map[string][]byte, len(c.HMACKeys)),
+	}
+	for kid, secret := range c.HMACKeys {
+		a.hmacKeys[kid] = []byte(secret)
+	}
+	if c.JWKSFile != "" {
+		a.jwks = &jwksFile{path: c.JWKSFile, interval: c.JWKSReloadInterval}
+		if err := a.jwks.load(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// jwtIdentity is the identity of the client verified by JWT.
+type jwtIdentity struct {
+	Session  string
+	Metadata sessionMetadata
+	// ExpiresAt is the expiration time of the token. Zero means no expiration.
+	ExpiresAt time.Time
+}
+
+// setHeader sets the session key and the metadata into the headers as the connect callback response.
+// The values already in the headers are not overwritten.
+func (id jwtIdentity) setHeader(h http.Header, sessionHeader string) {
+	if h.Get(sessionHeader) == "" {
+		h.Set(sessionHeader, id.Session)
+	}
+	for key, value := range id.Metadata {
+		if h.Get(METADATA_HEADER_PREFIX+key) == "" {
+			h.Set(METADATA_HEADER_PREFIX+key, value)
+		}
+	}
+}
+
+// token returns the token in the query parameter or the header.
+func (a *jwtAuthenticator) token(r *http.Request) string {
+	if token := r.URL.Query().Get(a.config.Query); token != "" {
+		return token
+	}
+	token := r.Header.Get(a.config.Header)
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	return token
+}
+
+// authenticate verifies the token in the request and returns the identity.
+func (a *jwtAuthenticator) authenticate(r *http.Request, now time.Time) (jwtIdentity, error) {
+	token := a.token(r)
+	if token == "" {
+		return jwtIdentity{}, errors.New("token is not found")
+	}
+	claims, err := a.verify(token, now)
+	if err != nil {
+		return jwtIdentity{}, err
+	}
+
+	session, ok := claims.string(a.config.SessionClaim)
+	if !ok || session == "" {
+		return jwtIdentity{}, errors.Errorf("claim %s is not found", a.config.SessionClaim)
+	}
+	id := jwtIdentity{Session: session}
+	for name, claim := range a.config.MetadataClaims {
+		value, ok := claims.string(claim)
+		if !ok {
+			continue
+		}
+		if id.Metadata == nil {
+			id.Metadata = sessionMetadata{}
+		}
+		id.Metadata[http.CanonicalHeaderKey(name)] = value
+	}
+	if exp, ok := claims.time("exp"); ok {
+		id.ExpiresAt = exp
+	}
+	return id, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims is the payload of JWT.
+type jwtClaims map[string]interface{}
+
+// string returns the claim as a string. Numbers and booleans are formatted,
+// and arrays are joined with commas.
+func (c jwtClaims) string(name string) (string, bool) {
+	switch v := c[name].(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := jwtClaims{"": e}.string("")
+			if !ok {
+				return "", false
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), true
+	}
+	return "", false
+}
+
+// time returns the NumericDate claim.
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// audience reports whether the aud claim has the audience.
+func (c jwtClaims) audience(audience string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify verifies the signature and the registered claims of the token.
+func (a *jwtAuthenticator) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	keys := a.keys(header, now)
+	if len(keys) == 0 {
+		return nil, errors.Errorf("key is not found: alg=%s kid=%s", header.Alg, header.Kid)
+	}
+	err = errJWTInvalidSignature
+	for _, key := range keys {
+		if err = verifyJWTSignature(header.Alg, key, signed, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "malformed claims")
+	}
+	leeway := a.config.Leeway
+	if exp, ok := claims.time("exp"); ok && !now.Before(exp.Add(leeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if a.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+			return nil, errors.Errorf("unexpected issuer: %s", iss)
+		}
+	}
+	if a.config.Audience != "" && !claims.audience(a.config.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// keys returns the candidate keys to verify the token.
+// Without kid, all keys of the algorithm are candidates to allow rotation.
+func (a *jwtAuthenticator) keys(header jwtHeader, now time.Time) []interface{} {
+	var keys []interface{}
+	switch header.Alg {
+	case "HS256", "HS384", "HS512":
+		if header.Kid != "" {
+			if key, ok := a.hmacKeys[header.Kid]; ok {
+				keys = append(keys, key)
+			}
+			return keys
+		}
+		for _, key := range a.hmacKeys {
+			keys = append(keys, key)
+		}
+	case "RS256", "RS384", "RS512", "ES256", "ES384", "ES512":
+		if a.jwks == nil {
+			return nil
+		}
+		for _, k := range a.jwks.keys(now) {
+			if header.Kid != "" && k.Kid != header.Kid {
+				continue
+			}
+			if k.Alg != "" && k.Alg != header.Alg {
+				continue
+			}
+			keys = append(keys, k.key)
+		}
+	}
+	return keys
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errJWTInvalidSignature
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errJWTInvalidSignature
+	}
+
+	switch alg[:2] {
+	case "HS":
+		key, ok := key.([]byte)
+		if !ok {
+			return errJWTInvalidSignature
+		}
+		mac := hmac.New(hash.New, key)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errJWTInvalidSignature
+		}
+		return nil
+	case "RS":
+		key, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errJWTInvalidSignature
+		}
+		h := hash.New()
+		h.Write(signed)
+		if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+			return errJWTInvalidSignature
+		}
+		return nil
+	case "ES":
+		key, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errJWTInvalidSignature
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errJWTInvalidSignature
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errJWTInvalidSignature
+		}
+		return nil
+	}
+	return errJWTInvalidSignature
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// jwk is a public key in JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// ECDSA
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key interface{}
+}
+
+func (k *jwk) parse() error {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return errors.Wrap(err, "invalid n")
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return errors.Wrap(err, "invalid e")
+		}
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return errors.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return errors.Wrap(err, "invalid x")
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return errors.Wrap(err, "invalid y")
+		}
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("point is not on curve")
+		}
+		k.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return errors.Errorf("unsupported kty: %s", k.Kty)
+	}
+	return nil
+}
+
+// jwksFile is JSON Web Key Set in a file.
+// The file is checked at the interval and reloaded when it is modified to rotate keys.
+type jwksFile struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.Mutex
+	set       []*jwk
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (f *jwksFile) load() error {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return errors.Wrap(err, "cannot stat jwks file")
+	}
+	if st.ModTime().Equal(f.modTime) && f.set != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "cannot read jwks file")
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return errors.Wrap(err, "cannot parse jwks file")
+	}
+	keys := make([]*jwk, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if err := k.parse(); err != nil {
+			return errors.Wrapf(err, "invalid key %s in jwks file", k.Kid)
+		}
+		keys = append(keys, k)
+	}
+	f.set = keys
+	f.modTime = st.ModTime()
+	return nil
+}
+
+func (f *jwksFile) keys(now time.Time) []*jwk {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.checkedAt) >= f.interval {
+		f.checkedAt = now
+		if err := f.load(); err != nil {
+			// keep using the previous keys.
+			Log.Error("failed reload jwks file",
+				zap.Error(err),
+				zap.String("path", f.path),
+			)
+		}
+	}
+	return f.set
+}
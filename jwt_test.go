@@ -0,0 +1,311 @@
+package kuiperbelt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestJWT signs the claims. key is []byte, *rsa.PrivateKey or *ecdsa.PrivateKey.
+func newTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func TestJWTAuthenticator__HMAC(t *testing.T) {
+	a, err := newJWTAuthenticator(JWTAuth{
+		HMACKeys:       map[string]string{"old": "old-secret", "new": "new-secret"},
+		Issuer:         "https://auth.example.com",
+		Audience:       "kuiperbelt",
+		SessionClaim:   "sid",
+		MetadataClaims: map[string]string{"user-id": "sub", "Roles": "roles"},
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	now := time.Unix(1600000000, 0)
+	claims := map[string]interface{}{
+		"sid":   "hogehoge",
+		"sub":   42,
+		"roles": []string{"admin", "editor"},
+		"iss":   "https://auth.example.com",
+		"aud":   []string{"other", "kuiperbelt"},
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	for _, kid := range []string{"old", "new", ""} {
+		key := []byte("new-secret")
+		if kid == "old" {
+			key = []byte("old-secret")
+		}
+		token := newTestJWT(t, "HS256", kid, key, claims)
+		r := httptest.NewRequest("GET", "/connect?token="+token, nil)
+		a.config.Query = "token"
+		id, err := a.authenticate(r, now)
+		if err != nil {
+			t.Fatalf("unexpected error of kid %q: %s", kid, err)
+		}
+		if id.Session != "hogehoge" || id.Metadata["User-Id"] != "42" || id.Metadata["Roles"] != "admin,editor" {
+			t.Errorf("unexpected identity: %+v", id)
+		}
+		if !id.ExpiresAt.Equal(now.Add(time.Hour)) {
+			t.Errorf("unexpected expiration: %s", id.ExpiresAt)
+		}
+	}
+
+	// the token in the header.
+	a.config.Header = "Authorization"
+	r := httptest.NewRequest("GET", "/connect", nil)
+	r.Header.Set("Authorization", "Bearer "+newTestJWT(t, "HS512", "new", []byte("new-secret"), claims))
+	if _, err := a.authenticate(r, now); err != nil {
+		t.Error("unexpected error of the token in the header:", err)
+	}
+
+	invalid := map[string]string{
+		"wrong key":   newTestJWT(t, "HS256", "new", []byte("old-secret"), claims),
+		"unknown kid": newTestJWT(t, "HS256", "unknown", []byte("new-secret"), claims),
+		"none": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			strings.Split(newTestJWT(t, "HS256", "", []byte("new-secret"), claims), ".")[1] + ".",
+	}
+	for _, name := range []string{"exp", "iss", "aud", "sid"} {
+		c := map[string]interface{}{}
+		for k, v := range claims {
+			c[k] = v
+		}
+		switch name {
+		case "exp":
+			c["exp"] = now.Add(-time.Second).Unix()
+		case "iss":
+			c["iss"] = "https://evil.example.com"
+		case "aud":
+			c["aud"] = "other"
+		case "sid":
+			delete(c, "sid")
+		}
+		invalid[name] = newTestJWT(t, "HS256", "new", []byte("new-secret"), c)
+	}
+	for name, token := range invalid {
+		r := httptest.NewRequest("GET", "/connect?token="+token, nil)
+		if _, err := a.authenticate(r, now); err == nil {
+			t.Errorf("invalid token must be error: %s", name)
+		}
+	}
+	if _, err := a.authenticate(httptest.NewRequest("GET", "/connect", nil), now); err == nil {
+		t.Error("request without token must be error")
+	}
+}
+
+func TestJWTAuthenticator__JWKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kuiperbelt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestJWKS(t, path, rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))
+
+	a, err := newJWTAuthenticator(JWTAuth{
+		JWKSFile:           path,
+		JWKSReloadInterval: time.Minute,
+		SessionClaim:       "sub",
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "hogehoge"}
+
+	for _, token := range []string{
+		newTestJWT(t, "RS256", "rsa", rsaKey, claims),
+		newTestJWT(t, "ES256", "ec", ecKey, claims),
+		newTestJWT(t, "ES256", "", ecKey, claims),
+	} {
+		if _, err := a.verify(token, now); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if _, err := a.verify(newTestJWT(t, "RS256", "ec", rsaKey, claims), now); err == nil {
+		t.Error("token signed by the other key must be error")
+	}
+
+	// rotate the keys.
+	writeTestJWKS(t, path, ecJWK("rotated", rotatedKey))
+	modTime := now.Add(time.Second)
+	os.Chtimes(path, modTime, modTime)
+	rotated := newTestJWT(t, "ES256", "rotated", rotatedKey, claims)
+	if _, err := a.verify(rotated, now.Add(time.Second)); err == nil {
+		t.Error("keys must not be reloaded before the interval")
+	}
+	if _, err := a.verify(rotated, now.Add(time.Minute)); err != nil {
+		t.Error("rotated key is not loaded:", err)
+	}
+	if _, err := a.verify(newTestJWT(t, "RS256", "rsa", rsaKey, claims), now.Add(time.Minute)); err == nil {
+		t.Error("removed key must not be used")
+	}
+
+	// the broken file keeps the previous keys.
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	modTime = now.Add(2 * time.Second)
+	os.Chtimes(path, modTime, modTime)
+	if _, err := a.verify(rotated, now.Add(2*time.Minute)); err != nil {
+		t.Error("previous keys must be kept:", err)
+	}
+}
+
+func TestWebSocketServer__Handler__JWT(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.JWT = JWTAuth{
+		Enabled:             true,
+		Query:               "token",
+		Header:              "Authorization",
+		HMACKeys:            map[string]string{"key": "secret"},
+		SessionClaim:        "sub",
+		MetadataClaims:      map[string]string{"Tenant": "tenant"},
+		SkipConnectCallback: true,
+		Expiry:              "close",
+	}
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+
+	// the token is rejected without the connect callback.
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?token=invalid", nil)
+	if err == nil {
+		t.Fatal("connection with invalid token must fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	exp := float64(time.Now().Add(500*time.Millisecond).UnixNano()) / float64(time.Second)
+	token := newTestJWT(t, "HS256", "key", []byte("secret"), map[string]interface{}{
+		"sub":    "hogehoge",
+		"tenant": "acme",
+		"exp":    exp,
+	})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+token, nil)
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer conn.Close()
+	if callbackServer.IsCallbacked() {
+		t.Error("connect callback must be skipped")
+	}
+
+	var session *WebSocketSession
+	for i := 0; i < 50; i++ {
+		if s, err := pool.Get("hogehoge"); err == nil {
+			session = s.(*WebSocketSession)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if session == nil {
+		t.Fatal("session is not registered by the claim")
+	}
+	if session.metadata["Tenant"] != "acme" {
+		t.Errorf("unexpected metadata: %v", session.metadata)
+	}
+
+	// the session is closed when the token expires.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != "token_expired" {
+		t.Errorf("unexpected close: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package kuiperbeltpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// KuiperbeltClient is the client API for Kuiperbelt service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KuiperbeltClient interface {
+	// Send sends the message to the sessions.
+	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// SendStream sends messages in bulk. A response is returned for each request with the same id.
+	SendStream(ctx context.Context, opts ...grpc.CallOption) (Kuiperbelt_SendStreamClient, error)
+	// Close sends the last message to the sessions, and closes them.
+	Close(ctx context.Context, in *CloseRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// Broadcast sends the message to all sessions having the metadata.
+	Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// ListSessions returns the sessions having the metadata.
+	ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error)
+}
+
+type kuiperbeltClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKuiperbeltClient(cc grpc.ClientConnInterface) KuiperbeltClient {
+	return &kuiperbeltClient{cc}
+}
+
+func (c *kuiperbeltClient) Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, "/kuiperbelt.v1.Kuiperbelt/Send", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kuiperbeltClient) SendStream(ctx context.Context, opts ...grpc.CallOption) (Kuiperbelt_SendStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Kuiperbelt_ServiceDesc.Streams[0], "/kuiperbelt.v1.Kuiperbelt/SendStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kuiperbeltSendStreamClient{stream}
+	return x, nil
+}
+
+type Kuiperbelt_SendStreamClient interface {
+	Send(*SendRequest) error
+	Recv() (*SendResponse, error)
+	grpc.ClientStream
+}
+
+type kuiperbeltSendStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *kuiperbeltSendStreamClient) Send(m *SendRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *kuiperbeltSendStreamClient) Recv() (*SendResponse, error) {
+	m := new(SendResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kuiperbeltClient) Close(ctx context.Context, in *CloseRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, "/kuiperbelt.v1.Kuiperbelt/Close", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kuiperbeltClient) Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, "/kuiperbelt.v1.Kuiperbelt/Broadcast", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kuiperbeltClient) ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error) {
+	out := new(ListSessionsResponse)
+	err := c.cc.Invoke(ctx, "/kuiperbelt.v1.Kuiperbelt/ListSessions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KuiperbeltServer is the server API for Kuiperbelt service.
+// All implementations must embed UnimplementedKuiperbeltServer
+// for forward compatibility
+type KuiperbeltServer interface {
+	// Send sends the message to the sessions.
+	Send(context.Context, *SendRequest) (*SendResponse, error)
+	// SendStream sends messages in bulk. A response is returned for each request with the same id.
+	SendStream(Kuiperbelt_SendStreamServer) error
+	// Close sends the last message to the sessions, and closes them.
+	Close(context.Context, *CloseRequest) (*SendResponse, error)
+	// Broadcast sends the message to all sessions having the metadata.
+	Broadcast(context.Context, *BroadcastRequest) (*SendResponse, error)
+	// ListSessions returns the sessions having the metadata.
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	mustEmbedUnimplementedKuiperbeltServer()
+}
+
+// UnimplementedKuiperbeltServer must be embedded to have forward compatible implementations.
+type UnimplementedKuiperbeltServer struct {
+}
+
+func (UnimplementedKuiperbeltServer) Send(context.Context, *SendRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedKuiperbeltServer) SendStream(Kuiperbelt_SendStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SendStream not implemented")
+}
+func (UnimplementedKuiperbeltServer) Close(context.Context, *CloseRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Close not implemented")
+}
+func (UnimplementedKuiperbeltServer) Broadcast(context.Context, *BroadcastRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Broadcast not implemented")
+}
+func (UnimplementedKuiperbeltServer) ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSessions not implemented")
+}
+func (UnimplementedKuiperbeltServer) mustEmbedUnimplementedKuiperbeltServer() {}
+
+// UnsafeKuiperbeltServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KuiperbeltServer will
+// result in compilation errors.
+type UnsafeKuiperbeltServer interface {
+	mustEmbedUnimplementedKuiperbeltServer()
+}
+
+func RegisterKuiperbeltServer(s grpc.ServiceRegistrar, srv KuiperbeltServer) {
+	s.RegisterService(&Kuiperbelt_ServiceDesc, srv)
+}
+
+func _Kuiperbelt_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KuiperbeltServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kuiperbelt.v1.Kuiperbelt/Send",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KuiperbeltServer).Send(ctx, req.(*SendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kuiperbelt_SendStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KuiperbeltServer).SendStream(&kuiperbeltSendStreamServer{stream})
+}
+
+type Kuiperbelt_SendStreamServer interface {
+	Send(*SendResponse) error
+	Recv() (*SendRequest, error)
+	grpc.ServerStream
+}
+
+type kuiperbeltSendStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *kuiperbeltSendStreamServer) Send(m *SendResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *kuiperbeltSendStreamServer) Recv() (*SendRequest, error) {
+	m := new(SendRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Kuiperbelt_Close_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KuiperbeltServer).Close(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kuiperbelt.v1.Kuiperbelt/Close",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KuiperbeltServer).Close(ctx, req.(*CloseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kuiperbelt_Broadcast_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BroadcastRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KuiperbeltServer).Broadcast(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kuiperbelt.v1.Kuiperbelt/Broadcast",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KuiperbeltServer).Broadcast(ctx, req.(*BroadcastRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kuiperbelt_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KuiperbeltServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kuiperbelt.v1.Kuiperbelt/ListSessions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KuiperbeltServer).ListSessions(ctx, req.(*ListSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Kuiperbelt_ServiceDesc is the grpc.ServiceDesc for Kuiperbelt service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Kuiperbelt_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kuiperbelt.v1.Kuiperbelt",
+	HandlerType: (*KuiperbeltServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _Kuiperbelt_Send_Handler,
+		},
+		{
+			MethodName: "Close",
+			Handler:    _Kuiperbelt_Close_Handler,
+		},
+		{
+			MethodName: "Broadcast",
+			Handler:    _Kuiperbelt_Broadcast_Handler,
+		},
+		{
+			MethodName: "ListSessions",
+			Handler:    _Kuiperbelt_ListSessions_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendStream",
+			Handler:       _Kuiperbelt_SendStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "kuiperbelt.proto",
+}
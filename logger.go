@@ -1,13 +1,44 @@
 package kuiperbelt
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type loggingHandler struct {
-	handler http.Handler
+	handler        http.Handler
+	trustedProxies []*net.IPNet
+	format         string
+	out            io.Writer
+	mu             *sync.Mutex
+}
+
+type accessLogEntryKey struct{}
+
+// accessLogEntry is fields of the access log filled by handlers.
+type accessLogEntry struct {
+	Sessions  []string
+	Delivered int
+	Failed    int
+}
+
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	e, _ := ctx.Value(accessLogEntryKey{}).(*accessLogEntry)
+	return e
 }
 
 type responseLogger struct {
@@ -39,17 +70,242 @@ func NewLoggingHandler(h http.Handler) http.Handler {
 	return loggingHandler{handler: h}
 }
 
+// newLoggingHandler returns a loggingHandler configured by c.AccessLog and c.TrustedProxies.
+// If c.AccessLog.Path is set, it also returns the file of the access log. Otherwise the file is nil.
+func newLoggingHandler(h http.Handler, c Config) (http.Handler, *accessLogFile, error) {
+	trusted, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := loggingHandler{
+		handler:        h,
+		trustedProxies: trusted,
+		format:         c.AccessLog.Format,
+		mu:             new(sync.Mutex),
+	}
+	var f *accessLogFile
+	if c.AccessLog.Path != "" {
+		f, err = openAccessLogFile(c.AccessLog.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		l.out = f
+	}
+	return l, f, nil
+}
+
+// accessLogFile is the file of the access log. It is reopened to follow the log rotation.
+type accessLogFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func openAccessLogFile(path string) (*accessLogFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogFile{path: path, f: f}, nil
+}
+
+func (l *accessLogFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// Reopen opens the file of the path again, and closes the old one.
+// If the file cannot be opened, the old one is still used.
+func (l *accessLogFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+func (l *accessLogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
 func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
 	logger := &responseLogger{w: w}
+	entry := &accessLogEntry{}
+	req = req.WithContext(context.WithValue(req.Context(), accessLogEntryKey{}, entry))
 	h.handler.ServeHTTP(logger, req)
+	elapsed := time.Since(start)
 
 	url := *req.URL
 	method := req.Method
 
+	if h.out != nil {
+		h.writeAccessLog(start, elapsed, req, logger, entry)
+		return
+	}
+
 	Log.Info("access",
 		zap.String("method", method),
 		zap.String("url", url.String()),
 		zap.Int("status", logger.status),
 		zap.Int("size", logger.size),
+		zap.Duration("duration", elapsed),
+		zap.String("remote_addr", clientIP(req, h.trustedProxies)),
+		zap.String("forwarded_for", req.Header.Get("X-Forwarded-For")),
+		zap.Strings("sessions", entry.Sessions),
+		zap.Int("delivered", entry.Delivered),
+		zap.Int("failed", entry.Failed),
 	)
 }
+
+func (h loggingHandler) writeAccessLog(start time.Time, elapsed time.Duration, req *http.Request, l *responseLogger, e *accessLogEntry) {
+	fields := [][2]string{
+		{"time", start.Format(time.RFC3339Nano)},
+		{"method", req.Method},
+		{"uri", req.URL.String()},
+		{"status", strconv.Itoa(l.status)},
+		{"size", strconv.Itoa(l.size)},
+		{"reqtime", strconv.FormatFloat(elapsed.Seconds(), 'f', 6, 64)},
+		{"host", clientIP(req, h.trustedProxies)},
+		{"forwardedfor", req.Header.Get("X-Forwarded-For")},
+		{"sessions", strings.Join(e.Sessions, ",")},
+		{"delivered", strconv.Itoa(e.Delivered)},
+		{"failed", strconv.Itoa(e.Failed)},
+	}
+
+	buf := new(bytes.Buffer)
+	switch h.format {
+	case "json":
+		m := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			m[f[0]] = f[1]
+		}
+		m["status"] = l.status
+		m["size"] = l.size
+		m["reqtime"] = elapsed.Seconds()
+		m["sessions"] = e.Sessions
+		m["delivered"] = e.Delivered
+		m["failed"] = e.Failed
+		if err := json.NewEncoder(buf).Encode(m); err != nil {
+			Log.Error("cannot encode access log", zap.Error(err))
+			return
+		}
+	default:
+		for i, f := range fields {
+			if i > 0 {
+				buf.WriteByte('\t')
+			}
+			fmt.Fprintf(buf, "%s:%s", f[0], ltsvEscaper.Replace(f[1]))
+		}
+		buf.WriteByte('\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := buf.WriteTo(h.out); err != nil {
+		Log.Error("cannot write access log", zap.Error(err))
+	}
+}
+
+var ltsvEscaper = strings.NewReplacer("\t", "\\t", "\n", "\\n")
+
+// parseTrustedProxies parses IP addresses and CIDRs of trusted proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP address of the client.
+// If the request comes from a trusted proxy, the rightmost untrusted address in X-Forwarded-For is used.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip, trusted) {
+		return host
+	}
+
+	var addrs []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(v, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			break
+		}
+		host = addrs[i]
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// newSessionLogger builds the logger for session lifecycle events.
+func newSessionLogger(c SessionLog) *zap.Logger {
+	if c.Format == "" && c.Sampling.Initial == 0 && c.Sampling.Thereafter == 0 {
+		return Log
+	}
+
+	var core zapcore.Core
+	switch c.Format {
+	case "json":
+		enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		core = zapcore.NewCore(enc, zapcore.Lock(os.Stderr), zapcore.InfoLevel)
+	case "console":
+		enc := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		core = zapcore.NewCore(enc, zapcore.Lock(os.Stderr), zapcore.InfoLevel)
+	default:
+		core = Log.Core()
+	}
+	if c.Sampling.Initial > 0 || c.Sampling.Thereafter > 0 {
+		thereafter := c.Sampling.Thereafter
+		if thereafter <= 0 {
+			// drop all entries after the initial ones.
+			thereafter = math.MaxInt32
+		}
+		core = zapcore.NewSampler(core, time.Second, c.Sampling.Initial, thereafter)
+	}
+	return zap.New(core)
+}
@@ -0,0 +1,153 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expectedAddr string
+	}{
+		{"203.0.113.1:1234", "", "203.0.113.1"},
+		{"203.0.113.1:1234", "198.51.100.1", "203.0.113.1"}, // untrusted proxy
+		{"192.168.1.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"192.168.1.1:1234", "198.51.100.2, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/send", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if got := clientIP(r, trusted); got != test.expectedAddr {
+			t.Errorf("unexpected client IP: remote_addr=%s, forwarded_for=%s, got %s, expected %s",
+				test.remoteAddr, test.forwardedFor, got, test.expectedAddr)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"invalid"}); err == nil {
+		t.Error("invalid trusted proxy must be error")
+	}
+}
+
+func TestLoggingHandler__AccessLogFile(t *testing.T) {
+	for _, format := range []string{"ltsv", "json"} {
+		f, err := ioutil.TempFile("", "ekbo-access-log")
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		var pool SessionPool
+		s1 := &TestSession{
+			key:  "hogehoge",
+			send: make(chan Message, 4),
+		}
+		pool.Add(s1)
+
+		tc := TestConfig
+		tc.AccessLog = AccessLog{Path: f.Name(), Format: format}
+		p := NewProxy(tc, NewStats(), &pool)
+		h, l, err := newLoggingHandler(http.HandlerFunc(p.SendHandlerFunc), tc)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		ts := httptest.NewServer(h)
+
+		req, err := http.NewRequest("POST", ts.URL+"/send", bytes.NewBufferString("test message"))
+		if err != nil {
+			t.Fatal("proxy handler new request unexpected error:", err)
+		}
+		req.Header.Add(tc.SessionHeader, "hogehoge")
+		req.Header.Add(tc.SessionHeader, "not-exist")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("proxy handler request unexpected error:", err)
+		}
+		resp.Body.Close()
+		ts.Close()
+		l.Close()
+
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		line := string(b)
+
+		switch format {
+		case "ltsv":
+			for _, expect := range []string{"method:POST", "uri:/send", "status:200", "sessions:hogehoge,not-exist", "delivered:1", "failed:1", "host:127.0.0.1", "reqtime:"} {
+				if !strings.Contains(line, expect) {
+					t.Errorf("access log does not contain %q: %s", expect, line)
+				}
+			}
+		case "json":
+			var entry struct {
+				Status    int      `json:"status"`
+				Sessions  []string `json:"sessions"`
+				Delivered int      `json:"delivered"`
+				Failed    int      `json:"failed"`
+				Host      string   `json:"host"`
+			}
+			if err := json.Unmarshal(b, &entry); err != nil {
+				t.Fatalf("cannot unmarshal access log: %s: %s", err, line)
+			}
+			if entry.Status != 200 || len(entry.Sessions) != 2 || entry.Delivered != 1 || entry.Failed != 1 || entry.Host != "127.0.0.1" {
+				t.Errorf("unexpected access log: %s", line)
+			}
+		}
+	}
+}
+
+func TestAccessLogFile__Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kuiperbelt-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	l, err := openAccessLogFile(path)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer l.Close()
+
+	io.WriteString(l, "before\n")
+	// rotate the file as logrotate does.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	io.WriteString(l, "after\n")
+
+	for name, expected := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if string(b) != expected {
+			t.Errorf("unexpected content of %s: %q", name, b)
+		}
+	}
+}
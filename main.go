@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -36,40 +37,50 @@ func Run(port, sock, configFilename string) {
 		c.Port = port
 	}
 
+	tr := newTracer(c.Trace)
+
 	st := NewStats()
 	var pool SessionPool
 
 	p := NewProxy(*c, st, &pool)
-	p.Register()
-
+	p.tracer = tr
 	s := NewWebSocketServer(*c, st, &pool)
+	s.tracer = tr
+	subscribeCtx, stopSubscribe := context.WithCancel(context.Background())
+	defer stopSubscribe()
+	var m *Membership
+	if c.Cluster.Enabled {
+		peers := func() []string { return c.Cluster.Peers }
+		if len(c.Cluster.Seeds) > 0 {
+			m = NewMembership(*c, st)
+			m.Register()
+			go m.Run(subscribeCtx)
+			peers = m.Peers
+		}
+		d := NewPeerDirectory(*c, peers)
+		p.Directory = d
+		s.Directory = d
+	}
+	if b := newBackplane(c.Backplane); b != nil {
+		p.Backplane = b
+		go p.SubscribeBackplane(subscribeCtx)
+	}
+	p.Register()
 	s.Register()
 
-	var ln net.Listener
-	if c.Sock != "" {
-		ln, err = net.Listen("unix", c.Sock)
-		if err != nil {
-			Log.Fatal("listen sock error",
-				zap.Error(err),
-				zap.String("sock", c.Sock),
-			)
-		}
-		Log.Info("listen start",
-			zap.String("sock", c.Sock),
-		)
-	} else {
-		ln, err = net.Listen("tcp", ":"+c.Port)
-		if err != nil {
-			Log.Fatal("listen port error",
-				zap.Error(err),
-				zap.String("port", c.Port),
-			)
-		}
-		Log.Info("listen start",
-			zap.String("port", c.Port),
-		)
+	var gs *grpc.Server
+	if c.GRPC.Enabled {
+		gs = grpc.NewServer()
+		NewGRPCServer(p).Register(gs)
+		gln := listen(c.GRPC.Sock, c.GRPC.Port)
+		go func() {
+			if err := gs.Serve(gln); err != nil {
+				Log.Fatal("grpc serve error:", zap.Error(err))
+			}
+		}()
 	}
 
+	ln := listen(c.Sock, c.Port)
 	server := &http.Server{}
 	go func() {
 		err := server.Serve(ln)
@@ -81,22 +92,80 @@ func Run(port, sock, configFilename string) {
 		}
 	}()
 
-	waitForSignal()
+	waitForSignal(func() {
+		if err := p.ReopenAccessLog(); err != nil {
+			Log.Error("cannot reopen access log",
+				zap.Error(err),
+				zap.String("path", c.AccessLog.Path),
+			)
+		}
+	})
 
 	// Shutdown gracefully
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if m != nil {
+		// tell the other members that this node is going to shut down.
+		m.SetDraining(true)
+		m.gossip(ctx)
+	}
 	server.Shutdown(ctx)
+	if gs != nil {
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			gs.Stop()
+		}
+	}
 	s.Shutdown(ctx)
+	tr.Shutdown(ctx)
+	p.CloseAccessLog()
+}
+
+// listen listens the UNIX domain socket if sock is set. Otherwise, it listens the TCP port.
+func listen(sock, port string) net.Listener {
+	if sock != "" {
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			Log.Fatal("listen sock error",
+				zap.Error(err),
+				zap.String("sock", sock),
+			)
+		}
+		Log.Info("listen start",
+			zap.String("sock", sock),
+		)
+		return ln
+	}
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		Log.Fatal("listen port error",
+			zap.Error(err),
+			zap.String("port", port),
+		)
+	}
+	Log.Info("listen start",
+		zap.String("port", port),
+	)
+	return ln
 }
 
-func waitForSignal() {
+// waitForSignal waits for SIGTERM or SIGINT. reopen is called on SIGHUP to reopen log files after rotation.
+func waitForSignal(reopen func()) {
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	defer signal.Stop(signalCh)
 
 	for s := range signalCh {
 		switch s {
+		case syscall.SIGHUP:
+			Log.Info("received SIGHUP. reopening log files...")
+			reopen()
 		case syscall.SIGTERM:
 			Log.Info("received SIGTERM. shutting down...")
 			return
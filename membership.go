@@ -0,0 +1,312 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	memberAlive   = "alive"
+	memberSuspect = "suspect"
+	memberDead    = "dead"
+
+	gossipFanout = 3
+)
+
+// Member is a node in the cluster.
+type Member struct {
+	Endpoint string `json:"endpoint"`
+	Sessions int64  `json:"sessions"`
+	Draining bool   `json:"draining"`
+	// Incarnation is the start time of the node in Unix nanoseconds.
+	// The member of a higher incarnation wins regardless of the heartbeat, as the node has restarted.
+	Incarnation int64 `json:"incarnation"`
+	// Heartbeat is incremented by the node itself in each gossip round.
+	Heartbeat uint64 `json:"heartbeat"`
+	// State is "alive", "suspect" or "dead", decided by each node locally.
+	State string `json:"state"`
+	// UpdatedAt is the local time when the heartbeat is updated last.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Membership manages the members of the cluster by gossip protocol.
+// Each node periodically exchanges the member list with a few random members,
+// and a member is suspected and then regarded as dead if its heartbeat is not updated.
+type Membership struct {
+	config Config
+	stats  *Stats
+
+	mu       sync.RWMutex
+	members  map[string]*Member
+	draining bool
+}
+
+// NewMembership returns a new Membership of this node.
+func NewMembership(c Config, st *Stats) *Membership {
+	m := &Membership{
+		config:  c,
+		stats:   st,
+		members: make(map[string]*Member),
+	}
+	now := time.Now()
+	m.members[c.Endpoint] = &Member{
+		Endpoint:    c.Endpoint,
+		Incarnation: now.UnixNano(),
+		State:       memberAlive,
+		UpdatedAt:   now,
+	}
+	return m
+}
+
+// Register registers the handlers of membership.
+func (m *Membership) Register() {
+	http.HandleFunc(m.config.Path.ClusterMembers, m.MembersHandler)
+	http.HandleFunc(m.config.Path.ClusterGossip, m.GossipHandler)
+}
+
+// Run gossips periodically until ctx is canceled.
+func (m *Membership) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.Cluster.GossipInterval)
+	defer ticker.Stop()
+	for {
+		m.gossip(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetDraining sets the drain state of this node. A draining node is going to shut down.
+func (m *Membership) SetDraining(draining bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = draining
+	m.members[m.config.Endpoint].Draining = draining
+}
+
+// Members returns all known members sorted by the endpoint.
+func (m *Membership) Members() []Member {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Endpoint < members[j].Endpoint
+	})
+	return members
+}
+
+// Peers returns the endpoints of the other members which are not dead.
+func (m *Membership) Peers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	peers := make([]string, 0, len(m.members))
+	for endpoint, member := range m.members {
+		if endpoint == m.config.Endpoint || member.State == memberDead {
+			continue
+		}
+		peers = append(peers, endpoint)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// tick updates the heartbeat of this node and the states of the other members.
+func (m *Membership) tick(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	self := m.members[m.config.Endpoint]
+	self.Heartbeat++
+	self.Sessions = m.stats.Connections()
+	self.Draining = m.draining
+	self.UpdatedAt = now
+
+	for endpoint, member := range m.members {
+		if endpoint == m.config.Endpoint {
+			continue
+		}
+		elapsed := now.Sub(member.UpdatedAt)
+		switch {
+		case elapsed > 2*m.config.Cluster.DeadTimeout:
+			delete(m.members, endpoint)
+		case elapsed > m.config.Cluster.DeadTimeout:
+			if member.State != memberDead {
+				Log.Warn("cluster member is dead", zap.String("endpoint", endpoint))
+			}
+			member.State = memberDead
+		case elapsed > m.config.Cluster.SuspectTimeout:
+			member.State = memberSuspect
+		}
+	}
+}
+
+// merge merges the member list from other node.
+func (m *Membership) merge(members []Member, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, in := range members {
+		if in.Endpoint == "" || in.Endpoint == m.config.Endpoint {
+			continue
+		}
+		member, ok := m.members[in.Endpoint]
+		if !ok {
+			if in.State == memberDead {
+				continue
+			}
+			Log.Info("cluster member joined", zap.String("endpoint", in.Endpoint))
+			member = &Member{Endpoint: in.Endpoint}
+			m.members[in.Endpoint] = member
+		} else if in.Incarnation < member.Incarnation || (in.Incarnation == member.Incarnation && in.Heartbeat <= member.Heartbeat) {
+			continue
+		}
+		if member.State == memberDead {
+			Log.Info("cluster member is alive again", zap.String("endpoint", in.Endpoint))
+		}
+		member.Sessions = in.Sessions
+		member.Draining = in.Draining
+		member.Incarnation = in.Incarnation
+		member.Heartbeat = in.Heartbeat
+		member.State = memberAlive
+		member.UpdatedAt = now
+	}
+}
+
+// targets returns the endpoints to gossip in this round.
+func (m *Membership) targets() []string {
+	peers := m.Peers()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > gossipFanout {
+		peers = peers[:gossipFanout]
+	}
+
+	// join through a seed until all seeds are known.
+	seeds := make([]string, 0, len(m.config.Cluster.Seeds))
+	m.mu.RLock()
+	for _, seed := range m.config.Cluster.Seeds {
+		if _, ok := m.members[seed]; !ok && seed != m.config.Endpoint {
+			seeds = append(seeds, seed)
+		}
+	}
+	m.mu.RUnlock()
+	if len(seeds) > 0 {
+		peers = append(peers, seeds[rand.Intn(len(seeds))])
+	}
+	return peers
+}
+
+func (m *Membership) gossip(ctx context.Context) {
+	m.tick(time.Now())
+	targets := m.targets()
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		target := target
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			members, err := m.exchange(ctx, target)
+			if err != nil {
+				Log.Debug("failed gossip",
+					zap.Error(err),
+					zap.String("endpoint", target),
+				)
+				return
+			}
+			m.merge(members, time.Now())
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *Membership) exchange(ctx context.Context, endpoint string) ([]Member, error) {
+	body, err := json.Marshal(m.Members())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal members")
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+endpoint+m.config.Path.ClusterGossip, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create gossip request")
+	}
+	if timeout := m.config.Cluster.Timeout; timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.token())
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed post gossip request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrap(errCallbackResponseNotOK(resp.StatusCode), "unsuccessful post gossip request")
+	}
+	var members []Member
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return nil, errors.Wrap(err, "cannot decode gossip response")
+	}
+	return members, nil
+}
+
+// token returns the bearer token of gossip requests. It is the cluster token, or the admin token if empty.
+func (m *Membership) token() string {
+	if m.config.Cluster.Token != "" {
+		return m.config.Cluster.Token
+	}
+	return m.config.Admin.Token
+}
+
+// GossipHandler handles POST /cluster/gossip request.
+// It merges the member list in the request, and responds the member list of this node.
+// The request must have the cluster token, because the members are the targets of forwarded requests.
+func (m *Membership) GossipHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !authorizeBearer(m.token(), w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"errors":[{"error":"required POST method"}],"result":"NG"}`)
+		return
+	}
+	var members []Member
+	if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"errors":[{"error":"invalid member list"}],"result":"NG"}`)
+		return
+	}
+	m.merge(members, time.Now())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(m.Members())
+}
+
+// MembersHandler handles GET /cluster/members request.
+func (m *Membership) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Self    string   `json:"self"`
+		Members []Member `json:"members"`
+	}{
+		Self:    m.config.Endpoint,
+		Members: m.Members(),
+	})
+}
@@ -0,0 +1,190 @@
+package kuiperbelt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMember struct {
+	membership *Membership
+	server     *httptest.Server
+}
+
+func newTestMember(seeds ...string) *testMember {
+	c := TestConfig
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	c.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	c.Cluster = Cluster{
+		Enabled:        true,
+		Seeds:          seeds,
+		GossipInterval: 10 * time.Millisecond,
+		SuspectTimeout: time.Second,
+		DeadTimeout:    2 * time.Second,
+		Token:          "secret",
+	}
+	m := NewMembership(c, NewStats())
+	mux.HandleFunc(c.Path.ClusterMembers, m.MembersHandler)
+	mux.HandleFunc(c.Path.ClusterGossip, m.GossipHandler)
+	return &testMember{membership: m, server: server}
+}
+
+func (m *testMember) endpoint() string {
+	return m.membership.config.Endpoint
+}
+
+func TestMembership__Join(t *testing.T) {
+	a := newTestMember()
+	defer a.server.Close()
+	b := newTestMember(a.endpoint())
+	defer b.server.Close()
+	c := newTestMember(a.endpoint())
+	defer c.server.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b.membership.gossip(ctx)
+		c.membership.gossip(ctx)
+	}
+
+	for _, m := range []*testMember{a, b, c} {
+		if peers := m.membership.Peers(); len(peers) != 2 {
+			t.Errorf("%s does not know all peers: %v", m.endpoint(), peers)
+		}
+	}
+
+	c.membership.SetDraining(true)
+	c.membership.gossip(ctx)
+	b.membership.gossip(ctx)
+
+	resp, err := http.Get(b.server.URL + TestConfig.Path.ClusterMembers)
+	if err != nil {
+		t.Fatal("members request unexpected error:", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Self    string   `json:"self"`
+		Members []Member `json:"members"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal("members response unexpected error:", err)
+	}
+	if result.Self != b.endpoint() {
+		t.Errorf("unexpected self: %s", result.Self)
+	}
+	if len(result.Members) != 3 {
+		t.Fatalf("unexpected members: %+v", result.Members)
+	}
+	for _, member := range result.Members {
+		if member.State != memberAlive {
+			t.Errorf("%s is not alive: %s", member.Endpoint, member.State)
+		}
+		if member.Draining != (member.Endpoint == c.endpoint()) {
+			t.Errorf("unexpected drain state of %s: %t", member.Endpoint, member.Draining)
+		}
+	}
+}
+
+func TestMembership__FailureDetection(t *testing.T) {
+	a := newTestMember()
+	defer a.server.Close()
+	b := newTestMember(a.endpoint())
+	b.membership.gossip(context.Background())
+	b.server.Close()
+
+	m := a.membership
+	if peers := m.Peers(); len(peers) != 1 || peers[0] != b.endpoint() {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+
+	now := time.Now()
+	m.tick(now.Add(m.config.Cluster.SuspectTimeout + time.Millisecond))
+	for _, member := range m.Members() {
+		if member.Endpoint == b.endpoint() && member.State != memberSuspect {
+			t.Errorf("member is not suspected: %+v", member)
+		}
+	}
+	if peers := m.Peers(); len(peers) != 1 {
+		t.Errorf("suspected member should be in peers: %v", peers)
+	}
+
+	m.tick(now.Add(m.config.Cluster.DeadTimeout + time.Millisecond))
+	if peers := m.Peers(); len(peers) != 0 {
+		t.Errorf("dead member should not be in peers: %v", peers)
+	}
+	if members := m.Members(); len(members) != 2 {
+		t.Errorf("dead member should be listed: %+v", members)
+	}
+
+	// a dead member is not revived by an old heartbeat.
+	m.merge([]Member{{Endpoint: b.endpoint(), Heartbeat: 1}}, now)
+	if peers := m.Peers(); len(peers) != 0 {
+		t.Errorf("dead member is revived by an old heartbeat: %v", peers)
+	}
+
+	m.tick(now.Add(2*m.config.Cluster.DeadTimeout + time.Millisecond))
+	if members := m.Members(); len(members) != 1 {
+		t.Errorf("dead member should be removed: %+v", members)
+	}
+}
+
+func TestMembership__Restart(t *testing.T) {
+	a := newTestMember()
+	defer a.server.Close()
+	b := newTestMember(a.endpoint())
+	defer b.server.Close()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b.membership.gossip(ctx)
+	}
+
+	// b restarts in the same endpoint, and its heartbeat starts again.
+	restarted := NewMembership(b.membership.config, NewStats())
+	incarnation := restarted.members[b.endpoint()].Incarnation
+	restarted.gossip(ctx)
+
+	for _, member := range a.membership.Members() {
+		if member.Endpoint != b.endpoint() {
+			continue
+		}
+		if member.Incarnation != incarnation || member.Heartbeat != 1 {
+			t.Errorf("restarted member is not updated: %+v", member)
+		}
+	}
+
+	// the old incarnation does not override the restarted one.
+	b.membership.gossip(ctx)
+	for _, member := range a.membership.Members() {
+		if member.Endpoint == b.endpoint() && member.Incarnation != incarnation {
+			t.Errorf("restarted member is overridden by the old incarnation: %+v", member)
+		}
+	}
+}
+
+func TestMembership__GossipHandler__Unauthorized(t *testing.T) {
+	a := newTestMember()
+	defer a.server.Close()
+
+	for _, auth := range []string{"", "Bearer invalid"} {
+		req, _ := http.NewRequest("POST", a.server.URL+TestConfig.Path.ClusterGossip, strings.NewReader(`[{"endpoint":"evil:9180","heartbeat":1}]`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("gossip request unexpected error:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("unexpected status: %d", resp.StatusCode)
+		}
+	}
+	if peers := a.membership.Peers(); len(peers) != 0 {
+		t.Errorf("members of unauthorized gossip are merged: %v", peers)
+	}
+}
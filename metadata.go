@@ -0,0 +1,64 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"strings"
+)
+
+// METADATA_HEADER_PREFIX is the prefix of the headers attached to the session by the connect callback.
+// They are replayed on the establish, receive and close callbacks.
+const METADATA_HEADER_PREFIX = "X-Kuiperbelt-Meta-"
+
+// sessionMetadata is the metadata of a session keyed by the header name without the prefix.
+type sessionMetadata map[string]string
+
+// parseMetadata returns the metadata in the headers. It returns nil if there is no metadata.
+func parseMetadata(h http.Header) sessionMetadata {
+	var md sessionMetadata
+	for name, values := range h {
+		if !strings.HasPrefix(name, METADATA_HEADER_PREFIX) || len(values) == 0 {
+			continue
+		}
+		key := name[len(METADATA_HEADER_PREFIX):]
+		if key == "" {
+			continue
+		}
+		if md == nil {
+			md = sessionMetadata{}
+		}
+		md[key] = values[0]
+	}
+	return md
+}
+
+// setHeader sets the metadata into the headers.
+func (md sessionMetadata) setHeader(h http.Header) {
+	for key, value := range md {
+		h.Set(METADATA_HEADER_PREFIX+key, value)
+	}
+}
+
+// match reports whether the metadata has all of the values in the query.
+func (md sessionMetadata) match(query map[string]string) bool {
+	for key, value := range query {
+		if v, ok := md[http.CanonicalHeaderKey(key)]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionsWithMetadata returns the sessions in the pool having the metadata. Empty metadata matches all sessions.
+func (p *Proxy) sessionsWithMetadata(metadata map[string]string) []Session {
+	var ss []Session
+	for _, session := range p.Pool.List() {
+		if len(metadata) > 0 {
+			i, ok := session.(inspector)
+			if !ok || !i.inspect().Metadata.match(metadata) {
+				continue
+			}
+		}
+		ss = append(ss, session)
+	}
+	return ss
+}
@@ -0,0 +1,145 @@
+package kuiperbelt
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseMetadata(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Kuiperbelt-Meta-User-Id", "42")
+	h.Set("X-Kuiperbelt-Meta-Tenant", "acme")
+	h.Set("X-Kuiperbelt-Session", "hogehoge")
+	md := parseMetadata(h)
+	if len(md) != 2 || md["User-Id"] != "42" || md["Tenant"] != "acme" {
+		t.Errorf("unexpected metadata: %v", md)
+	}
+	if md := parseMetadata(http.Header{}); md != nil {
+		t.Errorf("metadata must be nil without headers: %v", md)
+	}
+
+	replayed := http.Header{}
+	md.setHeader(replayed)
+	if replayed.Get("X-Kuiperbelt-Meta-User-Id") != "42" || replayed.Get("X-Kuiperbelt-Meta-Tenant") != "acme" {
+		t.Errorf("unexpected replayed headers: %v", replayed)
+	}
+
+	if !md.match(map[string]string{"tenant": "acme"}) {
+		t.Error("metadata must match the query")
+	}
+	if md.match(map[string]string{"tenant": "acme", "user-id": "1"}) {
+		t.Error("metadata must not match the query")
+	}
+	if !md.match(nil) {
+		t.Error("metadata must match the empty query")
+	}
+}
+
+func TestWebSocketSession__Metadata(t *testing.T) {
+	var pool SessionPool
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(testRequestSessionHeader)
+		w.Header().Set(TestConfig.SessionHeader, key)
+		w.Header().Set("X-Kuiperbelt-Meta-User-Id", key+"-user")
+		w.Header().Set("X-Kuiperbelt-Meta-Tenant", "acme")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tcc.Close()
+
+	received := make(chan http.Header, 1)
+	tcr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		received <- r.Header
+	}))
+	defer tcr.Close()
+
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcl := httptest.NewServer(http.HandlerFunc(callbackServer.CloseHandler))
+	defer tcl.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.Callback.Receive = tcr.URL
+	c.Callback.Close = tcl.URL
+	c.Admin.Token = "secret"
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	ti := httptest.NewServer(http.HandlerFunc(server.SessionHandler))
+	defer ti.Close()
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	var conns []*websocket.Conn
+	for _, key := range []string{"hogehoge", "fugafuga"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+			testRequestSessionHeader: []string{key},
+		})
+		if err != nil {
+			t.Fatal("cannot connect error:", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 50 && len(pool.List()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the metadata is replayed on the receive callback.
+	if err := conns[0].WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal("cannot write message:", err)
+	}
+	select {
+	case h := <-received:
+		if h.Get("X-Kuiperbelt-Meta-User-Id") != "hogehoge-user" || h.Get("X-Kuiperbelt-Meta-Tenant") != "acme" {
+			t.Errorf("unexpected metadata on receive callback: %v", h)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive callback is not called")
+	}
+
+	// the sessions are queried by the metadata.
+	query := func(q string) []sessionInspection {
+		req, _ := http.NewRequest("GET", ti.URL+"?"+q, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		defer resp.Body.Close()
+		var result []sessionInspection
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal("cannot decode response:", err)
+		}
+		return result
+	}
+	if result := query("meta.Tenant=acme"); len(result) != 2 {
+		t.Errorf("unexpected sessions of the tenant: %+v", result)
+	}
+	result := query("meta.User-Id=fugafuga-user")
+	if len(result) != 1 || result[0].Session != "fugafuga" || result[0].Metadata["Tenant"] != "acme" {
+		t.Errorf("unexpected sessions of the user: %+v", result)
+	}
+	if result := query("meta.Tenant=other"); len(result) != 0 {
+		t.Errorf("unexpected sessions of the other tenant: %+v", result)
+	}
+
+	// the metadata is replayed on the close callback.
+	conns[1].Close()
+	for i := 0; i < 100 && !callbackServer.IsClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !callbackServer.IsClosed() {
+		t.Fatal("close callback is not called")
+	}
+	if h := callbackServer.Header(); h.Get("X-Kuiperbelt-Meta-User-Id") != "fugafuga-user" {
+		t.Errorf("unexpected metadata on close callback: %v", h)
+	}
+}
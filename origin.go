@@ -0,0 +1,150 @@
+package kuiperbelt
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// newOriginChecker returns the function to check Origin header of a connect request by origin_policy.
+// It is used by the WebSocket upgrader and the connect requests of the other transports.
+func newOriginChecker(c Config, st *Stats) (func(r *http.Request) bool, error) {
+	switch c.OriginPolicy {
+	case "same_hostname":
+		return func(r *http.Request) bool {
+			host := r.Host
+			hostname, _, err := net.SplitHostPort(host)
+			if err != nil {
+				Log.Error("cannot split host by request",
+					zap.Error(err),
+				)
+				return false
+			}
+			origin := r.Header.Get("Origin")
+			originURL, err := url.Parse(origin)
+			if err != nil {
+				Log.Error("cannot parse origin by request",
+					zap.Error(err),
+				)
+				return false
+			}
+			return hostname == originURL.Hostname()
+		}, nil
+	case "allowlist":
+		matcher, err := newOriginMatcher(c.OriginAllowlist)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || matcher.match(origin) {
+				return true
+			}
+			st.OriginRejectEvent()
+			Log.Info("origin rejected",
+				zap.String("origin", origin),
+				zap.String("remote_addr", r.RemoteAddr),
+			)
+			return false
+		}, nil
+	case "none":
+		return func(r *http.Request) bool {
+			return true
+		}, nil
+	}
+	// same_origin is the same as the default checker of gorilla/websocket.
+	return checkSameOrigin, nil
+}
+
+// checkSameOrigin reports whether Origin header is absent or the same as Host.
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// originMatcher matches Origin header with the allowlist.
+// A pattern is one of
+//
+//	exact origin:       "https://example.com"
+//	wildcard subdomain: "https://*.example.com" or "*.example.com" for any scheme, on any port
+//	regular expression: "~^https://[a-z]+\.example\.(com|net)$"
+type originMatcher struct {
+	exact     map[string]bool
+	wildcards []originWildcard
+	regexps   []*regexp.Regexp
+}
+
+type originWildcard struct {
+	scheme string // empty means any scheme
+	suffix string // e.g. ".example.com"
+}
+
+func newOriginMatcher(patterns []string) (*originMatcher, error) {
+	m := &originMatcher{exact: make(map[string]bool)}
+	for _, p := range patterns {
+		switch {
+		case strings.HasPrefix(p, "~"):
+			re, err := regexp.Compile(p[1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid origin pattern %q", p)
+			}
+			m.regexps = append(m.regexps, re)
+		case strings.Contains(p, "*"):
+			var w originWildcard
+			host := p
+			if i := strings.Index(p, "://"); i >= 0 {
+				w.scheme = strings.ToLower(p[:i])
+				host = p[i+3:]
+			}
+			if !strings.HasPrefix(host, "*.") || strings.Contains(host[1:], "*") {
+				return nil, errors.Errorf("invalid origin pattern %q: wildcard must be the leftmost label", p)
+			}
+			w.suffix = strings.ToLower(host[1:])
+			m.wildcards = append(m.wildcards, w)
+		default:
+			u, err := url.Parse(p)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, errors.Errorf("invalid origin pattern %q", p)
+			}
+			m.exact[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+		}
+	}
+	return m, nil
+}
+
+// match reports whether the origin is allowed.
+func (m *originMatcher) match(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if m.exact[scheme+"://"+host] {
+		return true
+	}
+	// wildcards match any port as the pattern has no port.
+	hostname := strings.ToLower(u.Hostname())
+	for _, w := range m.wildcards {
+		if (w.scheme == "" || w.scheme == scheme) && strings.HasSuffix(hostname, w.suffix) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginMatcher(t *testing.T) {
+	m, err := newOriginMatcher([]string{
+		"https://example.com",
+		"http://localhost:3000",
+		"https://*.example.net",
+		"*.example.org",
+		`~^https://[a-z]+\.example\.(com|jp)$`,
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	tests := []struct {
+		origin string
+		expect bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"https://www.example.net", true},
+		{"https://a.b.example.net", true},
+		{"https://www.example.net:8443", true},
+		{"https://www.example.net.evil.com:8443", false},
+		{"https://example.net", false},
+		{"http://www.example.net", false},
+		{"https://evilexample.net", false},
+		{"http://www.example.org", true},
+		{"https://www.example.org", true},
+		{"https://www.example.jp", true},
+		{"https://www.example.jp.evil.com", false},
+		{"https://www1.example.jp", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.origin); got != tt.expect {
+			t.Errorf("unexpected result of %q: %t", tt.origin, got)
+		}
+	}
+
+	for _, p := range []string{"example.com", "https://www.*.example.com", "~[", "https://*"} {
+		if _, err := newOriginMatcher([]string{p}); err == nil {
+			t.Errorf("invalid pattern must be error: %q", p)
+		}
+	}
+}
+
+func TestWebSocketServer__Handler__OriginAllowlist(t *testing.T) {
+	var pool SessionPool
+	var called int64
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&called, 1)
+		callbackServer.SuccessHandler(w, r)
+	}))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.OriginPolicy = "allowlist"
+	c.OriginAllowlist = []string{"https://*.example.com"}
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		"Origin":                 {"https://www.example.com"},
+		testRequestSessionHeader: {"hogehoge"},
+	})
+	if err != nil {
+		t.Fatal("cannot connect from allowed origin:", err)
+	}
+	conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		"Origin":                 {"https://www.example.org"},
+		testRequestSessionHeader: {"hogehoge"},
+	})
+	if err == nil {
+		t.Fatal("connection from disallowed origin must fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if n := atomic.LoadInt64(&called); n != 1 {
+		t.Errorf("connect callback must not be called for disallowed origins: %d", n)
+	}
+	if st.OriginRejects() != 1 {
+		t.Errorf("unexpected origin rejects: %d", st.OriginRejects())
+	}
+}
+
+func TestWebSocketServer__HTTPTransports__OriginAllowlist(t *testing.T) {
+	var pool SessionPool
+	var called int64
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&called, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.OriginPolicy = "allowlist"
+	c.OriginAllowlist = []string{"https://*.example.com"}
+	c.SSE.Enabled = true
+	c.LongPolling.Enabled = true
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.Path.SSE, server.SSEHandler)
+	mux.HandleFunc(c.Path.Poll, server.PollHandler)
+	tc := httptest.NewServer(mux)
+	defer tc.Close()
+
+	for _, path := range []string{c.Path.SSE, c.Path.Poll} {
+		req, _ := http.NewRequest(http.MethodGet, tc.URL+path, nil)
+		req.Header.Set("Origin", "https://www.example.org")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("connection to %s from disallowed origin must fail: %d", path, resp.StatusCode)
+		}
+	}
+	if n := atomic.LoadInt64(&called); n != 0 {
+		t.Errorf("connect callback must not be called for disallowed origins: %d", n)
+	}
+	if st.OriginRejects() != 2 {
+		t.Errorf("unexpected origin rejects: %d", st.OriginRejects())
+	}
+
+	// the transports are disabled by default.
+	server = NewWebSocketServer(TestConfig, st, &pool)
+	for _, h := range []http.HandlerFunc{server.SSEHandler, server.SSEMessageHandler, server.PollHandler} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("disabled transport must respond 404: %d", w.Code)
+		}
+	}
+}
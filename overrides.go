@@ -0,0 +1,83 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The headers in the connect callback response to override the configuration of the session.
+const (
+	IDLE_TIMEOUT_HEADER_NAME     = "X-Kuiperbelt-Idle-Timeout"
+	SEND_QUEUE_SIZE_HEADER_NAME  = "X-Kuiperbelt-Send-Queue-Size"
+	MAX_MESSAGE_SIZE_HEADER_NAME = "X-Kuiperbelt-Max-Message-Size"
+	INBOUND_RATE_HEADER_NAME     = "X-Kuiperbelt-Inbound-Rate"
+	INBOUND_BURST_HEADER_NAME    = "X-Kuiperbelt-Inbound-Burst"
+)
+
+// maxSendQueueSize is the maximum of the send queue size overridden by the connect callback.
+// The send queue is allocated for each session, so a larger value is regarded as a mistake.
+const maxSendQueueSize = 65536
+
+// sessionConfig is the configuration of a session.
+// It is the global configuration overridden by the connect callback.
+type sessionConfig struct {
+	IdleTimeout   time.Duration
+	SendQueueSize int
+	InboundLimit  InboundLimit
+}
+
+func newSessionConfig(c Config) sessionConfig {
+	return sessionConfig{
+		IdleTimeout:   c.IdleTimeout,
+		SendQueueSize: c.SendQueueSize,
+		InboundLimit:  c.InboundLimit,
+	}
+}
+
+// override returns the configuration overridden by the headers.
+func (sc sessionConfig) override(h http.Header) (sessionConfig, error) {
+	if v := h.Get(IDLE_TIMEOUT_HEADER_NAME); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return sc, errors.Errorf("invalid %s: %q", IDLE_TIMEOUT_HEADER_NAME, v)
+		}
+		sc.IdleTimeout = d
+	}
+	if v := h.Get(SEND_QUEUE_SIZE_HEADER_NAME); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSendQueueSize {
+			return sc, errors.Errorf("invalid %s: %q", SEND_QUEUE_SIZE_HEADER_NAME, v)
+		}
+		sc.SendQueueSize = n
+	}
+	if v := h.Get(MAX_MESSAGE_SIZE_HEADER_NAME); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return sc, errors.Errorf("invalid %s: %q", MAX_MESSAGE_SIZE_HEADER_NAME, v)
+		}
+		sc.InboundLimit.MaxMessageSize = n
+	}
+	if v := h.Get(INBOUND_RATE_HEADER_NAME); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return sc, errors.Errorf("invalid %s: %q", INBOUND_RATE_HEADER_NAME, v)
+		}
+		sc.InboundLimit.Rate = rate
+		// same as the default of the configuration, and at least 1 as newTokenBucket.
+		sc.InboundLimit.Burst = int(rate)
+		if sc.InboundLimit.Burst < 1 {
+			sc.InboundLimit.Burst = 1
+		}
+	}
+	if v := h.Get(INBOUND_BURST_HEADER_NAME); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return sc, errors.Errorf("invalid %s: %q", INBOUND_BURST_HEADER_NAME, v)
+		}
+		sc.InboundLimit.Burst = n
+	}
+	return sc, nil
+}
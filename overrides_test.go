@@ -0,0 +1,158 @@
+package kuiperbelt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionConfig__Override(t *testing.T) {
+	c := TestConfig
+	c.IdleTimeout = time.Minute
+	c.SendQueueSize = 10
+	c.InboundLimit = InboundLimit{MaxMessageSize: 1024, Rate: 10, Burst: 20, Policy: "close"}
+	base := newSessionConfig(c)
+
+	sc, err := base.override(http.Header{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sc != base {
+		t.Errorf("configuration without headers must not be changed: %+v", sc)
+	}
+
+	sc, err = base.override(http.Header{
+		IDLE_TIMEOUT_HEADER_NAME:     {"1h"},
+		SEND_QUEUE_SIZE_HEADER_NAME:  {"100"},
+		MAX_MESSAGE_SIZE_HEADER_NAME: {"65536"},
+		INBOUND_RATE_HEADER_NAME:     {"2"},
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expect := sessionConfig{
+		IdleTimeout:   time.Hour,
+		SendQueueSize: 100,
+		InboundLimit:  InboundLimit{MaxMessageSize: 65536, Rate: 2, Burst: 2, Policy: "close"},
+	}
+	if sc != expect {
+		t.Errorf("unexpected configuration: %+v", sc)
+	}
+
+	sc, err = base.override(http.Header{
+		INBOUND_RATE_HEADER_NAME:  {"0.5"},
+		INBOUND_BURST_HEADER_NAME: {"3"},
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sc.InboundLimit.Rate != 0.5 || sc.InboundLimit.Burst != 3 {
+		t.Errorf("unexpected inbound limit: %+v", sc.InboundLimit)
+	}
+
+	// the burst of a rate below 1 is at least 1.
+	sc, err = base.override(http.Header{INBOUND_RATE_HEADER_NAME: {"0.5"}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sc.InboundLimit.Rate != 0.5 || sc.InboundLimit.Burst != 1 {
+		t.Errorf("unexpected inbound limit: %+v", sc.InboundLimit)
+	}
+
+	for _, h := range []http.Header{
+		{IDLE_TIMEOUT_HEADER_NAME: {"10"}},
+		{IDLE_TIMEOUT_HEADER_NAME: {"-1s"}},
+		{SEND_QUEUE_SIZE_HEADER_NAME: {"many"}},
+		{SEND_QUEUE_SIZE_HEADER_NAME: {"1000000000"}},
+		{MAX_MESSAGE_SIZE_HEADER_NAME: {"-1"}},
+		{INBOUND_RATE_HEADER_NAME: {"fast"}},
+		{INBOUND_BURST_HEADER_NAME: {"1.5"}},
+	} {
+		if _, err := base.override(h); err == nil {
+			t.Errorf("invalid headers must be error: %v", h)
+		}
+	}
+}
+
+func TestWebSocketServer__Handler__Overrides(t *testing.T) {
+	var pool SessionPool
+	overrides := map[string]http.Header{
+		"hogehoge": {
+			IDLE_TIMEOUT_HEADER_NAME:    {"200ms"},
+			SEND_QUEUE_SIZE_HEADER_NAME: {"64"},
+			INBOUND_RATE_HEADER_NAME:    {"5"},
+		},
+		"fugafuga": {
+			SEND_QUEUE_SIZE_HEADER_NAME: {"many"},
+		},
+	}
+	tcc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(testRequestSessionHeader)
+		for name, values := range overrides[key] {
+			w.Header()[name] = values
+		}
+		w.Header().Set(TestConfig.SessionHeader, key)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.SendQueueSize = 1
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		testRequestSessionHeader: []string{"hogehoge"},
+	})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer conn.Close()
+
+	var session *WebSocketSession
+	for i := 0; i < 50; i++ {
+		if s, err := pool.Get("hogehoge"); err == nil {
+			session = s.(*WebSocketSession)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if session == nil {
+		t.Fatal("session is not registered")
+	}
+	if cap(session.send) != 64 {
+		t.Errorf("unexpected send queue size: %d", cap(session.send))
+	}
+	if session.inbound == nil || session.inbound.rate != 5 {
+		t.Errorf("unexpected inbound rate limit: %+v", session.inbound)
+	}
+
+	// the session is closed by the overridden idle timeout.
+	select {
+	case <-session.Closed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session is not closed by the idle timeout")
+	}
+	if reason := session.getCloseReason(); reason.Initiator != "idle" {
+		t.Errorf("unexpected close reason: %+v", reason)
+	}
+
+	// the invalid overrides are rejected.
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		testRequestSessionHeader: []string{"fugafuga"},
+	})
+	if err == nil {
+		t.Fatal("connection with invalid overrides must fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
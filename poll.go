@@ -0,0 +1,285 @@
+package kuiperbelt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// PollSession is a session over HTTP long-polling for clients which cannot use WebSocket nor Server-Sent Events.
+// Messages are queued in the send queue of the session, and returned to the client in a batch by each poll.
+// The session is closed when no poll comes within long_polling.gap.
+type PollSession struct {
+	*httpSession
+	gap *time.Timer
+
+	pollMu   sync.Mutex
+	polling  bool
+	deadline time.Time
+	// expired is true after the expiration of JWT is handled. It is accessed only in a poll.
+	expired bool
+}
+
+// pollMessage is a message in the response of a poll.
+type pollMessage struct {
+	// Type is "text" or "binary". Data of a binary message is encoded in base64.
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// pollClose is the close frame in the response of a poll.
+type pollClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// pollResponse is the response of a poll. Session and Token are responded only on connect.
+type pollResponse struct {
+	Session  string        `json:"session,omitempty"`
+	Token    string        `json:"token,omitempty"`
+	Messages []pollMessage `json:"messages"`
+	Close    *pollClose    `json:"close,omitempty"`
+}
+
+func (s *WebSocketServer) newPollSession(hs *httpSession) *PollSession {
+	gap := s.Config.LongPolling.Gap
+	session := &PollSession{
+		httpSession: hs,
+		deadline:    time.Now().Add(gap),
+	}
+	session.gap = time.AfterFunc(gap, session.expire)
+	return session
+}
+
+// PollHandler handles requests of long-polling transport.
+//
+//	GET  /poll                       - connects as /connect, and responds the session, the token and the hello message.
+//	GET  /poll?session=...&token=... - waits for messages to the session, and responds them in a batch.
+//	POST /poll?session=...&token=... - passes the request body to the receive callback.
+func (s *WebSocketServer) PollHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !s.Config.LongPolling.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Get("session") == "":
+		s.pollConnect(w, r)
+		return
+	case r.Method == http.MethodGet, r.Method == http.MethodPost:
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := s.Pool.Get(query.Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ps, ok := session.(*PollSession)
+	if !ok || !ps.authorize(query.Get("token")) {
+		// do not tell whether the session exists.
+		http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.receiveHTTP(w, r, ps.httpSession)
+		return
+	}
+	ps.poll(w, r)
+}
+
+func (s *WebSocketServer) pollConnect(w http.ResponseWriter, r *http.Request) {
+	release := s.admit(w, r)
+	if release == nil {
+		return
+	}
+	s.Stats.ConnectEvent()
+
+	hs, hello, ok := s.connectHTTP(w, r, "polling")
+	if !ok {
+		release()
+		s.Stats.DisconnectEvent()
+		return
+	}
+	session := s.newPollSession(hs)
+	s.addSession(session)
+	go func() {
+		// the session lives across polls until it is closed.
+		<-session.Closed()
+		session.gap.Stop()
+		release()
+		s.Stats.DisconnectEvent()
+	}()
+
+	resp := pollResponse{
+		Session:  session.Key(),
+		Token:    session.token,
+		Messages: []pollMessage{},
+	}
+	if hello != nil {
+		s.Stats.MessageEvent()
+		session.add(&resp, *hello)
+	}
+	writePollResponse(w, resp)
+}
+
+// poll waits for messages until long_polling.timeout, and responds them in a batch.
+func (s *PollSession) poll(w http.ResponseWriter, r *http.Request) {
+	if !s.begin() {
+		http.Error(w, "session is already polled", http.StatusConflict)
+		return
+	}
+	defer s.end()
+
+	resp := pollResponse{Messages: []pollMessage{}}
+	timeout := s.server.Config.LongPolling.Timeout
+	if exp := s.info.TokenExpiresAt; !exp.IsZero() && !s.expired {
+		if d := time.Until(exp); d <= 0 {
+			s.tokenExpired(&resp)
+			writePollResponse(w, resp)
+			return
+		} else if d < timeout {
+			// handle the expiration by the next poll.
+			timeout = d
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-s.send:
+		s.add(&resp, msg)
+	batch:
+		// batch the queued messages.
+		for len(resp.Messages) < s.server.Config.LongPolling.MaxMessages && resp.Close == nil {
+			select {
+			case msg := <-s.send:
+				s.add(&resp, msg)
+			default:
+				break batch
+			}
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+		// the client has gone.
+		return
+	case <-s.closedch:
+		reason := s.getCloseReason()
+		resp.Close = &pollClose{Code: reason.Code, Reason: reason.Text}
+	}
+	writePollResponse(w, resp)
+}
+
+// add adds the message to the response. The session is closed by the last word.
+func (s *PollSession) add(resp *pollResponse, message Message) {
+	if m, err := s.encode(message); err != nil {
+		s.server.Stats.MessageErrorEvent()
+		Log.Error("cannot encode message",
+			zap.Error(err),
+			zap.String("session", s.Key()),
+		)
+	} else {
+		resp.Messages = append(resp.Messages, m)
+	}
+	if !message.LastWord {
+		return
+	}
+	code := message.CloseCode
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	s.setCloseReason("server", code, message.CloseReason)
+	resp.Close = &pollClose{Code: code, Reason: message.CloseReason}
+	s.close(!message.FromPostClose)
+}
+
+func (s *PollSession) encode(message Message) (pollMessage, error) {
+	bs, messageType, err := messageMarshal(message)
+	if err != nil {
+		return pollMessage{}, err
+	}
+	if message.TraceParent != "" {
+		span := s.server.tracer.StartSpan("deliver", spanKindProducer, message.traceContext())
+		span.SetAttribute("kuiperbelt.session", s.Key())
+		span.SetAttribute("messaging.message_payload_size_bytes", len(bs))
+		span.End()
+	}
+	s.sent(messageType, message.ContentType, bs)
+	if messageType == websocket.BinaryMessage {
+		return pollMessage{Type: "binary", Data: base64.StdEncoding.EncodeToString(bs)}, nil
+	}
+	return pollMessage{Type: "text", Data: string(bs)}, nil
+}
+
+// tokenExpired handles the expiration of JWT by jwt.expiry.
+func (s *PollSession) tokenExpired(resp *pollResponse) {
+	s.expired = true
+	s.server.sessionLog.Info("session token expired",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.String("policy", s.server.Config.JWT.Expiry),
+	)
+	if s.server.Config.JWT.Expiry == "warn" {
+		s.add(resp, Message{
+			Body:        []byte(`{"error":"token_expired"}`),
+			ContentType: "application/json",
+			Session:     s.Key(),
+		})
+		return
+	}
+	s.setCloseReason("server", websocket.ClosePolicyViolation, "token_expired")
+	resp.Close = &pollClose{Code: websocket.ClosePolicyViolation, Reason: "token_expired"}
+	s.Close()
+}
+
+// begin marks the session as polling. It reports false if the session is already polled.
+func (s *PollSession) begin() bool {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	if s.polling {
+		return false
+	}
+	s.polling = true
+	return true
+}
+
+// end marks the end of a poll, and waits for the next poll within long_polling.gap.
+func (s *PollSession) end() {
+	gap := s.server.Config.LongPolling.Gap
+	s.pollMu.Lock()
+	s.polling = false
+	s.deadline = time.Now().Add(gap)
+	s.pollMu.Unlock()
+	s.gap.Reset(gap)
+}
+
+// expire closes the session if no poll comes within long_polling.gap.
+func (s *PollSession) expire() {
+	s.pollMu.Lock()
+	alive := s.polling || time.Now().Before(s.deadline)
+	s.pollMu.Unlock()
+	if alive {
+		return
+	}
+	s.server.sessionLog.Info("session poll gap exceeded",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.Duration("duration", time.Since(s.connectedAt)),
+	)
+	s.setCloseReason("idle", 0, "")
+	s.Close()
+}
+
+func writePollResponse(w http.ResponseWriter, resp pollResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
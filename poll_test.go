@@ -0,0 +1,170 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPoll(t *testing.T, url string) pollResponse {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("cannot poll:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status of poll: %d", resp.StatusCode)
+	}
+	var pr pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		t.Fatal("cannot decode poll response:", err)
+	}
+	return pr
+}
+
+func TestWebSocketServer__PollHandler(t *testing.T) {
+	c := TestConfig
+	c.LongPolling.Enabled = true
+
+	received := make(chan string, 1)
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tccConnect := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tccConnect.Close()
+	tccReceive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		b.ReadFrom(r.Body)
+		received <- b.String()
+	}))
+	defer tccReceive.Close()
+	c.Callback.Connect = tccConnect.URL
+	c.Callback.Receive = tccReceive.URL
+	c.SendQueueSize = 4
+	c.LongPolling.Timeout = 100 * time.Millisecond
+
+	var pool SessionPool
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.PollHandler))
+	defer tc.Close()
+	proxy := NewProxy(c, st, &pool)
+
+	open := testPoll(t, tc.URL)
+	if open.Session != "hogehoge" || open.Token == "" {
+		t.Fatalf("unexpected connect response: %+v", open)
+	}
+	if len(open.Messages) != 1 || open.Messages[0] != (pollMessage{Type: "text", Data: testHelloMessage}) {
+		t.Errorf("unexpected hello message: %+v", open.Messages)
+	}
+	pollURL := tc.URL + "?session=hogehoge&token=" + open.Token
+
+	// no messages until the timeout.
+	if pr := testPoll(t, pollURL); len(pr.Messages) != 0 || pr.Close != nil {
+		t.Errorf("unexpected response: %+v", pr)
+	}
+
+	// queued messages are responded in a batch.
+	for _, body := range []string{"foo", "bar"} {
+		req := httptest.NewRequest(http.MethodPost, c.Path.Send, strings.NewReader(body))
+		req.Header.Set(c.SessionHeader, "hogehoge")
+		w := httptest.NewRecorder()
+		proxy.SendHandlerFunc(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected send status: %d %s", w.Code, w.Body.String())
+		}
+	}
+	pr := testPoll(t, pollURL)
+	if len(pr.Messages) != 2 || pr.Messages[0].Data != "foo" || pr.Messages[1].Data != "bar" {
+		t.Errorf("unexpected messages: %+v", pr.Messages)
+	}
+
+	// post a message from the client.
+	if resp, err := http.Get(tc.URL + "?session=hogehoge&token=invalid"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll with invalid token must be rejected: %+v %s", resp, err)
+	}
+	resp, err := http.Post(pollURL, "text/plain", strings.NewReader("from client"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected message response: %+v %s", resp, err)
+	}
+	resp.Body.Close()
+	select {
+	case m := <-received:
+		if m != "from client" {
+			t.Errorf("unexpected received message: %s", m)
+		}
+	case <-time.After(time.Second):
+		t.Error("receive callback is not called")
+	}
+
+	// close from the backend.
+	req := httptest.NewRequest(http.MethodPost, c.Path.Close, strings.NewReader("bye"))
+	req.Header.Set(c.SessionHeader, "hogehoge")
+	proxy.CloseHandlerFunc(httptest.NewRecorder(), req)
+	pr = testPoll(t, pollURL)
+	if len(pr.Messages) != 1 || pr.Messages[0].Data != "bye" || pr.Close == nil || pr.Close.Code != 1000 {
+		t.Errorf("unexpected last response: %+v", pr)
+	}
+	if _, err := pool.Get("hogehoge"); err == nil {
+		t.Error("session must be closed")
+	}
+}
+
+func TestPollSession__Gap(t *testing.T) {
+	c := TestConfig
+	c.LongPolling.Enabled = true
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tccConnect := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tccConnect.Close()
+	tccClose := httptest.NewServer(http.HandlerFunc(callbackServer.CloseHandler))
+	defer tccClose.Close()
+	c.Callback.Connect = tccConnect.URL
+	c.Callback.Close = tccClose.URL
+	c.LongPolling.Timeout = 200 * time.Millisecond
+	c.LongPolling.Gap = 100 * time.Millisecond
+
+	var pool SessionPool
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.PollHandler))
+	defer tc.Close()
+
+	open := testPoll(t, tc.URL)
+	pollURL := tc.URL + "?session=hogehoge&token=" + open.Token
+
+	// a poll longer than the gap keeps the session.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.Get(pollURL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if resp, err := http.Get(pollURL); err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("concurrent poll must be rejected: %+v %s", resp, err)
+	}
+	<-done
+	session, err := pool.Get("hogehoge")
+	if err != nil {
+		t.Fatal("session must be alive:", err)
+	}
+
+	select {
+	case <-session.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("session is not closed after the gap")
+	}
+	for i := 0; i < 50 && !callbackServer.IsClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var payload closeCallbackPayload
+	if err := json.Unmarshal(callbackServer.CloseBody(), &payload); err != nil {
+		t.Fatal("cannot decode close callback payload:", err)
+	}
+	if payload.Transport != "polling" || payload.Initiator != "idle" {
+		t.Errorf("unexpected close callback payload: %+v", payload)
+	}
+}
@@ -8,11 +8,24 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
 )
 
 const (
 	ioBufferSize = 4096
+
+	// CLOSE_CODE_HEADER_NAME and CLOSE_REASON_HEADER_NAME are the code and reason of the close frame in /close request.
+	CLOSE_CODE_HEADER_NAME   = "X-Kuiperbelt-Close-Code"
+	CLOSE_REASON_HEADER_NAME = "X-Kuiperbelt-Close-Reason"
+
+	// maxCloseReasonSize is the maximum size of the reason in a close frame.
+	// The payload of a control frame is up to 125 bytes including 2 bytes of the code.
+	maxCloseReasonSize = 123
 )
 
 type sessionErrors []sessionError
@@ -30,6 +43,17 @@ type Proxy struct {
 	Config Config
 	Stats  *Stats
 	Pool   *SessionPool
+
+	// Directory is used to forward requests to the nodes holding sessions in cluster mode.
+	// If nil, cluster mode is disabled.
+	Directory SessionDirectory
+	// Backplane is used to publish messages to the sessions in all nodes. If nil, /publish is disabled.
+	Backplane Backplane
+
+	// tracer records spans of the backend API. If nil, tracing is disabled.
+	tracer *tracer
+	// accessLog is the file of the access log opened by Register. If nil, the access log is not written to a file.
+	accessLog *accessLogFile
 }
 
 func NewProxy(c Config, s *Stats, p *SessionPool) *Proxy {
@@ -45,15 +69,44 @@ func (p *Proxy) Register() {
 	mux.HandleFunc(p.Config.Path.Send, p.SendHandlerFunc)
 	mux.HandleFunc(p.Config.Path.Close, p.CloseHandlerFunc)
 	mux.HandleFunc(p.Config.Path.Ping, p.PingHandlerFunc)
+	if p.Config.Cluster.Enabled {
+		mux.HandleFunc(p.Config.Path.ClusterLookup, p.ClusterLookupHandlerFunc)
+	}
+	if p.Backplane != nil {
+		mux.HandleFunc(p.Config.Path.Publish, p.PublishHandlerFunc)
+	}
 	if p.Config.SuppressAccessLog {
 		http.Handle("/", mux)
 	} else {
-		l := NewLoggingHandler(mux)
+		l, f, err := newLoggingHandler(mux, p.Config)
+		if err != nil {
+			Log.Fatal("failed open access log",
+				zap.Error(err),
+				zap.String("path", p.Config.AccessLog.Path),
+			)
+		}
+		p.accessLog = f
 		http.Handle("/", l)
 	}
 }
 
-func (p *Proxy) handlerPreHook(w http.ResponseWriter, r *http.Request) ([]Session, error) {
+// ReopenAccessLog reopens the file of the access log after it is rotated.
+func (p *Proxy) ReopenAccessLog() error {
+	if p.accessLog == nil {
+		return nil
+	}
+	return p.accessLog.Reopen()
+}
+
+// CloseAccessLog closes the file of the access log.
+func (p *Proxy) CloseAccessLog() error {
+	if p.accessLog == nil {
+		return nil
+	}
+	return p.accessLog.Close()
+}
+
+func (p *Proxy) handlerPreHook(w http.ResponseWriter, r *http.Request) ([]string, error) {
 	if r.Method != "POST" {
 		w.Header().Add("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -67,6 +120,12 @@ func (p *Proxy) handlerPreHook(w http.ResponseWriter, r *http.Request) ([]Sessio
 		io.WriteString(w, `{"errors":[{"error":"session header is missing"}],"result":"NG"}`)
 		return nil, errors.New("kuiperbelt: session header is missing")
 	}
+
+	return keys, nil
+}
+
+// lookup gets the sessions from the pool. The keys not found are returned as errors.
+func (p *Proxy) lookup(keys []string) ([]Session, sessionErrors) {
 	ss := make([]Session, 0, len(keys))
 	se := make(sessionErrors, 0, len(keys))
 	for _, key := range keys {
@@ -77,14 +136,65 @@ func (p *Proxy) handlerPreHook(w http.ResponseWriter, r *http.Request) ([]Sessio
 		}
 		ss = append(ss, s)
 	}
-	if len(se) > 0 {
-		return ss, se
+	return ss, se
+}
+
+// dispatch delivers the message to the sessions of keys, as the request of path having header.
+// The sessions in the other nodes are forwarded to them in cluster mode.
+// It returns the number of delivered sessions and the errors of the others.
+// In strict broadcast, the message is delivered to no session if some of them are not found.
+func (p *Proxy) dispatch(ctx context.Context, path string, header http.Header, keys []string, message Message, tc traceContext) (int, sessionErrors) {
+	ss, se := p.lookup(keys)
+	var remote map[string][]string
+	remote, se = p.resolveRemoteSessions(ctx, header, se)
+	if p.Config.StrictBroadcast && len(se) > 0 {
+		return 0, se
+	}
+
+	body := message.Body
+	if p.Config.Compression.Enabled && len(ss) > 1 && !message.LastWord {
+		// compress the broadcast message once for all sessions.
+		message = prepareMessage(message)
+	}
+
+	var cancel context.CancelFunc
+	if p.Config.SendTimeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.Config.SendTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
+	defer cancel()
 
-	return ss, nil
+	var delivered int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, errs := p.deliver(ctx, ss, message)
+		mu.Lock()
+		defer mu.Unlock()
+		se = append(se, errs...)
+		delivered += n
+	}()
+	for endpoint, keys := range remote {
+		endpoint, keys := endpoint, keys
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs := p.forward(ctx, path, header, endpoint, keys, body, tc)
+			mu.Lock()
+			defer mu.Unlock()
+			se = append(se, errs...)
+			delivered += len(keys) - len(errs)
+		}()
+	}
+	wg.Wait()
+
+	return delivered, se
 }
 
-func (p *Proxy) sessionKeysErrorHandler(w http.ResponseWriter, se sessionErrors, ss []Session) {
+func (p *Proxy) sessionKeysErrorHandler(w http.ResponseWriter, se sessionErrors) {
 	res := struct {
 		Errors []sessionError `json:"errors"`
 		Result string         `json:"result"`
@@ -109,14 +219,26 @@ func (p *Proxy) sessionKeysErrorHandler(w http.ResponseWriter, se sessionErrors,
 func (p *Proxy) SendHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	ss, err := p.handlerPreHook(w, r)
-	se, ok := err.(sessionErrors)
-	if ok {
-		if p.Config.StrictBroadcast {
-			p.sessionKeysErrorHandler(w, se, ss)
-			return
+	start := time.Now()
+	rl := &responseLogger{w: w}
+	w = rl
+	parent, _ := parseTraceContext(r.Header)
+	span := p.tracer.StartSpan("send", spanKindServer, parent)
+	var delivered int
+	defer func() {
+		p.Stats.HandlerEvent("send", rl.status, time.Since(start))
+		span.SetStatusCode(rl.status)
+		span.End()
+		keys := r.Header[p.Config.SessionHeader]
+		if e := accessLogEntryFromContext(r.Context()); e != nil {
+			e.Sessions = keys
+			e.Delivered = delivered
+			e.Failed = len(keys) - delivered
 		}
-	} else if err != nil {
+	}()
+
+	keys, err := p.handlerPreHook(w, r)
+	if err != nil {
 		return
 	}
 
@@ -131,38 +253,14 @@ func (p *Proxy) SendHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	message := Message{
 		Body:        buf,
 		ContentType: r.Header.Get("Content-Type"),
+		TraceParent: span.ctx.Traceparent(),
+		TraceState:  span.ctx.State,
 	}
 
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if p.Config.SendTimeout != 0 {
-		ctx, cancel = context.WithTimeout(r.Context(), p.Config.SendTimeout)
-	} else {
-		ctx, cancel = context.WithCancel(r.Context())
-	}
-	defer cancel()
-
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(len(ss))
-	for _, s := range ss {
-		s := s
-		go func() {
-			defer wg.Done()
-			if err := p.sendMessage(ctx, s, message); err != nil {
-				mu.Lock()
-				se = append(se, sessionError{
-					Error:   err.Error(),
-					Session: s.Key(),
-				})
-				mu.Unlock()
-			}
-		}()
-	}
-	wg.Wait()
-
+	var se sessionErrors
+	delivered, se = p.dispatch(r.Context(), r.URL.Path, r.Header, keys, message, span.ctx)
 	if len(se) > 0 {
-		p.sessionKeysErrorHandler(w, se, ss)
+		p.sessionKeysErrorHandler(w, se)
 		return
 	}
 
@@ -175,14 +273,40 @@ func (p *Proxy) SendHandlerFunc(w http.ResponseWriter, r *http.Request) {
 func (p *Proxy) CloseHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	ss, err := p.handlerPreHook(w, r)
-	se, ok := err.(sessionErrors)
-	if ok {
-		if p.Config.StrictBroadcast {
-			p.sessionKeysErrorHandler(w, se, ss)
-			return
+	start := time.Now()
+	rl := &responseLogger{w: w}
+	w = rl
+	parent, _ := parseTraceContext(r.Header)
+	span := p.tracer.StartSpan("close", spanKindServer, parent)
+	var delivered int
+	defer func() {
+		p.Stats.HandlerEvent("close", rl.status, time.Since(start))
+		span.SetStatusCode(rl.status)
+		span.End()
+		keys := r.Header[p.Config.SessionHeader]
+		if e := accessLogEntryFromContext(r.Context()); e != nil {
+			e.Sessions = keys
+			e.Delivered = delivered
+			e.Failed = len(keys) - delivered
 		}
-	} else if err != nil {
+	}()
+
+	keys, err := p.handlerPreHook(w, r)
+	if err != nil {
+		return
+	}
+
+	code, reason, err := parseCloseFrame(r.Header)
+	if err != nil {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Errors []sessionError `json:"errors"`
+			Result string         `json:"result"`
+		}{
+			Errors: []sessionError{{Error: err.Error()}},
+			Result: "NG",
+		})
 		return
 	}
 
@@ -199,38 +323,16 @@ func (p *Proxy) CloseHandlerFunc(w http.ResponseWriter, r *http.Request) {
 		ContentType:   r.Header.Get("Content-Type"),
 		LastWord:      true,
 		FromPostClose: true,
+		CloseCode:     code,
+		CloseReason:   reason,
+		TraceParent:   span.ctx.Traceparent(),
+		TraceState:    span.ctx.State,
 	}
 
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if p.Config.SendTimeout != 0 {
-		ctx, cancel = context.WithTimeout(r.Context(), p.Config.SendTimeout)
-	} else {
-		ctx, cancel = context.WithCancel(r.Context())
-	}
-	defer cancel()
-
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(len(ss))
-	for _, s := range ss {
-		s := s
-		go func() {
-			defer wg.Done()
-			if err := p.sendMessage(ctx, s, message); err != nil {
-				mu.Lock()
-				se = append(se, sessionError{
-					Error:   err.Error(),
-					Session: s.Key(),
-				})
-				mu.Unlock()
-			}
-		}()
-	}
-	wg.Wait()
-
+	var se sessionErrors
+	delivered, se = p.dispatch(r.Context(), r.URL.Path, r.Header, keys, message, span.ctx)
 	if len(se) > 0 {
-		p.sessionKeysErrorHandler(w, se, ss)
+		p.sessionKeysErrorHandler(w, se)
 		return
 	}
 
@@ -250,18 +352,75 @@ type sessionError struct {
 	Session string `json:"session"`
 }
 
+// deliver sends the message to the sessions concurrently.
+// It returns the number of sessions which the message is queued to, and the errors of the others.
+func (p *Proxy) deliver(ctx context.Context, ss []Session, message Message) (int, sessionErrors) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var delivered int
+	var se sessionErrors
+	wg.Add(len(ss))
+	for _, s := range ss {
+		s := s
+		go func() {
+			defer wg.Done()
+			err := p.sendMessage(ctx, s, message)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				se = append(se, sessionError{
+					Error:   err.Error(),
+					Session: s.Key(),
+				})
+				return
+			}
+			delivered++
+		}()
+	}
+	wg.Wait()
+	return delivered, se
+}
+
 func (p *Proxy) sendMessage(ctx context.Context, s Session, message Message) error {
 	p.Stats.MessageEvent()
 	q := s.Send()
 	if q == nil {
 		return errors.New("kuiperbelt: session is closed")
 	}
+	start := time.Now()
 	select {
 	case q <- message:
 	case <-ctx.Done():
+		p.Stats.QueueWaitEvent("timeout", time.Since(start))
 		return ctx.Err()
 	case <-s.Closed():
+		p.Stats.QueueWaitEvent("closed", time.Since(start))
 		return errors.New("kuiperbelt: session is closed")
 	}
+	p.Stats.QueueWaitEvent("ok", time.Since(start))
 	return nil
 }
+
+// parseCloseFrame returns the code and reason of the close frame in /close request.
+// The code must be 1000 (normal closure) or 3000-4999 (application defined). The default is 1000.
+func parseCloseFrame(h http.Header) (int, string, error) {
+	code := websocket.CloseNormalClosure
+	if v := h.Get(CLOSE_CODE_HEADER_NAME); v != "" {
+		var err error
+		code, err = strconv.Atoi(v)
+		if err != nil || !validCloseCode(code) {
+			return 0, "", fmt.Errorf("invalid close code: %s", v)
+		}
+	}
+	reason := h.Get(CLOSE_REASON_HEADER_NAME)
+	if len(reason) > maxCloseReasonSize {
+		return 0, "", fmt.Errorf("close reason is too long: %d bytes", len(reason))
+	}
+	return code, reason, nil
+}
+
+// validCloseCode reports whether the code can be sent by the backend.
+// It must be 1000 (normal closure) or 3000-4999 (application defined).
+func validCloseCode(code int) bool {
+	return code == websocket.CloseNormalClosure || (code >= 3000 && code <= 4999)
+}
@@ -542,3 +542,73 @@ func TestProxySendHandlerFunc__Timeout(t *testing.T) {
 		t.Fatalf("proxy handler response unexpected response: %+v", result)
 	}
 }
+
+func TestProxyCloseHandlerFunc__CloseCode(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+
+	tc := TestConfig
+	tc.Callback.Connect = tcc.URL
+	st := NewStats()
+	p := NewProxy(tc, st, &pool)
+	ts := httptest.NewServer(http.HandlerFunc(p.CloseHandlerFunc))
+	defer ts.Close()
+	server := NewWebSocketServer(tc, st, &pool)
+	th := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer th.Close()
+
+	wsURL := strings.Replace(th.URL, "http://", "ws://", -1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{testRequestSessionHeader: []string{"hogehoge"}})
+	if err != nil {
+		t.Fatal("cannot create connection config error:", err)
+	}
+	defer conn.Close()
+	conn.ReadMessage() // ignore hello message
+
+	close := func(code, reason string) int {
+		req, _ := http.NewRequest("POST", ts.URL, bytes.NewBufferString("good bye"))
+		req.Header.Add(tc.SessionHeader, "hogehoge")
+		req.Header.Set(CLOSE_CODE_HEADER_NAME, code)
+		req.Header.Set(CLOSE_REASON_HEADER_NAME, reason)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("proxy handler request unexpected error:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := close("1006", ""); status != http.StatusBadRequest {
+		t.Errorf("reserved close code must be rejected: %d", status)
+	}
+
+	// the method is checked before the close frame.
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set(CLOSE_CODE_HEADER_NAME, "1006")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("proxy handler request unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status of GET request: %d", resp.StatusCode)
+	}
+	if status := close("4001", strings.Repeat("x", maxCloseReasonSize+1)); status != http.StatusBadRequest {
+		t.Errorf("too long close reason must be rejected: %d", status)
+	}
+	if status := close("4001", "maintenance"); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "good bye" {
+		t.Errorf("unexpected last message: %s %v", msg, err)
+	}
+	_, _, err = conn.ReadMessage()
+	ce, ok := err.(*websocket.CloseError)
+	if !ok || ce.Code != 4001 || ce.Text != "maintenance" {
+		t.Errorf("unexpected close: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package kuiperbelt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	now := time.Now()
+
+	if !b.allowAt(now) || !b.allowAt(now) {
+		t.Fatal("burst tokens must be allowed")
+	}
+	if b.allowAt(now) {
+		t.Error("must not be allowed over the burst")
+	}
+	if b.allowAt(now.Add(50 * time.Millisecond)) {
+		t.Error("must not be allowed before a token is filled")
+	}
+	if !b.allowAt(now.Add(100 * time.Millisecond)) {
+		t.Error("must be allowed after a token is filled")
+	}
+	if !b.allowAt(now.Add(time.Hour)) || !b.allowAt(now.Add(time.Hour)) || b.allowAt(now.Add(time.Hour)) {
+		t.Error("tokens must not be filled over the burst")
+	}
+}
+
+func TestTokenBucket__Unlimited(t *testing.T) {
+	b := newTokenBucket(0, 0)
+	if b != nil {
+		t.Fatal("zero rate must be unlimited")
+	}
+	for i := 0; i < 100; i++ {
+		if !b.Allow() {
+			t.Fatal("unlimited bucket must allow everything")
+		}
+	}
+}
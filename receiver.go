@@ -19,20 +19,24 @@ type receivedMessage struct {
 }
 
 func newReceivedMessage(msgType int, h http.Header, r io.Reader) receivedMessage {
-	var contentType string
-	switch msgType {
-	case websocket.TextMessage:
-		contentType = "text/plain"
-	case websocket.BinaryMessage:
-		contentType = "application/octet-stream"
-	}
 	return receivedMessage{
 		Message:     r,
-		ContentType: contentType,
+		ContentType: messageContentType(msgType),
 		Header:      h,
 	}
 }
 
+// messageContentType returns Content-Type of a WebSocket message type.
+func messageContentType(msgType int) string {
+	switch msgType {
+	case websocket.TextMessage:
+		return "text/plain"
+	case websocket.BinaryMessage:
+		return "application/octet-stream"
+	}
+	return ""
+}
+
 // Receiver is proxy message from a client
 type Receiver interface {
 	Receive(context.Context, receivedMessage) error
@@ -0,0 +1,250 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	redisDialTimeout      = 5 * time.Second
+	redisReconnectBackoff = time.Second
+
+	defaultBackplaneTimeout = time.Second
+)
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a minimal client of Redis serialization protocol.
+// The backplane needs only AUTH, PUBLISH and SUBSCRIBE, so it is written here
+// to keep the dependencies small instead of depending on a Redis client library.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to Redis, and authenticates within timeout if password is set.
+func dialRedis(ctx context.Context, addr, password string, timeout time.Duration) (*redisConn, error) {
+	d := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot dial redis")
+	}
+	c := &redisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	if password != "" {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed auth redis")
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *redisConn) send(args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := buf.WriteTo(c.conn)
+	return err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply. It returns string, int64, []byte, []interface{} or nil.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, redisError("invalid reply: " + strconv.Quote(line))
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, redisError("invalid reply: " + strconv.Quote(line))
+}
+
+// RedisBackplane is a Backplane by Redis pub/sub.
+type RedisBackplane struct {
+	addr     string
+	password string
+	channel  string
+	timeout  time.Duration
+
+	mu  sync.Mutex
+	pub *redisConn
+}
+
+// NewRedisBackplane returns a new RedisBackplane publishing to the channel.
+// A request to Redis fails after timeout. If timeout is 0, it is 1s.
+func NewRedisBackplane(addr, password, channel string, timeout time.Duration) *RedisBackplane {
+	if timeout <= 0 {
+		timeout = defaultBackplaneTimeout
+	}
+	return &RedisBackplane{
+		addr:     addr,
+		password: password,
+		channel:  channel,
+		timeout:  timeout,
+	}
+}
+
+// Publish publishes the envelope within the timeout, or until ctx is done if it is earlier.
+func (b *RedisBackplane) Publish(ctx context.Context, e Envelope) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal envelope")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pub == nil {
+		b.pub, err = dialRedis(ctx, b.addr, b.password, b.timeout)
+		if err != nil {
+			return err
+		}
+	}
+	// the connection is locked while publishing, so it must not wait forever.
+	deadline := time.Now().Add(b.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	b.pub.conn.SetDeadline(deadline)
+	if _, err := b.pub.do("PUBLISH", b.channel, string(payload)); err != nil {
+		if _, ok := err.(redisError); !ok {
+			// the connection is broken. reconnect at the next time.
+			b.pub.Close()
+			b.pub = nil
+		}
+		return errors.Wrap(err, "failed publish")
+	}
+	return nil
+}
+
+func (b *RedisBackplane) Subscribe(ctx context.Context, handler func(Envelope)) error {
+	for {
+		err := b.subscribe(ctx, handler)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		Log.Error("redis subscription is disconnected. reconnecting...",
+			zap.Error(err),
+			zap.String("addr", b.addr),
+		)
+		select {
+		case <-time.After(redisReconnectBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *RedisBackplane) subscribe(ctx context.Context, handler func(Envelope)) error {
+	c, err := dialRedis(ctx, b.addr, b.password, b.timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	// messages are waited without deadline after subscribing.
+	c.conn.SetWriteDeadline(time.Now().Add(b.timeout))
+	if err := c.send("SUBSCRIBE", b.channel); err != nil {
+		return errors.Wrap(err, "failed subscribe")
+	}
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 3 {
+			continue
+		}
+		if kind, _ := values[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		payload, _ := values[2].([]byte)
+		var e Envelope
+		if err := json.Unmarshal(payload, &e); err != nil {
+			Log.Error("cannot unmarshal envelope", zap.Error(err))
+			continue
+		}
+		handler(e)
+	}
+}
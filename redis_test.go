@@ -0,0 +1,187 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedisServer is a fake Redis server supporting PUBLISH and SUBSCRIBE.
+type testRedisServer struct {
+	ln          net.Listener
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newTestRedisServer(t *testing.T) *testRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	s := &testRedisServer{
+		ln:          ln,
+		subscribers: make(map[string][]net.Conn),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testRedisServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testRedisServer) Close() {
+	s.ln.Close()
+}
+
+func (s *testRedisServer) subscribed(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+func (s *testRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, l+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			args[i] = string(b[:l])
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			s.mu.Lock()
+			s.subscribers[args[1]] = append(s.subscribers[args[1]], conn)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			s.mu.Lock()
+			subscribers := s.subscribers[args[1]]
+			for _, sub := range subscribers {
+				fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+					len(args[1]), args[1], len(args[2]), args[2])
+			}
+			s.mu.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", len(subscribers))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func TestRedisBackplane(t *testing.T) {
+	server := newTestRedisServer(t)
+	defer server.Close()
+
+	b := NewRedisBackplane(server.Addr(), "", "kuiperbelt-test", time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan Envelope, 1)
+	go b.Subscribe(ctx, func(e Envelope) {
+		received <- e
+	})
+	for i := 0; i < 50 && server.subscribed("kuiperbelt-test") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e := Envelope{
+		Sessions:    []string{"hogehoge"},
+		Body:        []byte{0x00, 0xff, '\r', '\n'},
+		ContentType: "application/octet-stream",
+		Origin:      "localhost",
+	}
+	if err := b.Publish(ctx, e); err != nil {
+		t.Fatal("unexpected error on publish:", err)
+	}
+
+	select {
+	case got := <-received:
+		if string(got.Body) != string(e.Body) || got.ContentType != e.ContentType || len(got.Sessions) != 1 || got.Sessions[0] != "hogehoge" {
+			t.Errorf("unexpected envelope: %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("envelope is not received")
+	}
+}
+
+func TestRedisConn__ErrorReply(t *testing.T) {
+	server := newTestRedisServer(t)
+	defer server.Close()
+
+	c, err := dialRedis(context.Background(), server.Addr(), "", time.Second)
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	defer c.Close()
+	_, err = c.do("GET", "hogehoge")
+	if _, ok := err.(redisError); !ok {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestRedisBackplane__PublishTimeout(t *testing.T) {
+	// the server accepts connections, and never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	b := NewRedisBackplane(ln.Addr().String(), "", "kuiperbelt-test", 100*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Publish(context.Background(), Envelope{Body: []byte("hello")})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("publish without reply must fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish blocks without reply")
+	}
+	if b.pub != nil {
+		t.Error("timed out connection must be closed")
+	}
+}
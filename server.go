@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -21,11 +22,21 @@ import (
 const (
 	ENDPOINT_HEADER_NAME               = "X-Kuiperbelt-Endpoint"
 	CALLBACK_CLIENT_MAX_CONNS_PER_HOST = 32
+	// SUBPROTOCOLS_HEADER_NAME has the subprotocols requested by the client in the connect callback.
+	SUBPROTOCOLS_HEADER_NAME = "X-Kuiperbelt-Subprotocols"
+	// SUBPROTOCOL_HEADER_NAME has the subprotocol chosen by the connect callback.
+	// It is also sent in the receive and close callbacks.
+	SUBPROTOCOL_HEADER_NAME = "X-Kuiperbelt-Subprotocol"
+
+	// reasons of inbound limit violations
+	inboundRateLimited = "rate_limit_exceeded"
+	inboundTooLarge    = "message_too_large"
 )
 
 var (
 	callbackClient          = new(http.Client)
 	callbackPersistentLimit = 10 * time.Second
+	closeWriteWait          = time.Second
 	defaultUpgrader         = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -45,37 +56,52 @@ type WebSocketServer struct {
 	upgrader websocket.Upgrader
 	timer    *time.Timer
 	receiver Receiver
+
+	// Directory records the sessions of this node in cluster mode. If nil, cluster mode is disabled.
+	Directory SessionDirectory
+
+	sessionLog *zap.Logger
+	taps       *tapHub
+	admission  *admission
+	// jwt authenticates connect requests locally. If nil, JWT authentication is disabled.
+	jwt *jwtAuthenticator
+	// connectCache caches decisions of the connect callback. If nil, the cache is disabled.
+	connectCache *connectCache
+	// events delivers messages and events of sessions to backend consumers. If nil, the event stream is disabled.
+	events *eventHub
+	// checkOrigin checks Origin header of connect requests by the origin policy in all transports.
+	checkOrigin func(r *http.Request) bool
+	// tracer records spans of callbacks and deliveries. If nil, tracing is disabled.
+	tracer *tracer
+}
+
+// connectInfo is information about the connect request of a session.
+type connectInfo struct {
+	RemoteAddr string
+	UserAgent  string
+	Origin     string
+	// TokenExpiresAt is the expiration time of JWT. Zero means no expiration.
+	TokenExpiresAt time.Time
+}
+
+func newConnectInfo(r *http.Request) connectInfo {
+	return connectInfo{
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Origin:     r.Header.Get("Origin"),
+	}
 }
 
 func NewWebSocketServer(c Config, s *Stats, p *SessionPool) *WebSocketServer {
 	upgrader := defaultUpgrader
-	switch c.OriginPolicy {
-	case "same_origin": // gorilla/websocket default checker is checking same origin.
-	case "same_hostname":
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			host := r.Host
-			hostname, _, err := net.SplitHostPort(host)
-			if err != nil {
-				Log.Error("cannot split host by request",
-					zap.Error(err),
-				)
-				return false
-			}
-			origin := r.Header.Get("Origin")
-			originURL, err := url.Parse(origin)
-			if err != nil {
-				Log.Error("cannot parse origin by request",
-					zap.Error(err),
-				)
-				return false
-			}
-			return hostname == originURL.Hostname()
-		}
-	case "none":
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			return true
-		}
+	upgrader.EnableCompression = c.Compression.Enabled
+	checkOrigin, err := newOriginChecker(c, s)
+	if err != nil {
+		Log.Fatal("failed parse config.OriginAllowlist",
+			zap.Error(err),
+		)
 	}
+	upgrader.CheckOrigin = checkOrigin
 
 	receiver := newDiscardReceiver()
 	if c.Callback.Receive != "" {
@@ -87,6 +113,29 @@ func NewWebSocketServer(c Config, s *Stats, p *SessionPool) *WebSocketServer {
 		}
 		receiver = newCallbackReceiver(callbackClient, u, c)
 	}
+	events := newEventHub(c, s)
+	if events != nil {
+		if c.Callback.Receive != "" {
+			// messages are passed to the receive callback while no consumer is connected.
+			events.fallback = receiver
+		}
+		receiver = events
+	}
+	trusted, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		Log.Fatal("failed parse config.TrustedProxies",
+			zap.Error(err),
+		)
+	}
+	var jwt *jwtAuthenticator
+	if c.JWT.Enabled {
+		jwt, err = newJWTAuthenticator(c.JWT)
+		if err != nil {
+			Log.Fatal("failed initialize jwt authentication",
+				zap.Error(err),
+			)
+		}
+	}
 
 	return &WebSocketServer{
 		Config:   c,
@@ -95,6 +144,16 @@ func NewWebSocketServer(c Config, s *Stats, p *SessionPool) *WebSocketServer {
 		upgrader: upgrader,
 		timer:    time.NewTimer(callbackPersistentLimit),
 		receiver: receiver,
+
+		checkOrigin: checkOrigin,
+
+		sessionLog: newSessionLogger(c.SessionLog),
+		taps:       newTapHub(),
+		admission:  newAdmission(c.ConnectionLimit, trusted),
+		jwt:        jwt,
+
+		connectCache: newConnectCache(c.ConnectCache),
+		events:       events,
 	}
 }
 
@@ -102,28 +161,56 @@ func NewWebSocketServer(c Config, s *Stats, p *SessionPool) *WebSocketServer {
 func (s *WebSocketServer) Handler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	release := s.admit(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+
 	s.Stats.ConnectEvent()
 	defer s.Stats.DisconnectEvent()
 
-	resp, err := s.ConnectCallbackHandler(w, r)
-	if err != nil {
-		if resErr, ok := err.(errCallbackResponseNotOK); ok && resErr == http.StatusForbidden {
-			Log.Info("authorization failed")
-			return
-		}
-		Log.Error("connect error before upgrade",
-			zap.Error(err),
+	// check origin before the connect callback as the other transports do.
+	// the upgrader checks it again, but rejected browsers never reach the callback.
+	if !s.checkOrigin(r) {
+		Log.Info("connect request origin is not allowed",
+			zap.String("origin", r.Header.Get("Origin")),
+			zap.String("transport", "websocket"),
 		)
 		s.Stats.ConnectErrorEvent()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	resp, info, sc, ok := s.accept(w, r)
+	if !ok {
 		return
 	}
 
-	wsHandler, err := s.NewWebSocketHandler(resp)
+	var upgradeHeader http.Header
+	if protocol := resp.Header.Get(SUBPROTOCOL_HEADER_NAME); protocol != "" {
+		if !hasSubprotocol(websocket.Subprotocols(r), protocol) {
+			resp.Body.Close()
+			Log.Error("subprotocol chosen by connect callback is not requested",
+				zap.String("subprotocol", protocol),
+			)
+			s.Stats.ConnectErrorEvent()
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		upgradeHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+
+	wsHandler, err := s.newWebSocketHandler(resp, info, sc)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if s.upgrader.EnableCompression && offersDeflate(r.Header) {
+		// measure the bytes on the wire for the compression ratio.
+		w = countingHijacker{w}
+	}
+	conn, err := s.upgrader.Upgrade(w, r, upgradeHeader)
 	if err != nil {
 		Log.Error("cannot upgrade",
 			zap.Error(err),
@@ -134,7 +221,9 @@ func (s *WebSocketServer) Handler(w http.ResponseWriter, r *http.Request) {
 
 	if s.Config.Callback.Establish != "" {
 		key := resp.Header.Get(s.Config.SessionHeader)
-		err = s.EstablishCallbackHandler(key)
+		// the establish callback belongs to the trace of the connect callback.
+		parent, _ := parseTraceContext(resp.Request.Header)
+		err = s.establishCallback(key, parseMetadata(resp.Header), parent)
 		if err != nil {
 			Log.Error("establish error after upgrade",
 				zap.Error(err),
@@ -148,6 +237,91 @@ func (s *WebSocketServer) Handler(w http.ResponseWriter, r *http.Request) {
 	wsHandler(conn)
 }
 
+// admit runs the admission control of a connect request.
+// It responds 503 and returns nil if the request is rejected. Otherwise, it returns the function to release the admission.
+func (s *WebSocketServer) admit(w http.ResponseWriter, r *http.Request) func() {
+	ip := clientIP(r, s.admission.trustedProxies)
+	release, retryAfter, reason := s.admission.admit(ip, time.Now())
+	if release == nil {
+		s.Stats.ConnectRejectEvent()
+		Log.Info("connect rejected",
+			zap.String("reason", reason),
+			zap.String("remote_addr", ip),
+		)
+		rejectConnect(w, retryAfter)
+		return nil
+	}
+	return release
+}
+
+// accept authenticates a connect request by JWT and the connect callback, and resolves the configuration of the session.
+// It responds the error and reports false if the request is not accepted.
+func (s *WebSocketServer) accept(w http.ResponseWriter, r *http.Request) (*http.Response, connectInfo, sessionConfig, bool) {
+	var identity *jwtIdentity
+	if s.jwt != nil {
+		id, err := s.jwt.authenticate(r, time.Now())
+		if err != nil {
+			Log.Info("jwt authentication failed",
+				zap.Error(err),
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil, connectInfo{}, sessionConfig{}, false
+		}
+		identity = &id
+	}
+
+	var resp *http.Response
+	if identity != nil && s.Config.JWT.SkipConnectCallback {
+		resp = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    r,
+		}
+	} else {
+		var err error
+		resp, err = s.ConnectCallbackHandler(w, r)
+		if err != nil {
+			if resErr, ok := err.(errCallbackResponseNotOK); ok && resErr == http.StatusForbidden {
+				Log.Info("authorization failed")
+				return nil, connectInfo{}, sessionConfig{}, false
+			}
+			Log.Error("connect error before upgrade",
+				zap.Error(err),
+			)
+			s.Stats.ConnectErrorEvent()
+			return nil, connectInfo{}, sessionConfig{}, false
+		}
+	}
+	if identity != nil {
+		// the connect callback response takes precedence over the claims.
+		identity.setHeader(resp.Header, s.Config.SessionHeader)
+	}
+
+	sc, err := newSessionConfig(s.Config).override(resp.Header)
+	if err != nil {
+		resp.Body.Close()
+		Log.Error("invalid session overrides by connect callback",
+			zap.Error(err),
+		)
+		s.Stats.ConnectErrorEvent()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return nil, connectInfo{}, sessionConfig{}, false
+	}
+
+	info := newConnectInfo(r)
+	if identity != nil {
+		info.TokenExpiresAt = identity.ExpiresAt
+	}
+	s.sessionLog.Info("session connect",
+		zap.String("session", resp.Header.Get(s.Config.SessionHeader)),
+		zap.String("remote_addr", info.RemoteAddr),
+		zap.String("user_agent", info.UserAgent),
+	)
+	return resp, info, sc, true
+}
+
 func (s *WebSocketServer) Register() {
 	callbackClient.Transport = &http.Transport{
 		MaxIdleConnsPerHost: CALLBACK_CLIENT_MAX_CONNS_PER_HOST,
@@ -155,6 +329,19 @@ func (s *WebSocketServer) Register() {
 	}
 	http.HandleFunc(s.Config.Path.Connect, s.Handler)
 	http.HandleFunc(s.Config.Path.Stats, s.StatsHandler)
+	http.HandleFunc(s.Config.Path.Metrics, s.MetricsHandler)
+	http.HandleFunc(s.Config.Path.Tap, s.TapHandler)
+	http.HandleFunc(s.Config.Path.Session, s.SessionHandler)
+	if s.Config.SSE.Enabled {
+		http.HandleFunc(s.Config.Path.SSE, s.SSEHandler)
+		http.HandleFunc(s.Config.Path.SSEMessage, s.SSEMessageHandler)
+	}
+	if s.Config.LongPolling.Enabled {
+		http.HandleFunc(s.Config.Path.Poll, s.PollHandler)
+	}
+	if s.events != nil {
+		http.HandleFunc(s.Config.Path.Events, s.EventsHandler)
+	}
 }
 
 func (s *WebSocketServer) StatsHandler(w http.ResponseWriter, r *http.Request) {
@@ -174,7 +361,36 @@ func (s *WebSocketServer) StatsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// MetricsHandler handles GET /metrics request in the Prometheus text format.
+func (s *WebSocketServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.Stats.DumpPrometheus(w); err != nil {
+		Log.Error("metrics dump failed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
 func (s *WebSocketServer) ConnectCallbackHandler(w http.ResponseWriter, r *http.Request) (*http.Response, error) {
+	var cacheKey string
+	if s.connectCache != nil {
+		cacheKey = s.connectCache.key(r)
+	}
+	if cacheKey != "" {
+		d, ok := s.connectCache.get(cacheKey, time.Now())
+		s.Stats.ConnectCacheEvent(ok)
+		if ok {
+			resp := d.response(r)
+			if resp.StatusCode != http.StatusOK {
+				// replay the response of the callback as a miss.
+				w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+				w.WriteHeader(resp.StatusCode)
+				io.Copy(w, resp.Body)
+				return nil, errCallbackResponseNotOK(resp.StatusCode)
+			}
+			return resp, nil
+		}
+	}
+
 	callback, err := url.ParseRequestURI(s.Config.Callback.Connect)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -208,6 +424,9 @@ func (s *WebSocketServer) ConnectCallbackHandler(w http.ResponseWriter, r *http.
 	}
 
 	callbackRequest.Header.Add(ENDPOINT_HEADER_NAME, s.Config.Endpoint)
+	if protocols := websocket.Subprotocols(r); len(protocols) > 0 {
+		callbackRequest.Header.Set(SUBPROTOCOLS_HEADER_NAME, strings.Join(protocols, ", "))
+	}
 	callbackRequest.Close = s.shouldDisconnectCallbackRequest()
 
 	// set callback timeout
@@ -216,12 +435,26 @@ func (s *WebSocketServer) ConnectCallbackHandler(w http.ResponseWriter, r *http.
 		defer cancel()
 		callbackRequest = callbackRequest.WithContext(ctx)
 	}
+	parent, _ := parseTraceContext(r.Header)
+	span := s.tracer.StartSpan("callback connect", spanKindClient, parent)
+	defer span.End()
+	span.SetAttribute("http.url", callback.String())
+	span.ctx.inject(callbackRequest.Header)
+
+	start := time.Now()
 	resp, err := callbackClient.Do(callbackRequest)
 	if err != nil {
+		s.Stats.CallbackEvent("connect", 0, time.Since(start))
+		span.SetError(err)
 		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		return nil, err
 	}
+	s.Stats.CallbackEvent("connect", resp.StatusCode, time.Since(start))
+	span.SetStatusCode(resp.StatusCode)
 
+	if cacheKey != "" && (resp.StatusCode != http.StatusOK || resp.Header.Get(s.Config.SessionHeader) != "") {
+		s.connectCache.store(cacheKey, resp, s.Config.SessionHeader, time.Now())
+	}
 	if resp.StatusCode != http.StatusOK {
 		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
 		w.WriteHeader(resp.StatusCode)
@@ -240,12 +473,17 @@ func (s *WebSocketServer) ConnectCallbackHandler(w http.ResponseWriter, r *http.
 }
 
 func (s *WebSocketServer) EstablishCallbackHandler(key string) error {
+	return s.establishCallback(key, nil, traceContext{})
+}
+
+func (s *WebSocketServer) establishCallback(key string, metadata sessionMetadata, parent traceContext) error {
 	req, err := http.NewRequest("POST", s.Config.Callback.Establish, nil)
 	if err != nil {
 		return errors.Wrap(err, "cannot create establish callback request")
 	}
 
 	req.Header.Add(s.Config.SessionHeader, key)
+	metadata.setHeader(req.Header)
 	for name, value := range s.Config.ProxySetHeader {
 		if value == "" {
 			req.Header.Del(name)
@@ -263,11 +501,21 @@ func (s *WebSocketServer) EstablishCallbackHandler(key string) error {
 		defer cancel()
 		req = req.WithContext(ctx)
 	}
+	span := s.tracer.StartSpan("callback establish", spanKindClient, parent)
+	defer span.End()
+	span.SetAttribute("kuiperbelt.session", key)
+	span.ctx.inject(req.Header)
+
+	start := time.Now()
 	resp, err := callbackClient.Do(req)
 	if err != nil {
+		s.Stats.CallbackEvent("establish", 0, time.Since(start))
+		span.SetError(err)
 		return errors.Wrap(err, "failed post establish callback request")
 	}
 	defer resp.Body.Close()
+	s.Stats.CallbackEvent("establish", resp.StatusCode, time.Since(start))
+	span.SetStatusCode(resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
 		err := errCallbackResponseNotOK(resp.StatusCode)
 		return errors.Wrap(err, "unsuccessful post establish callback request")
@@ -277,8 +525,19 @@ func (s *WebSocketServer) EstablishCallbackHandler(key string) error {
 }
 
 func (s *WebSocketServer) NewWebSocketHandler(resp *http.Response) (func(ws *websocket.Conn), error) {
+	sc, err := newSessionConfig(s.Config).override(resp.Header)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return s.newWebSocketHandler(resp, connectInfo{}, sc)
+}
+
+func (s *WebSocketServer) newWebSocketHandler(resp *http.Response, info connectInfo, sc sessionConfig) (func(ws *websocket.Conn), error) {
 	defer resp.Body.Close()
 	key := resp.Header.Get(s.Config.SessionHeader)
+	metadata := parseMetadata(resp.Header)
+	channels := parseChannels(resp.Header)
 	var b bytes.Buffer
 	if _, err := b.ReadFrom(resp.Body); err != nil {
 		return nil, err
@@ -290,14 +549,22 @@ func (s *WebSocketServer) NewWebSocketHandler(resp *http.Response) (func(ws *web
 	}
 	return func(ws *websocket.Conn) {
 		// register a new websocket sesssion.
-		session, err := s.NewWebSocketSession(key, ws)
+		session, err := s.newWebSocketSession(key, ws, sc)
 		if err != nil {
 			Log.Error("connect error after upgrade", zap.Error(err))
 			s.Stats.ConnectErrorEvent()
 			return
 		}
-		s.Pool.Add(session)
-		defer s.Pool.Delete(session.Key())
+		session.info = info
+		session.metadata = metadata
+		session.channels = channels
+		s.addSession(session)
+		defer s.deleteSession(session.Key())
+		s.sessionLog.Info("session establish",
+			zap.String("session", key),
+			zap.String("remote_addr", info.RemoteAddr),
+			zap.String("user_agent", info.UserAgent),
+		)
 
 		defaultPingHandler := ws.PingHandler()
 		// Whern receive Ping, stretch idle deadline and do default ping handler
@@ -307,6 +574,7 @@ func (s *WebSocketServer) NewWebSocketHandler(resp *http.Response) (func(ws *web
 		})
 		ws.SetPongHandler(func(message string) error {
 			session.setIdleTimeout()
+			session.receivePong(message)
 			return nil
 		})
 
@@ -324,20 +592,65 @@ func (s *WebSocketServer) NewWebSocketHandler(resp *http.Response) (func(ws *web
 }
 
 func (s *WebSocketServer) NewWebSocketSession(key string, ws *websocket.Conn) (*WebSocketSession, error) {
-	send := make(chan Message, s.Config.SendQueueSize)
+	return s.newWebSocketSession(key, ws, newSessionConfig(s.Config))
+}
+
+func (s *WebSocketServer) newWebSocketSession(key string, ws *websocket.Conn, sc sessionConfig) (*WebSocketSession, error) {
 	session := &WebSocketSession{
-		ws:       ws,
-		key:      key,
-		server:   s,
-		send:     send,
-		closedch: make(chan struct{}),
+		baseSession: s.newBaseSession(key, "websocket", sc),
+		ws:          ws,
+		inbound:     newTokenBucket(sc.InboundLimit.Rate, sc.InboundLimit.Burst),
+		pong:        make(chan struct{}, 1),
+	}
+	session.subprotocol = ws.Subprotocol()
+	if s.Config.Compression.Enabled {
+		if err := ws.SetCompressionLevel(s.Config.Compression.Level); err != nil {
+			return nil, err
+		}
+		session.wire, _ = ws.UnderlyingConn().(*countingConn)
+	}
+	if max := sc.InboundLimit.MaxMessageSize; max > 0 && sc.InboundLimit.Policy == "close" {
+		// gorilla/websocket closes the connection with 1009 over the limit.
+		ws.SetReadLimit(max)
 	}
 
 	return session, nil
 }
 
+// addSession adds the session into the pool and the directory.
+func (s *WebSocketServer) addSession(session Session) {
+	s.Pool.Add(session)
+	if i, ok := session.(inspector); ok && s.events != nil {
+		info := i.inspect()
+		s.events.publish(&streamEvent{Type: "connect", Session: session.Key(), Info: &info})
+	}
+	if s.Directory == nil {
+		return
+	}
+	if err := s.Directory.Register(context.Background(), session.Key(), s.Config.Endpoint); err != nil {
+		Log.Error("failed register session to directory",
+			zap.Error(err),
+			zap.String("session", session.Key()),
+		)
+	}
+}
+
+// deleteSession deletes the session from the pool and the directory.
+func (s *WebSocketServer) deleteSession(key string) {
+	s.Pool.Delete(key)
+	if s.Directory == nil {
+		return
+	}
+	if err := s.Directory.Unregister(context.Background(), key, s.Config.Endpoint); err != nil {
+		Log.Error("failed unregister session from directory",
+			zap.Error(err),
+			zap.String("session", key),
+		)
+	}
+}
+
 func (s *WebSocketServer) Shutdown(ctx context.Context) error {
-	msg := Message{LastWord: true}
+	msg := Message{LastWord: true, CloseCode: websocket.CloseGoingAway}
 	sessions := s.Pool.List()
 	for _, s := range sessions {
 		q := s.Send()
@@ -376,119 +689,104 @@ func (s *WebSocketServer) shouldDisconnectCallbackRequest() bool {
 }
 
 type WebSocketSession struct {
-	ws       *websocket.Conn
-	key      string
-	server   *WebSocketServer
-	send     chan Message
-	closed   uint32 // accessed atomically
-	closedch chan struct{}
-}
-
-// Key returns the session key.
-func (s *WebSocketSession) Key() string {
-	return s.key
-}
-
-// Send returns the channel for sending messages.
-func (s *WebSocketSession) Send() chan<- Message {
-	if atomic.LoadUint32(&s.closed) != 0 {
-		return nil
-	}
-	return s.send
+	baseSession
+	ws      *websocket.Conn
+	inbound *tokenBucket
+	// wire is the connection of the session negotiated compression. Otherwise nil.
+	wire *countingConn
+	// pong notifies the writer goroutine of receiving a pong.
+	pong chan struct{}
 }
 
 // Close closes the session.
 func (s *WebSocketSession) Close() error {
-	if atomic.SwapUint32(&s.closed, 1) != 0 {
+	if !s.close(true) {
 		return nil
 	}
-	s.server.Pool.Delete(s.key)
-	close(s.closedch)
-	if s.server.Config.Callback.Close != "" {
-		s.server.Stats.ClosingEvent()
-		go s.sendCloseCallback()
-	}
 	return s.ws.Close()
 }
 
 // CloseWithNoCallback closes the session but does not fire callback.
 func (s *WebSocketSession) CloseWithNoCallback() error {
-	if atomic.SwapUint32(&s.closed, 1) != 0 {
+	if !s.close(false) {
 		return nil
 	}
-	s.server.Pool.Delete(s.key)
-	close(s.closedch)
 	return s.ws.Close()
 }
 
-func (s *WebSocketSession) Closed() <-chan struct{} {
-	return s.closedch
-}
-
-func (s *WebSocketSession) sendCloseCallback() {
-	defer s.server.Stats.ClosedEvent()
-	req, err := http.NewRequest("POST", s.server.Config.Callback.Close, nil)
-	if err != nil {
-		Log.Error("cannot create close callback request.",
-			zap.Error(err),
-			zap.String("session", s.Key()),
-		)
-		return
-	}
-
-	req.Header.Add(s.server.Config.SessionHeader, s.Key())
-	for name, value := range s.server.Config.ProxySetHeader {
-		if value == "" {
-			req.Header.Del(name)
-		} else {
-			req.Header.Set(name, value)
-		}
-	}
-	req.Close = s.server.shouldDisconnectCallbackRequest()
-	resp, err := callbackClient.Do(req)
-	if err != nil {
-		Log.Error("failed send close callback request.",
-			zap.Error(err),
-			zap.String("session", s.Key()),
-		)
-		return
-	}
-	defer resp.Body.Close()
-
-	buf, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		Log.Error("invalid close callback status.",
-			zap.String("session", s.Key()),
-			zap.String("status", resp.Status),
-			zap.String("error", err.Error()),
-		)
-		return
+func (s *WebSocketSession) sendMessages() {
+	var ping <-chan time.Time
+	if interval := s.server.Config.PingInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ping = ticker.C
 	}
-	if resp.StatusCode != http.StatusOK {
-		Log.Error("invalid close callback status.",
-			zap.String("session", s.Key()),
-			zap.String("status", resp.Status),
-			zap.String("error", string(buf)),
-		)
-		return
+	pongTimer := time.NewTimer(0)
+	pongTimer.Stop()
+	defer pongTimer.Stop()
+	var pongTimeout <-chan time.Time
+	var expiry <-chan time.Time
+	if exp := s.info.TokenExpiresAt; !exp.IsZero() {
+		expiryTimer := time.NewTimer(time.Until(exp))
+		defer expiryTimer.Stop()
+		expiry = expiryTimer.C
 	}
 
-	Log.Info("success close callback.",
-		zap.String("session", s.Key()),
-	)
-}
-
-func (s *WebSocketSession) sendMessages() {
 	for {
 		s.setIdleTimeout()
 		select {
+		case <-ping:
+			if err := s.writePing(); err != nil {
+				s.setCloseReason("error", 0, "")
+				s.Close()
+				return
+			}
+			if pongTimeout == nil {
+				pongTimer.Reset(s.server.Config.PongTimeout)
+				pongTimeout = pongTimer.C
+			}
+		case <-s.pong:
+			if pongTimeout != nil && !pongTimer.Stop() {
+				<-pongTimer.C
+			}
+			pongTimeout = nil
+		case <-pongTimeout:
+			// the peer is dead or the network is half-open.
+			s.server.Stats.PongTimeoutEvent()
+			s.server.sessionLog.Info("session pong timeout",
+				zap.String("session", s.Key()),
+				zap.String("remote_addr", s.info.RemoteAddr),
+				zap.Duration("duration", time.Since(s.connectedAt)),
+			)
+			s.setCloseReason("idle", 0, "")
+			s.Close()
+			return
+		case <-expiry:
+			expiry = nil
+			if s.tokenExpired() {
+				return
+			}
 		case msg := <-s.send:
 			if err := s.writeMessage(msg); err != nil {
 				s.server.Stats.MessageErrorEvent()
+				if isTimeout(err) {
+					s.setCloseReason("idle", 0, "")
+				} else {
+					s.setCloseReason("error", 0, "")
+				}
 				s.Close()
 				return
 			}
 			if msg.LastWord {
+				code := msg.CloseCode
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				s.setCloseReason("server", code, msg.CloseReason)
+				s.ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(code, msg.CloseReason),
+					time.Now().Add(closeWriteWait),
+				)
 				if msg.FromPostClose {
 					s.CloseWithNoCallback()
 				} else {
@@ -506,7 +804,25 @@ func (s *WebSocketSession) recvMessages() {
 	defer s.Close()
 	for {
 		msgType, r, err := s.ws.NextReader()
+		if err == websocket.ErrReadLimit {
+			s.readLimitExceeded()
+			return
+		}
 		if err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				s.setCloseReason("client", ce.Code, ce.Text)
+			} else if isTimeout(err) {
+				if atomic.LoadUint32(&s.closed) == 0 {
+					s.server.sessionLog.Info("session idle timeout",
+						zap.String("session", s.Key()),
+						zap.String("remote_addr", s.info.RemoteAddr),
+						zap.Duration("duration", time.Since(s.connectedAt)),
+					)
+				}
+				s.setCloseReason("idle", 0, "")
+			} else {
+				s.setCloseReason("client", websocket.CloseAbnormalClosure, "")
+			}
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway,
 				websocket.CloseNormalClosure,
@@ -530,18 +846,36 @@ func (s *WebSocketSession) recvMessages() {
 			ctx, cancel = context.WithTimeout(ctx, timeout)
 			defer cancel()
 		}
-		h := http.Header{
-			s.server.Config.SessionHeader: {s.Key()},
-		}
-		m := newReceivedMessage(msgType, h, r)
-		err = s.server.receiver.Receive(ctx, m)
-		if err != nil {
-			Log.Error(
-				"receive callback failed",
-				zap.Error(err),
-			)
+		if !s.inbound.Allow() {
+			io.Copy(ioutil.Discard, r)
+			if s.inboundViolation(inboundRateLimited, websocket.ClosePolicyViolation) {
+				return
+			}
 			continue
 		}
+		if max := s.config.InboundLimit.MaxMessageSize; max > 0 {
+			b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+			if err == websocket.ErrReadLimit {
+				s.readLimitExceeded()
+				return
+			}
+			if err == nil && int64(len(b)) > max {
+				io.Copy(ioutil.Discard, r)
+				if s.inboundViolation(inboundTooLarge, websocket.CloseMessageTooBig) {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				Log.Error("cannot read message", zap.Error(err))
+				break
+			}
+			r = bytes.NewReader(b)
+		}
+		if err := s.receive(ctx, msgType, r); err != nil {
+			Log.Error("cannot read message", zap.Error(err))
+			break
+		}
 	}
 
 	// ignore closed session error
@@ -552,20 +886,143 @@ func (s *WebSocketSession) recvMessages() {
 	Log.Error("watch close frame error")
 }
 
+// tokenExpired handles the expiration of JWT by jwt.expiry. It reports whether the session is closed.
+func (s *WebSocketSession) tokenExpired() bool {
+	policy := s.server.Config.JWT.Expiry
+	s.server.sessionLog.Info("session token expired",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.String("policy", policy),
+	)
+	if policy == "warn" {
+		err := s.writeMessage(Message{
+			Body:        []byte(`{"error":"token_expired"}`),
+			ContentType: "application/json",
+			Session:     s.Key(),
+		})
+		if err != nil {
+			s.setCloseReason("error", 0, "")
+			s.Close()
+			return true
+		}
+		return false
+	}
+	s.setCloseReason("server", websocket.ClosePolicyViolation, "token_expired")
+	s.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token_expired"),
+		time.Now().Add(closeWriteWait),
+	)
+	s.Close()
+	return true
+}
+
+// writePing sends a ping with the current time to measure the round-trip time.
+func (s *WebSocketSession) writePing() error {
+	now := time.Now()
+	payload := strconv.FormatInt(now.UnixNano(), 10)
+	return s.ws.WriteControl(websocket.PingMessage, []byte(payload), now.Add(s.server.Config.PongTimeout))
+}
+
+// receivePong records the round-trip time of the ping and notifies the writer goroutine.
+func (s *WebSocketSession) receivePong(message string) {
+	if sent, err := strconv.ParseInt(message, 10, 64); err == nil {
+		// pongs not for our pings are ignored.
+		rtt := time.Since(time.Unix(0, sent))
+		atomic.StoreInt64(&s.rtt, int64(rtt))
+		s.server.Stats.PingEvent(rtt)
+	}
+	select {
+	case s.pong <- struct{}{}:
+	default:
+	}
+}
+
+// RTT returns the last round-trip time of the ping. 0 means not measured.
+func (s *WebSocketSession) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// inboundViolation handles a message from the client over the inbound limits by the policy.
+// It reports whether the session is closed.
+func (s *WebSocketSession) inboundViolation(reason string, code int) bool {
+	s.recordInboundViolation(reason)
+	switch s.config.InboundLimit.Policy {
+	case "notify":
+		message := Message{
+			Body:        []byte(`{"error":"` + reason + `"}`),
+			ContentType: "application/json",
+			Session:     s.Key(),
+		}
+		select {
+		case s.send <- message:
+		default:
+			// the send queue is full. the notification is dropped.
+		}
+	case "close":
+		s.setCloseReason("server", code, reason)
+		s.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(closeWriteWait),
+		)
+		return true
+	}
+	return false
+}
+
+// readLimitExceeded handles a message over the read limit of the connection.
+// gorilla/websocket has already sent the close frame of 1009, so it does not write another one.
+func (s *WebSocketSession) readLimitExceeded() {
+	s.recordInboundViolation(inboundTooLarge)
+	s.setCloseReason("server", websocket.CloseMessageTooBig, inboundTooLarge)
+}
+
+// recordInboundViolation counts and logs the violation of the inbound limit.
+func (s *WebSocketSession) recordInboundViolation(reason string) {
+	s.server.Stats.InboundViolationEvent(reason)
+	s.server.sessionLog.Warn("session inbound limit exceeded",
+		zap.String("session", s.Key()),
+		zap.String("remote_addr", s.info.RemoteAddr),
+		zap.String("reason", reason),
+		zap.String("policy", s.config.InboundLimit.Policy),
+	)
+}
+
 func (s *WebSocketSession) writeMessage(message Message) error {
 	bs, messageType, err := messageMarshal(message)
 	if err != nil {
 		return err
 	}
-	err = s.ws.WriteMessage(messageType, bs)
+	if message.TraceParent != "" {
+		span := s.server.tracer.StartSpan("deliver", spanKindProducer, message.traceContext())
+		defer span.End()
+		span.SetAttribute("kuiperbelt.session", s.Key())
+		span.SetAttribute("messaging.message_payload_size_bytes", len(bs))
+		defer func() {
+			span.SetError(err)
+		}()
+	}
+	var written int64
+	if s.wire != nil {
+		s.ws.EnableWriteCompression(len(bs) >= s.server.Config.Compression.Threshold)
+		written = s.wire.Written()
+	}
+	if message.prepared != nil {
+		err = s.ws.WritePreparedMessage(message.prepared)
+	} else {
+		err = s.ws.WriteMessage(messageType, bs)
+	}
 	if err != nil {
 		return err
 	}
+	if s.wire != nil {
+		s.server.Stats.CompressionEvent(len(bs), s.wire.Written()-written)
+	}
+	s.sent(messageType, message.ContentType, bs)
 	return nil
 }
 
 func (s *WebSocketSession) setIdleTimeout() error {
-	it := s.server.Config.IdleTimeout
+	it := s.config.IdleTimeout
 	if it == 0 {
 		return nil
 	}
@@ -577,6 +1034,43 @@ func (s *WebSocketSession) setIdleTimeout() error {
 	return s.ws.UnderlyingConn().SetDeadline(deadline)
 }
 
+func hasSubprotocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout reports whether err is caused by a deadline of the connection.
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
+// callbackStatus returns the status code of the callback response that caused err.
+func callbackStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if code, ok := errors.Cause(err).(errCallbackResponseNotOK); ok {
+		return int(code)
+	}
+	return 0
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
 func messageMarshal(v interface{}) ([]byte, int, error) {
 	message, ok := v.(Message)
 	if !ok {
@@ -2,8 +2,10 @@ package kuiperbelt
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -12,6 +14,9 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const (
@@ -24,6 +29,7 @@ type testSuccessConnectCallbackServer struct {
 	mu           sync.Mutex
 	isCallbacked bool
 	isClosed     bool
+	closeBody    []byte
 	header       http.Header
 }
 
@@ -39,6 +45,12 @@ func (s *testSuccessConnectCallbackServer) IsClosed() bool {
 	return s.isClosed
 }
 
+func (s *testSuccessConnectCallbackServer) CloseBody() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeBody
+}
+
 func (s *testSuccessConnectCallbackServer) Header() http.Header {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -89,9 +101,11 @@ func (s *testSuccessConnectCallbackServer) FailHandler(w http.ResponseWriter, r
 }
 
 func (s *testSuccessConnectCallbackServer) CloseHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
 	s.mu.Lock()
 	s.isClosed = true
 	s.header = r.Header
+	s.closeBody = body
 	s.mu.Unlock()
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "")
@@ -509,3 +523,389 @@ func TestWebSocketSession__Handler__FailEstablished(t *testing.T) {
 		t.Fatal("shouldn't save session error:", err)
 	}
 }
+
+func TestWebSocketSession__SessionLog(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	core, logs := observer.New(zapcore.InfoLevel)
+	server.sessionLog = zap.New(core)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+
+	dialer := websocket.Dialer{}
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	conn, _, err := dialer.Dial(wsURL, http.Header{
+		testRequestSessionHeader: []string{"hogehoge"},
+		"User-Agent":             []string{"kuiperbelt-test"},
+	})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	conn.ReadMessage() // pull and drop initial message
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte("barbar"))
+	if err != nil {
+		t.Fatal("cannot write to connection error:", err)
+	}
+	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatal("cannot write close message error:", err)
+	}
+
+	var entries []observer.LoggedEntry
+	for i := 0; i < 50; i++ {
+		entries = logs.FilterMessage("session close").All()
+		if len(entries) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected session close events: %d", len(entries))
+	}
+	if logs.FilterMessage("session connect").Len() != 1 || logs.FilterMessage("session establish").Len() != 1 {
+		t.Error("connect or establish event is not logged")
+	}
+
+	fields := entries[0].ContextMap()
+	expects := map[string]interface{}{
+		"session":           "hogehoge",
+		"user_agent":        "kuiperbelt-test",
+		"sent_messages":     int64(1),
+		"sent_bytes":        int64(len(testHelloMessage)),
+		"received_messages": int64(1),
+		"received_bytes":    int64(len("barbar")),
+		"close_code":        int64(websocket.CloseNormalClosure),
+		"close_initiator":   "client",
+	}
+	for key, expect := range expects {
+		if fields[key] != expect {
+			t.Errorf("unexpected %s field: got %#v, expected %#v", key, fields[key], expect)
+		}
+	}
+}
+
+func TestWebSocketSession__InboundLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     InboundLimit
+		messages  []string
+		reply     string
+		closeCode int
+		rate      int64
+		size      int64
+	}{
+		{
+			name:     "drop over rate",
+			limit:    InboundLimit{Rate: 0.01, Burst: 1, Policy: "drop"},
+			messages: []string{"foo", "bar"},
+			rate:     1,
+		},
+		{
+			name:     "notify over size",
+			limit:    InboundLimit{MaxMessageSize: 4, Policy: "notify"},
+			messages: []string{"foo", "toolarge"},
+			reply:    `{"error":"message_too_large"}`,
+			size:     1,
+		},
+		{
+			name:      "close over rate",
+			limit:     InboundLimit{Rate: 0.01, Burst: 1, Policy: "close"},
+			messages:  []string{"foo", "bar"},
+			closeCode: websocket.ClosePolicyViolation,
+			rate:      1,
+		},
+		{
+			name:      "close over size",
+			limit:     InboundLimit{MaxMessageSize: 4, Policy: "close"},
+			messages:  []string{"foo", "toolarge"},
+			closeCode: websocket.CloseMessageTooBig,
+			size:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pool SessionPool
+			callbackServer := new(testSuccessConnectCallbackServer)
+			tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+			defer tcc.Close()
+
+			c := TestConfig
+			c.Callback.Connect = tcc.URL
+			c.InboundLimit = tt.limit
+			st := NewStats()
+			server := NewWebSocketServer(c, st, &pool)
+			tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+			defer tc.Close()
+
+			wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+				testRequestSessionHeader: []string{"hogehoge"},
+			})
+			if err != nil {
+				t.Fatal("cannot connect error:", err)
+			}
+			defer conn.Close()
+			conn.ReadMessage() // pull and drop initial message
+
+			for _, m := range tt.messages {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+					t.Fatal("cannot write to connection error:", err)
+				}
+			}
+
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, reply, err := conn.ReadMessage()
+			switch {
+			case tt.closeCode != 0:
+				if !websocket.IsCloseError(err, tt.closeCode) {
+					t.Errorf("unexpected close: %s", err)
+				}
+			case tt.reply != "":
+				if string(reply) != tt.reply {
+					t.Errorf("unexpected reply: %s %s", reply, err)
+				}
+			default:
+				if !isTimeout(err) {
+					t.Errorf("unexpected reply: %s %s", reply, err)
+				}
+			}
+
+			if st.InboundRateLimited() != tt.rate || st.InboundTooLarge() != tt.size {
+				t.Errorf("unexpected violations: rate=%d size=%d", st.InboundRateLimited(), st.InboundTooLarge())
+			}
+		})
+	}
+}
+
+func TestWebSocketServer__Handler__Subprotocol(t *testing.T) {
+	var mu sync.Mutex
+	headers := map[string]http.Header{}
+	callback := func(name string, chosen string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			headers[name] = r.Header
+			mu.Unlock()
+			if name == "connect" {
+				w.Header().Set(TestConfig.SessionHeader, "hogehoge")
+				w.Header().Set(SUBPROTOCOL_HEADER_NAME, chosen)
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	header := func(name, key string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return headers[name].Get(key)
+	}
+
+	tests := []struct {
+		name   string
+		chosen string
+		expect string
+		status int
+	}{
+		{name: "chosen", chosen: "v2.kuiperbelt", expect: "v2.kuiperbelt"},
+		{name: "not chosen", chosen: "", expect: ""},
+		{name: "not requested", chosen: "v3.kuiperbelt", status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			headers = map[string]http.Header{}
+			mu.Unlock()
+			var pool SessionPool
+			tccConnect := httptest.NewServer(callback("connect", tt.chosen))
+			defer tccConnect.Close()
+			tccReceive := httptest.NewServer(callback("receive", ""))
+			defer tccReceive.Close()
+			tccClose := httptest.NewServer(callback("close", ""))
+			defer tccClose.Close()
+
+			c := TestConfig
+			c.Callback.Connect = tccConnect.URL
+			c.Callback.Receive = tccReceive.URL
+			c.Callback.Close = tccClose.URL
+			server := NewWebSocketServer(c, NewStats(), &pool)
+			tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+			defer tc.Close()
+
+			dialer := websocket.Dialer{Subprotocols: []string{"v1.kuiperbelt", "v2.kuiperbelt"}}
+			wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+			conn, resp, err := dialer.Dial(wsURL, nil)
+			if got := header("connect", SUBPROTOCOLS_HEADER_NAME); got != "v1.kuiperbelt, v2.kuiperbelt" {
+				t.Errorf("requested subprotocols are not forwarded: %q", got)
+			}
+			if tt.status != 0 {
+				if err == nil || resp == nil || resp.StatusCode != tt.status {
+					t.Errorf("unexpected response: %v %v", resp, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("cannot connect error:", err)
+			}
+			if conn.Subprotocol() != tt.expect {
+				t.Errorf("unexpected subprotocol: %q", conn.Subprotocol())
+			}
+
+			conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+			for i := 0; i < 50 && header("receive", TestConfig.SessionHeader) == ""; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := header("receive", SUBPROTOCOL_HEADER_NAME); got != tt.expect {
+				t.Errorf("unexpected subprotocol in receive callback: %q", got)
+			}
+
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+			for i := 0; i < 50 && header("close", TestConfig.SessionHeader) == ""; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := header("close", SUBPROTOCOL_HEADER_NAME); got != tt.expect {
+				t.Errorf("unexpected subprotocol in close callback: %q", got)
+			}
+		})
+	}
+}
+
+func TestWebSocketSession__PongTimeout(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.PingInterval = 20 * time.Millisecond
+	c.PongTimeout = 50 * time.Millisecond
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		testRequestSessionHeader: []string{"hogehoge"},
+	})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer conn.Close()
+	// the client does not read, so it never responds pongs.
+
+	for i := 0; i < 50 && st.PongTimeouts() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.PongTimeouts() != 1 {
+		t.Fatalf("unexpected pong timeouts: %d", st.PongTimeouts())
+	}
+	if _, err := pool.Get("hogehoge"); err != errSessionNotFound {
+		t.Error("dead session is not removed from the pool")
+	}
+}
+
+func TestWebSocketSession__CloseCallbackTimeout(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc1 := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc1.Close()
+	called := make(chan struct{}, 1)
+	tcc2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer tcc2.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc1.URL
+	c.Callback.Close = tcc2.URL
+	c.Callback.Timeout = 50 * time.Millisecond
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{testRequestSessionHeader: []string{"hogehoge"}})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	conn.ReadMessage() // pull and drop initial message
+	conn.Close()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("not receive close callback")
+	}
+	for i := 0; i < 50 && st.ClosingConnections() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.ClosingConnections() != 0 {
+		t.Error("close callback does not time out")
+	}
+}
+
+func TestWebSocketSession__CloseCallbackPayload(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc1 := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tcc1.Close()
+	tcc2 := httptest.NewServer(http.HandlerFunc(callbackServer.CloseHandler))
+	defer tcc2.Close()
+
+	c := TestConfig
+	c.Callback.Connect = tcc1.URL
+	c.Callback.Close = tcc2.URL
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	tc := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer tc.Close()
+
+	wsURL := strings.Replace(tc.URL, "http://", "ws://", -1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{testRequestSessionHeader: []string{"hogehoge"}})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer conn.Close()
+	conn.ReadMessage() // pull and drop initial message
+
+	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "leave"))
+	if err != nil {
+		t.Fatal("cannot write close message error:", err)
+	}
+	for i := 0; i < 50 && !callbackServer.IsClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !callbackServer.IsClosed() {
+		t.Fatal("not receive close callback")
+	}
+	if ct := callbackServer.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	var payload closeCallbackPayload
+	if err := json.Unmarshal(callbackServer.CloseBody(), &payload); err != nil {
+		t.Fatal("cannot unmarshal close callback payload:", err)
+	}
+	if payload.Session != "hogehoge" || payload.Endpoint != c.Endpoint {
+		t.Errorf("unexpected session in close callback payload: %+v", payload)
+	}
+	if payload.Initiator != "client" || payload.Code != 4000 || payload.Reason != "leave" {
+		t.Errorf("unexpected close reason in close callback payload: %+v", payload)
+	}
+	if payload.SentMessages != 1 || payload.SentBytes != int64(len(testHelloMessage)) || payload.UserAgent != "Go-http-client/1.1" {
+		t.Errorf("unexpected summary in close callback payload: %+v", payload)
+	}
+	if payload.ConnectedAt.IsZero() || payload.ClosedAt.Before(payload.ConnectedAt) || payload.Duration <= 0 {
+		t.Errorf("unexpected times in close callback payload: %+v", payload)
+	}
+}
@@ -5,6 +5,8 @@ package kuiperbelt
 import (
 	"errors"
 	"sync"
+
+	"github.com/gorilla/websocket"
 )
 
 var errSessionNotFound = errors.New("kuiperbelt: session is not found")
@@ -21,6 +23,13 @@ type Message struct {
 	Session       string
 	LastWord      bool
 	FromPostClose bool
+	CloseCode     int    // sent in the close frame after the last word
+	CloseReason   string // sent in the close frame after the last word
+	TraceParent   string
+	TraceState    string
+
+	// prepared is the message marshaled and compressed in advance for broadcasting.
+	prepared *websocket.PreparedMessage
 }
 
 // Session is an interface for sessions.
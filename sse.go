@@ -0,0 +1,236 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// sseKeepAliveInterval is the interval of comments to keep the stream alive through proxies
+// when ping_interval is not set.
+var sseKeepAliveInterval = 15 * time.Second
+
+// SSESession is a session over Server-Sent Events for clients which cannot use WebSocket.
+// Messages from the client are posted to the companion endpoint with the token of the session.
+type SSESession struct {
+	*httpSession
+}
+
+// SSEHandler handles GET /sse request.
+// It authenticates the request as /connect, and streams messages to the client as Server-Sent Events.
+func (s *WebSocketServer) SSEHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !s.Config.SSE.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	release := s.admit(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	s.Stats.ConnectEvent()
+	defer s.Stats.DisconnectEvent()
+
+	hs, hello, ok := s.connectHTTP(w, r, "sse")
+	if !ok {
+		return
+	}
+	session := &SSESession{hs}
+	s.addSession(session)
+	defer s.deleteSession(session.Key())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable buffering of nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	open, _ := json.Marshal(map[string]string{"session": session.Key(), "token": session.token})
+	if err := writeSSEEvent(w, "open", open); err != nil {
+		session.setCloseReason("error", 0, "")
+		session.Close()
+		return
+	}
+	// send the first message.
+	if hello != nil {
+		s.Stats.MessageEvent()
+		if err := session.writeMessage(w, *hello); err != nil {
+			s.Stats.MessageErrorEvent()
+			session.setCloseReason("error", 0, "")
+			session.Close()
+			return
+		}
+	}
+	flusher.Flush()
+	session.stream(r.Context(), w, flusher)
+}
+
+// stream writes messages to the client until the session is closed.
+func (s *SSESession) stream(ctx context.Context, w io.Writer, flusher http.Flusher) {
+	interval := s.server.Config.PingInterval
+	if interval <= 0 {
+		interval = sseKeepAliveInterval
+	}
+	keepAlive := time.NewTicker(interval)
+	defer keepAlive.Stop()
+	var expiry <-chan time.Time
+	if exp := s.info.TokenExpiresAt; !exp.IsZero() {
+		expiryTimer := time.NewTimer(time.Until(exp))
+		defer expiryTimer.Stop()
+		expiry = expiryTimer.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-expiry:
+			expiry = nil
+			s.server.sessionLog.Info("session token expired",
+				zap.String("session", s.Key()),
+				zap.String("remote_addr", s.info.RemoteAddr),
+				zap.String("policy", s.server.Config.JWT.Expiry),
+			)
+			if s.server.Config.JWT.Expiry == "warn" {
+				err = s.writeMessage(w, Message{
+					Body:        []byte(`{"error":"token_expired"}`),
+					ContentType: "application/json",
+					Session:     s.Key(),
+				})
+				break
+			}
+			s.setCloseReason("server", websocket.ClosePolicyViolation, "token_expired")
+			s.writeClose(w, websocket.ClosePolicyViolation, "token_expired")
+			flusher.Flush()
+			s.Close()
+			return
+		case msg := <-s.send:
+			if err = s.writeMessage(w, msg); err != nil {
+				s.server.Stats.MessageErrorEvent()
+				break
+			}
+			if msg.LastWord {
+				code := msg.CloseCode
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				s.setCloseReason("server", code, msg.CloseReason)
+				s.writeClose(w, code, msg.CloseReason)
+				flusher.Flush()
+				s.close(!msg.FromPostClose)
+				return
+			}
+		case <-ctx.Done():
+			s.setCloseReason("client", 0, "")
+			s.Close()
+			return
+		case <-s.closedch:
+			return
+		}
+		if err != nil {
+			s.setCloseReason("error", 0, "")
+			s.Close()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeMessage writes the message as "message" event. Binary messages are written as "binary" event encoded in base64.
+func (s *SSESession) writeMessage(w io.Writer, message Message) (err error) {
+	bs, messageType, err := messageMarshal(message)
+	if err != nil {
+		return err
+	}
+	if message.TraceParent != "" {
+		span := s.server.tracer.StartSpan("deliver", spanKindProducer, message.traceContext())
+		defer span.End()
+		span.SetAttribute("kuiperbelt.session", s.Key())
+		span.SetAttribute("messaging.message_payload_size_bytes", len(bs))
+		defer func() {
+			span.SetError(err)
+		}()
+	}
+	event, data := "message", bs
+	if messageType == websocket.BinaryMessage {
+		event = "binary"
+		data = []byte(base64.StdEncoding.EncodeToString(bs))
+	}
+	if err := writeSSEEvent(w, event, data); err != nil {
+		return err
+	}
+	s.sent(messageType, message.ContentType, bs)
+	return nil
+}
+
+// writeClose writes "close" event with the code and the reason as the close frame of WebSocket.
+func (s *SSESession) writeClose(w io.Writer, code int, reason string) error {
+	data, _ := json.Marshal(struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}{code, reason})
+	return writeSSEEvent(w, "close", data)
+}
+
+// writeSSEEvent writes an event of Server-Sent Events. Each line of the data is written as a data field.
+func writeSSEEvent(w io.Writer, event string, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("event: " + event + "\n")
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// SSEMessageHandler handles POST /sse/message?session=...&token=... request.
+// The request body is passed to the receive callback as a message from the client of the SSE session.
+func (s *WebSocketServer) SSEMessageHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !s.Config.SSE.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	session, err := s.Pool.Get(query.Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ss, ok := session.(*SSESession)
+	if !ok || !ss.authorize(query.Get("token")) {
+		// do not tell whether the session exists.
+		http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	s.receiveHTTP(w, r, ss.httpSession)
+}
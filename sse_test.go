@@ -0,0 +1,164 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSSEEvent(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeSSEEvent(&b, "message", []byte("foo\r\nbar\rbaz\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expect := "event: message\ndata: foo\ndata: bar\ndata: baz\ndata: \n\n"
+	if b.String() != expect {
+		t.Errorf("unexpected event: %q", b.String())
+	}
+}
+
+type testSSEEvent struct {
+	event string
+	data  string
+}
+
+func readSSEEvent(r *bufio.Reader) (testSSEEvent, error) {
+	var e testSSEEvent
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return e, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.event == "" && data == nil {
+				continue // end of a comment
+			}
+			e.data = strings.Join(data, "\n")
+			return e, nil
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestWebSocketServer__SSEHandler(t *testing.T) {
+	c := TestConfig
+	c.SSE.Enabled = true
+
+	received := make(chan string, 1)
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tccConnect := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+	defer tccConnect.Close()
+	tccClose := httptest.NewServer(http.HandlerFunc(callbackServer.CloseHandler))
+	defer tccClose.Close()
+	tccReceive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(c.SessionHeader) != "hogehoge" {
+			t.Errorf("received message Session Key is not match: %s", r.Header.Get(c.SessionHeader))
+		}
+		var b bytes.Buffer
+		b.ReadFrom(r.Body)
+		received <- b.String()
+	}))
+	defer tccReceive.Close()
+	c.Callback.Connect = tccConnect.URL
+	c.Callback.Close = tccClose.URL
+	c.Callback.Receive = tccReceive.URL
+
+	var pool SessionPool
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.Path.SSE, server.SSEHandler)
+	mux.HandleFunc(c.Path.SSEMessage, server.SSEMessageHandler)
+	tc := httptest.NewServer(mux)
+	defer tc.Close()
+	proxy := NewProxy(c, st, &pool)
+
+	req, _ := http.NewRequest(http.MethodGet, tc.URL+c.Path.SSE, nil)
+	req.Header.Set(testRequestSessionHeader, "hogehoge")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	e, err := readSSEEvent(r)
+	if err != nil || e.event != "open" {
+		t.Fatalf("unexpected open event: %+v %s", e, err)
+	}
+	var open struct {
+		Session string `json:"session"`
+		Token   string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(e.data), &open); err != nil || open.Session != "hogehoge" || open.Token == "" {
+		t.Fatalf("unexpected open event: %s", e.data)
+	}
+	if e, err := readSSEEvent(r); err != nil || e.event != "message" || e.data != testHelloMessage {
+		t.Errorf("unexpected hello message: %+v %s", e, err)
+	}
+
+	// send a message from the backend.
+	sendReq := httptest.NewRequest(http.MethodPost, c.Path.Send, strings.NewReader("from backend"))
+	sendReq.Header.Set(c.SessionHeader, "hogehoge")
+	w := httptest.NewRecorder()
+	proxy.SendHandlerFunc(w, sendReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected send status: %d %s", w.Code, w.Body.String())
+	}
+	if e, err := readSSEEvent(r); err != nil || e.event != "message" || e.data != "from backend" {
+		t.Errorf("unexpected message: %+v %s", e, err)
+	}
+
+	// post a message from the client.
+	messageURL := tc.URL + c.Path.SSEMessage + "?session=hogehoge&token="
+	if resp, err := http.Post(messageURL+"invalid", "text/plain", strings.NewReader("from client")); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("message with invalid token must be rejected: %+v %s", resp, err)
+	}
+	mresp, err := http.Post(messageURL+open.Token, "text/plain", strings.NewReader("from client"))
+	if err != nil || mresp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected message response: %+v %s", mresp, err)
+	}
+	mresp.Body.Close()
+	select {
+	case m := <-received:
+		if m != "from client" {
+			t.Errorf("unexpected received message: %s", m)
+		}
+	case <-time.After(time.Second):
+		t.Error("receive callback is not called")
+	}
+
+	// close from the backend.
+	closeReq := httptest.NewRequest(http.MethodPost, c.Path.Close, strings.NewReader("bye"))
+	closeReq.Header.Set(c.SessionHeader, "hogehoge")
+	w = httptest.NewRecorder()
+	proxy.CloseHandlerFunc(w, closeReq)
+	if e, err := readSSEEvent(r); err != nil || e.event != "message" || e.data != "bye" {
+		t.Errorf("unexpected last message: %+v %s", e, err)
+	}
+	if e, err := readSSEEvent(r); err != nil || e.event != "close" || !strings.Contains(e.data, `"code":1000`) {
+		t.Errorf("unexpected close event: %+v %s", e, err)
+	}
+	if _, err := readSSEEvent(r); err != io.EOF {
+		t.Errorf("stream must be finished: %s", err)
+	}
+}
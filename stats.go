@@ -5,10 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	latencyBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+	lifetimeBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 10800, 21600, 43200, 86400}
+)
+
 // macopy may be embedded into structs which must not be copied
 // after the first use.
 // See https://github.com/golang/go/issues/8005#issuecomment-190753527
@@ -24,11 +35,63 @@ type Stats struct {
 	connectErrors      int64
 	messageErrors      int64
 	closingConnections int64
+	connectRejects     int64
+	inboundRateLimited int64
+	inboundTooLarge    int64
+	compressionRaw     int64
+	compressionWire    int64
+	pongTimeouts       int64
+	connectCacheHits   int64
+	connectCacheMisses int64
+	originRejects      int64
+	eventDrops         int64
 	noCopy             macopy
+
+	callbackDuration *histogramVec
+	handlerDuration  *histogramVec
+	queueWait        *histogramVec
+	messageSize      *histogramVec
+	sessionLifetime  *histogramVec
+	pingRTT          *histogramVec
 }
 
 func NewStats() *Stats {
-	return &Stats{}
+	return &Stats{
+		callbackDuration: newHistogramVec(
+			"kuiperbelt_callback_duration_seconds",
+			"Latency of callback requests.",
+			latencyBuckets,
+			"callback", "result", "code",
+		),
+		handlerDuration: newHistogramVec(
+			"kuiperbelt_handler_duration_seconds",
+			"Latency of backend API handlers.",
+			latencyBuckets,
+			"handler", "result", "code",
+		),
+		queueWait: newHistogramVec(
+			"kuiperbelt_send_queue_wait_seconds",
+			"Time spent waiting to put a message into the send queue of a session.",
+			latencyBuckets,
+			"result",
+		),
+		messageSize: newHistogramVec(
+			"kuiperbelt_message_size_bytes",
+			"Size of messages sent to or received from clients.",
+			sizeBuckets,
+			"direction",
+		),
+		sessionLifetime: newHistogramVec(
+			"kuiperbelt_session_lifetime_seconds",
+			"Lifetime of sessions.",
+			lifetimeBuckets,
+		),
+		pingRTT: newHistogramVec(
+			"kuiperbelt_ping_rtt_seconds",
+			"Round-trip time of pings sent to clients.",
+			latencyBuckets,
+		),
+	}
 }
 
 func (s *Stats) Connections() int64 {
@@ -55,14 +118,64 @@ func (s *Stats) ClosingConnections() int64 {
 	return atomic.LoadInt64(&s.closingConnections)
 }
 
+func (s *Stats) ConnectRejects() int64 {
+	return atomic.LoadInt64(&s.connectRejects)
+}
+
+func (s *Stats) InboundRateLimited() int64 {
+	return atomic.LoadInt64(&s.inboundRateLimited)
+}
+
+func (s *Stats) InboundTooLarge() int64 {
+	return atomic.LoadInt64(&s.inboundTooLarge)
+}
+
+func (s *Stats) PongTimeouts() int64 {
+	return atomic.LoadInt64(&s.pongTimeouts)
+}
+
+func (s *Stats) ConnectCacheHits() int64 {
+	return atomic.LoadInt64(&s.connectCacheHits)
+}
+
+func (s *Stats) ConnectCacheMisses() int64 {
+	return atomic.LoadInt64(&s.connectCacheMisses)
+}
+
+func (s *Stats) OriginRejects() int64 {
+	return atomic.LoadInt64(&s.originRejects)
+}
+
+func (s *Stats) EventDrops() int64 {
+	return atomic.LoadInt64(&s.eventDrops)
+}
+
+// CompressionRatio returns the ratio of bytes on the wire to bytes of messages sent in compressed sessions.
+func (s *Stats) CompressionRatio() float64 {
+	raw := atomic.LoadInt64(&s.compressionRaw)
+	if raw == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&s.compressionWire)) / float64(raw)
+}
+
 func (s *Stats) Dump(w io.Writer) error {
 	return json.NewEncoder(w).Encode(struct {
-		Connections        int64 `json:"connections"`
-		TotalConnections   int64 `json:"total_connections"`
-		TotalMessages      int64 `json:"total_messages"`
-		ConnectErrors      int64 `json:"connect_errors"`
-		MessageErrors      int64 `json:"message_errors"`
-		ClosingConnections int64 `json:"closing_connections"`
+		Connections        int64   `json:"connections"`
+		TotalConnections   int64   `json:"total_connections"`
+		TotalMessages      int64   `json:"total_messages"`
+		ConnectErrors      int64   `json:"connect_errors"`
+		MessageErrors      int64   `json:"message_errors"`
+		ClosingConnections int64   `json:"closing_connections"`
+		ConnectRejects     int64   `json:"connect_rejects"`
+		InboundRateLimited int64   `json:"inbound_rate_limited"`
+		InboundTooLarge    int64   `json:"inbound_too_large"`
+		CompressionRatio   float64 `json:"compression_ratio"`
+		PongTimeouts       int64   `json:"pong_timeouts"`
+		ConnectCacheHits   int64   `json:"connect_cache_hits"`
+		ConnectCacheMisses int64   `json:"connect_cache_misses"`
+		OriginRejects      int64   `json:"origin_rejects"`
+		EventDrops         int64   `json:"event_drops"`
 	}{
 		Connections:        s.Connections(),
 		TotalConnections:   s.TotalConnections(),
@@ -70,6 +183,15 @@ func (s *Stats) Dump(w io.Writer) error {
 		ConnectErrors:      s.ConnectErrors(),
 		MessageErrors:      s.MessageErrors(),
 		ClosingConnections: s.ClosingConnections(),
+		ConnectRejects:     s.ConnectRejects(),
+		InboundRateLimited: s.InboundRateLimited(),
+		InboundTooLarge:    s.InboundTooLarge(),
+		CompressionRatio:   s.CompressionRatio(),
+		PongTimeouts:       s.PongTimeouts(),
+		ConnectCacheHits:   s.ConnectCacheHits(),
+		ConnectCacheMisses: s.ConnectCacheMisses(),
+		OriginRejects:      s.OriginRejects(),
+		EventDrops:         s.EventDrops(),
 	})
 }
 
@@ -81,8 +203,47 @@ func (s *Stats) DumpText(w io.Writer) error {
 	fmt.Fprintf(buf, "kuiperbelt.conn.total\t%d\t%d\n", s.TotalConnections(), now)
 	fmt.Fprintf(buf, "kuiperbelt.conn.errors\t%d\t%d\n", s.ConnectErrors(), now)
 	fmt.Fprintf(buf, "kuiperbelt.conn.closing\t%d\t%d\n", s.ClosingConnections(), now)
+	fmt.Fprintf(buf, "kuiperbelt.conn.rejects\t%d\t%d\n", s.ConnectRejects(), now)
+	fmt.Fprintf(buf, "kuiperbelt.conn.origin_rejects\t%d\t%d\n", s.OriginRejects(), now)
+	fmt.Fprintf(buf, "kuiperbelt.conn.pong_timeouts\t%d\t%d\n", s.PongTimeouts(), now)
+	fmt.Fprintf(buf, "kuiperbelt.conn.cache_hits\t%d\t%d\n", s.ConnectCacheHits(), now)
+	fmt.Fprintf(buf, "kuiperbelt.conn.cache_misses\t%d\t%d\n", s.ConnectCacheMisses(), now)
 	fmt.Fprintf(buf, "kuiperbelt.messages.total\t%d\t%d\n", s.TotalMessages(), now)
 	fmt.Fprintf(buf, "kuiperbelt.messages.errors\t%d\t%d\n", s.MessageErrors(), now)
+	fmt.Fprintf(buf, "kuiperbelt.messages.inbound_rate_limited\t%d\t%d\n", s.InboundRateLimited(), now)
+	fmt.Fprintf(buf, "kuiperbelt.messages.inbound_too_large\t%d\t%d\n", s.InboundTooLarge(), now)
+	fmt.Fprintf(buf, "kuiperbelt.messages.compression_ratio\t%f\t%d\n", s.CompressionRatio(), now)
+	fmt.Fprintf(buf, "kuiperbelt.events.drops\t%d\t%d\n", s.EventDrops(), now)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// DumpPrometheus writes the stats in the Prometheus text exposition format.
+func (s *Stats) DumpPrometheus(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	buf.Grow(8192)
+	writePrometheusValue(buf, "kuiperbelt_connections", "gauge", "Current number of connections.", s.Connections())
+	writePrometheusValue(buf, "kuiperbelt_connections_total", "counter", "Total number of connections.", s.TotalConnections())
+	writePrometheusValue(buf, "kuiperbelt_connect_errors_total", "counter", "Total number of connect errors.", s.ConnectErrors())
+	writePrometheusValue(buf, "kuiperbelt_connect_rejects_total", "counter", "Total number of connect requests rejected by connection limits.", s.ConnectRejects())
+	writePrometheusValue(buf, "kuiperbelt_connect_cache_hits_total", "counter", "Total number of connect requests decided by the connect callback cache.", s.ConnectCacheHits())
+	writePrometheusValue(buf, "kuiperbelt_connect_cache_misses_total", "counter", "Total number of connect requests missing the connect callback cache.", s.ConnectCacheMisses())
+	writePrometheusValue(buf, "kuiperbelt_origin_rejects_total", "counter", "Total number of connect requests rejected by the origin allowlist.", s.OriginRejects())
+	writePrometheusValue(buf, "kuiperbelt_pong_timeouts_total", "counter", "Total number of connections closed by pong timeout.", s.PongTimeouts())
+	writePrometheusValue(buf, "kuiperbelt_closing_connections", "gauge", "Current number of connections waiting for the close callback.", s.ClosingConnections())
+	writePrometheusValue(buf, "kuiperbelt_messages_total", "counter", "Total number of messages.", s.TotalMessages())
+	writePrometheusValue(buf, "kuiperbelt_message_errors_total", "counter", "Total number of message errors.", s.MessageErrors())
+	writePrometheusValue(buf, "kuiperbelt_inbound_rate_limited_total", "counter", "Total number of messages from clients over the rate limit.", s.InboundRateLimited())
+	writePrometheusValue(buf, "kuiperbelt_inbound_too_large_total", "counter", "Total number of messages from clients over the size limit.", s.InboundTooLarge())
+	writePrometheusValue(buf, "kuiperbelt_compression_raw_bytes_total", "counter", "Total bytes of messages sent in compressed sessions.", atomic.LoadInt64(&s.compressionRaw))
+	writePrometheusValue(buf, "kuiperbelt_event_drops_total", "counter", "Total number of events dropped because the event stream is full.", s.EventDrops())
+	writePrometheusValue(buf, "kuiperbelt_compression_wire_bytes_total", "counter", "Total bytes on the wire of messages sent in compressed sessions.", atomic.LoadInt64(&s.compressionWire))
+	s.callbackDuration.write(buf)
+	s.handlerDuration.write(buf)
+	s.queueWait.write(buf)
+	s.messageSize.write(buf)
+	s.sessionLifetime.write(buf)
+	s.pingRTT.write(buf)
 	_, err := buf.WriteTo(w)
 	return err
 }
@@ -96,6 +257,28 @@ func (s *Stats) ConnectErrorEvent() {
 	atomic.AddInt64(&s.connectErrors, 1)
 }
 
+func (s *Stats) ConnectRejectEvent() {
+	atomic.AddInt64(&s.connectRejects, 1)
+}
+
+// ConnectCacheEvent records a lookup of the connect callback cache.
+func (s *Stats) ConnectCacheEvent(hit bool) {
+	if hit {
+		atomic.AddInt64(&s.connectCacheHits, 1)
+	} else {
+		atomic.AddInt64(&s.connectCacheMisses, 1)
+	}
+}
+
+func (s *Stats) OriginRejectEvent() {
+	atomic.AddInt64(&s.originRejects, 1)
+}
+
+// EventDropEvent records an event dropped because the event stream is full.
+func (s *Stats) EventDropEvent() {
+	atomic.AddInt64(&s.eventDrops, 1)
+}
+
 func (s *Stats) DisconnectEvent() {
 	atomic.AddInt64(&s.connections, -1)
 }
@@ -108,6 +291,31 @@ func (s *Stats) MessageErrorEvent() {
 	atomic.AddInt64(&s.messageErrors, 1)
 }
 
+// InboundViolationEvent records a message from a client over the inbound limits.
+func (s *Stats) InboundViolationEvent(reason string) {
+	switch reason {
+	case inboundRateLimited:
+		atomic.AddInt64(&s.inboundRateLimited, 1)
+	case inboundTooLarge:
+		atomic.AddInt64(&s.inboundTooLarge, 1)
+	}
+}
+
+// CompressionEvent records the size of a message sent in a compressed session and the bytes on the wire.
+func (s *Stats) CompressionEvent(raw int, wire int64) {
+	atomic.AddInt64(&s.compressionRaw, int64(raw))
+	atomic.AddInt64(&s.compressionWire, wire)
+}
+
+// PingEvent records the round-trip time of a ping.
+func (s *Stats) PingEvent(rtt time.Duration) {
+	s.pingRTT.with().observe(rtt.Seconds())
+}
+
+func (s *Stats) PongTimeoutEvent() {
+	atomic.AddInt64(&s.pongTimeouts, 1)
+}
+
 func (s *Stats) ClosingEvent() {
 	atomic.AddInt64(&s.closingConnections, 1)
 }
@@ -115,3 +323,163 @@ func (s *Stats) ClosingEvent() {
 func (s *Stats) ClosedEvent() {
 	atomic.AddInt64(&s.closingConnections, -1)
 }
+
+// CallbackEvent records the latency of a callback request.
+// status is the response status code, or 0 if no response is received.
+func (s *Stats) CallbackEvent(callback string, status int, elapsed time.Duration) {
+	result, code := statusLabels(status)
+	s.callbackDuration.with(callback, result, code).observe(elapsed.Seconds())
+}
+
+// HandlerEvent records the latency of a backend API handler such as /send.
+func (s *Stats) HandlerEvent(handler string, status int, elapsed time.Duration) {
+	result, code := statusLabels(status)
+	s.handlerDuration.with(handler, result, code).observe(elapsed.Seconds())
+}
+
+// QueueWaitEvent records the time to put a message into a send queue.
+func (s *Stats) QueueWaitEvent(result string, elapsed time.Duration) {
+	s.queueWait.with(result).observe(elapsed.Seconds())
+}
+
+// MessageSizeEvent records the size of a message.
+// direction is "send" for messages to clients and "receive" for messages from clients.
+func (s *Stats) MessageSizeEvent(direction string, size int) {
+	s.messageSize.with(direction).observe(float64(size))
+}
+
+// SessionLifetimeEvent records the lifetime of a closed session.
+func (s *Stats) SessionLifetimeEvent(elapsed time.Duration) {
+	s.sessionLifetime.with().observe(elapsed.Seconds())
+}
+
+func statusLabels(status int) (string, string) {
+	switch {
+	case status == 0:
+		return "error", ""
+	case status >= 200 && status < 300:
+		return "ok", strconv.Itoa(status)
+	default:
+		return "ng", strconv.Itoa(status)
+	}
+}
+
+func writePrometheusValue(buf *bytes.Buffer, name, typ, help string, v int64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(buf, "%s %d\n", name, v)
+}
+
+type histogram struct {
+	upperBounds []float64
+	counts      []uint64 // accessed atomically
+	count       uint64   // accessed atomically
+	sumBits     uint64   // accessed atomically
+}
+
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	// count is incremented first so that the +Inf bucket never falls behind the others.
+	atomic.AddUint64(&h.count, 1)
+	if i := sort.SearchFloat64s(h.upperBounds, v); i < len(h.upperBounds) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+}
+
+type histogramVec struct {
+	name        string
+	help        string
+	labelNames  []string
+	upperBounds []float64
+
+	mu         sync.RWMutex
+	histograms map[string]*histogram
+	values     map[string][]string
+}
+
+func newHistogramVec(name, help string, upperBounds []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:        name,
+		help:        help,
+		labelNames:  labelNames,
+		upperBounds: upperBounds,
+		histograms:  make(map[string]*histogram),
+		values:      make(map[string][]string),
+	}
+}
+
+func (v *histogramVec) with(values ...string) *histogram {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	h, ok := v.histograms[key]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok := v.histograms[key]; ok {
+		return h
+	}
+	h = newHistogram(v.upperBounds)
+	v.histograms[key] = h
+	v.values[key] = values
+	return h
+}
+
+func (v *histogramVec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", v.name)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.histograms))
+	for key := range v.histograms {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		h := v.histograms[key]
+		values := v.values[key]
+		v.mu.RUnlock()
+
+		labels := make([]string, 0, len(values)+1)
+		for i, value := range values {
+			labels = append(labels, v.labelNames[i]+"="+strconv.Quote(value))
+		}
+		var cumulative uint64
+		for i, upper := range h.upperBounds {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := "le=" + strconv.Quote(strconv.FormatFloat(upper, 'g', -1, 64))
+			fmt.Fprintf(buf, "%s_bucket{%s} %d\n", v.name, strings.Join(append(labels, le), ","), cumulative)
+		}
+		count := atomic.LoadUint64(&h.count)
+		sum := math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+		fmt.Fprintf(buf, "%s_bucket{%s} %d\n", v.name, strings.Join(append(labels, `le="+Inf"`), ","), count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, formatLabels(labels), strconv.FormatFloat(sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count%s %d\n", v.name, formatLabels(labels), count)
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
@@ -2,8 +2,11 @@ package kuiperbelt
 
 import (
 	"bytes"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestStats(t *testing.T) {
@@ -30,7 +33,8 @@ func TestStats(t *testing.T) {
 	for i := 0; i < 2; i++ {
 		s.MessageErrorEvent()
 	}
-	if s.Connections() != 5 || s.TotalConnections() != 10 || s.ConnectErrors() != 3 || s.TotalMessages() != 4 || s.MessageErrors() != 2 {
+	s.ConnectRejectEvent()
+	if s.Connections() != 5 || s.TotalConnections() != 10 || s.ConnectErrors() != 3 || s.TotalMessages() != 4 || s.MessageErrors() != 2 || s.ConnectRejects() != 1 {
 		t.Errorf("invalid connetions count %#v", s)
 	}
 
@@ -39,7 +43,7 @@ func TestStats(t *testing.T) {
 	if err != nil {
 		t.Errorf("stats dump failed %s", err)
 	}
-	if out.String() != `{"connections":5,"total_connections":10,"total_messages":4,"connect_errors":3,"message_errors":2,"closing_connections":0}`+"\n" {
+	if out.String() != `{"connections":5,"total_connections":10,"total_messages":4,"connect_errors":3,"message_errors":2,"closing_connections":0,"connect_rejects":1,"inbound_rate_limited":0,"inbound_too_large":0,"compression_ratio":0,"pong_timeouts":0,"connect_cache_hits":0,"connect_cache_misses":0,"origin_rejects":0,"event_drops":0}`+"\n" {
 		t.Errorf("unexpected dump JSON %s", out.String())
 	}
 
@@ -84,3 +88,37 @@ func TestStatsRace(t *testing.T) {
 		t.Errorf("invalid stats %#v", s)
 	}
 }
+
+func TestStats__DumpPrometheus(t *testing.T) {
+	s := NewStats()
+	s.ConnectEvent()
+	s.CallbackEvent("connect", http.StatusOK, 30*time.Millisecond)
+	s.CallbackEvent("connect", http.StatusForbidden, 2*time.Second)
+	s.CallbackEvent("close", 0, 20*time.Second)
+	s.MessageSizeEvent("send", 100)
+	s.SessionLifetimeEvent(time.Minute)
+
+	out := new(bytes.Buffer)
+	if err := s.DumpPrometheus(out); err != nil {
+		t.Fatalf("stats dump prometheus failed %s", err)
+	}
+	expects := []string{
+		"# TYPE kuiperbelt_connections gauge\nkuiperbelt_connections 1\n",
+		"# TYPE kuiperbelt_connections_total counter\nkuiperbelt_connections_total 1\n",
+		`kuiperbelt_callback_duration_seconds_bucket{callback="connect",result="ok",code="200",le="0.025"} 0` + "\n",
+		`kuiperbelt_callback_duration_seconds_bucket{callback="connect",result="ok",code="200",le="0.05"} 1` + "\n",
+		`kuiperbelt_callback_duration_seconds_count{callback="connect",result="ng",code="403"} 1` + "\n",
+		`kuiperbelt_callback_duration_seconds_bucket{callback="close",result="error",code="",le="10"} 0` + "\n",
+		`kuiperbelt_callback_duration_seconds_bucket{callback="close",result="error",code="",le="+Inf"} 1` + "\n",
+		`kuiperbelt_message_size_bytes_bucket{direction="send",le="256"} 1` + "\n",
+		`kuiperbelt_message_size_bytes_sum{direction="send"} 100` + "\n",
+		`kuiperbelt_session_lifetime_seconds_bucket{le="60"} 1` + "\n",
+		"kuiperbelt_session_lifetime_seconds_sum 60\n",
+		"# TYPE kuiperbelt_send_queue_wait_seconds histogram\n",
+	}
+	for _, expect := range expects {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("prometheus dump does not contain %q:\n%s", expect, out.String())
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package kuiperbelt
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const tapQueueSize = 64
+
+// tapEvent is a message mirrored to observers of a session.
+type tapEvent struct {
+	Time        time.Time `json:"time"`
+	Session     string    `json:"session"`
+	Direction   string    `json:"direction"` // "send" or "receive"
+	ContentType string    `json:"content_type"`
+	Body        string    `json:"body"`
+	Encoding    string    `json:"encoding,omitempty"` // "base64" for binary messages
+	Dropped     int64     `json:"dropped,omitempty"`
+}
+
+func newTapEvent(key, direction string, msgType int, contentType string, body []byte) tapEvent {
+	e := tapEvent{
+		Time:        time.Now(),
+		Session:     key,
+		Direction:   direction,
+		ContentType: contentType,
+	}
+	if msgType == websocket.BinaryMessage {
+		e.Body = base64.StdEncoding.EncodeToString(body)
+		e.Encoding = "base64"
+	} else {
+		e.Body = string(body)
+	}
+	return e
+}
+
+type tap struct {
+	events  chan tapEvent
+	limiter *tokenBucket
+	dropped int64 // accessed atomically
+}
+
+// tapHub dispatches traffic of sessions to observers.
+type tapHub struct {
+	n    int32 // number of taps. accessed atomically
+	mu   sync.RWMutex
+	taps map[string]map[*tap]struct{}
+}
+
+func newTapHub() *tapHub {
+	return &tapHub{
+		taps: make(map[string]map[*tap]struct{}),
+	}
+}
+
+func (h *tapHub) subscribe(key string, t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.taps[key] == nil {
+		h.taps[key] = make(map[*tap]struct{})
+	}
+	h.taps[key][t] = struct{}{}
+	atomic.AddInt32(&h.n, 1)
+}
+
+func (h *tapHub) unsubscribe(key string, t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.taps[key][t]; !ok {
+		return
+	}
+	delete(h.taps[key], t)
+	if len(h.taps[key]) == 0 {
+		delete(h.taps, key)
+	}
+	atomic.AddInt32(&h.n, -1)
+}
+
+// tapped reports whether the session has any observers.
+func (h *tapHub) tapped(key string) bool {
+	if atomic.LoadInt32(&h.n) == 0 {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.taps[key]) > 0
+}
+
+// publish sends e to the observers of the session without blocking.
+// The events over the rate limit or the queue size are dropped.
+func (h *tapHub) publish(e tapEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for t := range h.taps[e.Session] {
+		if !t.limiter.Allow() {
+			atomic.AddInt64(&t.dropped, 1)
+			continue
+		}
+		select {
+		case t.events <- e:
+		default:
+			atomic.AddInt64(&t.dropped, 1)
+		}
+	}
+}
+
+// authorizeAdmin checks "Authorization: Bearer" header by the admin token.
+// It writes an error response and returns false if the request is not authorized.
+func authorizeAdmin(c Config, w http.ResponseWriter, r *http.Request) bool {
+	if c.Admin.Token == "" {
+		http.Error(w, "admin API is disabled", http.StatusNotFound)
+		return false
+	}
+	return authorizeBearer(c.Admin.Token, w, r)
+}
+
+// authorizeBearer checks "Authorization: Bearer" header by the token.
+// It writes an error response and returns false if the request is not authorized.
+func authorizeBearer(expected string, w http.ResponseWriter, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// TapHandler handles GET /debug/tap?session=... request.
+// It streams messages sent to and received from the session as Server-Sent Events.
+func (s *WebSocketServer) TapHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(s.Config, w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.FormValue("session")
+	session, err := s.Pool.Get(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	t := &tap{
+		events:  make(chan tapEvent, tapQueueSize),
+		limiter: newTokenBucket(s.Config.Admin.TapRate, s.Config.Admin.TapBurst),
+	}
+	s.taps.subscribe(key, t)
+	defer s.taps.unsubscribe(key, t)
+	Log.Info("tap start",
+		zap.String("session", key),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	defer Log.Info("tap end",
+		zap.String("session", key),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-t.events:
+			e.Dropped = atomic.SwapInt64(&t.dropped, 0)
+			fmt.Fprintf(w, "event: %s\ndata: ", e.Direction)
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		case <-session.Closed():
+			fmt.Fprint(w, "event: close\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package kuiperbelt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTapHandler__Unauthorized(t *testing.T) {
+	var pool SessionPool
+	c := TestConfig
+	server := NewWebSocketServer(c, NewStats(), &pool)
+	ts := httptest.NewServer(http.HandlerFunc(server.TapHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?session=hogehoge")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("tap must be disabled without admin token: %d", resp.StatusCode)
+	}
+
+	c.Admin.Token = "secret"
+	server = NewWebSocketServer(c, NewStats(), &pool)
+	ts2 := httptest.NewServer(http.HandlerFunc(server.TapHandler))
+	defer ts2.Close()
+	req, _ := http.NewRequest("GET", ts2.URL+"?session=hogehoge", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected status code with wrong token: %d", resp.StatusCode)
+	}
+}
+
+func TestTapHandler__MirrorTraffic(t *testing.T) {
+	var pool SessionPool
+	callbackServer := new(testSuccessConnectCallbackServer)
+	tcc := httptest.NewServer(http.HandlerFunc(callbackServer.SuccessHandler))
+
+	c := TestConfig
+	c.Callback.Connect = tcc.URL
+	c.Admin = Admin{Token: "secret", TapRate: 100, TapBurst: 100}
+
+	st := NewStats()
+	server := NewWebSocketServer(c, st, &pool)
+	th := httptest.NewServer(http.HandlerFunc(server.Handler))
+	tt := httptest.NewServer(http.HandlerFunc(server.TapHandler))
+	p := NewProxy(c, st, &pool)
+	ts := httptest.NewServer(http.HandlerFunc(p.SendHandlerFunc))
+
+	dialer := websocket.Dialer{}
+	wsURL := strings.Replace(th.URL, "http://", "ws://", -1)
+	conn, _, err := dialer.Dial(wsURL, http.Header{testRequestSessionHeader: []string{"hogehoge"}})
+	if err != nil {
+		t.Fatal("cannot connect error:", err)
+	}
+	conn.ReadMessage() // pull and drop initial message
+
+	req, _ := http.NewRequest("GET", tt.URL+"?session=hogehoge", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	for i := 0; i < 50 && !server.taps.tapped("hogehoge"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sendReq, _ := http.NewRequest("POST", ts.URL, bytes.NewBufferString("from backend"))
+	sendReq.Header.Add(c.SessionHeader, "hogehoge")
+	sendResp, err := http.DefaultClient.Do(sendReq)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sendResp.Body.Close()
+	conn.ReadMessage()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("from client")); err != nil {
+		t.Fatal("cannot write to connection error:", err)
+	}
+
+	events := make(chan tapEvent, 2)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var e tapEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Errorf("cannot unmarshal tap event: %s", err)
+				return
+			}
+			events <- e
+		}
+	}()
+
+	expects := []tapEvent{
+		{Direction: "send", Body: "from backend"},
+		{Direction: "receive", Body: "ZnJvbSBjbGllbnQ=", Encoding: "base64"},
+	}
+	for _, expect := range expects {
+		select {
+		case e := <-events:
+			if e.Session != "hogehoge" || e.Direction != expect.Direction || e.Body != expect.Body || e.Encoding != expect.Encoding {
+				t.Errorf("unexpected tap event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("tap event is not received: %+v", expect)
+		}
+	}
+}
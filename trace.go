@@ -0,0 +1,440 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+
+	traceFlagSampled = 0x01
+
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanKindProducer = 4
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	traceMaxBatchSize = 512
+	traceMaxQueueSize = 4096
+)
+
+// traceContext is a W3C trace context.
+// See https://www.w3.org/TR/trace-context/ for details.
+type traceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// parseTraceContext parses traceparent and tracestate headers.
+func parseTraceContext(h http.Header) (traceContext, bool) {
+	var tc traceContext
+	parent := strings.TrimSpace(h.Get(traceparentHeader))
+	// version "00" format: {version}-{trace-id}-{parent-id}-{trace-flags}
+	parts := strings.Split(parent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return tc, false
+	}
+	tc.Flags = byte(flags)
+	if !tc.IsValid() {
+		return traceContext{}, false
+	}
+	tc.State = strings.Join(h[tracestateHeader], ",")
+	return tc, true
+}
+
+// IsValid reports whether tc has non-zero trace id and span id.
+func (tc traceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// IsSampled reports whether the sampled flag is set.
+func (tc traceContext) IsSampled() bool {
+	return tc.Flags&traceFlagSampled != 0
+}
+
+// Traceparent returns the value of traceparent header.
+func (tc traceContext) Traceparent() string {
+	if !tc.IsValid() {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" +
+		hex.EncodeToString(tc.SpanID[:]) + "-" +
+		hex.EncodeToString([]byte{tc.Flags})
+}
+
+// inject sets traceparent and tracestate headers to h.
+func (tc traceContext) inject(h http.Header) {
+	if !tc.IsValid() {
+		return
+	}
+	h.Set(traceparentHeader, tc.Traceparent())
+	if tc.State != "" {
+		h.Set(tracestateHeader, tc.State)
+	} else {
+		h.Del(tracestateHeader)
+	}
+}
+
+func (m Message) traceContext() traceContext {
+	h := http.Header{}
+	h.Set(traceparentHeader, m.TraceParent)
+	if m.TraceState != "" {
+		h.Set(tracestateHeader, m.TraceState)
+	}
+	tc, _ := parseTraceContext(h)
+	return tc
+}
+
+type spanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+type span struct {
+	tracer     *tracer
+	ctx        traceContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	status     int
+	message    string
+}
+
+// SetAttribute sets an attribute of the span. value must be string, int, int64 or bool.
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s.tracer == nil {
+		return
+	}
+	s.attributes = append(s.attributes, spanAttribute{Key: key, Value: value})
+}
+
+// SetStatusCode sets the span status by a HTTP status code. 0 means no response.
+func (s *span) SetStatusCode(code int) {
+	if s.tracer == nil {
+		return
+	}
+	if code != 0 {
+		s.SetAttribute("http.status_code", code)
+	}
+	if code >= 200 && code < 400 {
+		s.status = spanStatusOK
+		return
+	}
+	s.status = spanStatusError
+	s.message = http.StatusText(code)
+}
+
+// SetError marks the span as failed by err.
+func (s *span) SetError(err error) {
+	if s.tracer == nil || err == nil {
+		return
+	}
+	s.status = spanStatusError
+	s.message = err.Error()
+}
+
+// End ends the span and queues it to the exporter.
+func (s *span) End() {
+	if s.tracer == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.ctx.IsSampled() {
+		s.tracer.enqueue(s)
+	}
+}
+
+// tracer creates spans and exports them to an OTLP/HTTP collector.
+// It is injected into WebSocketServer and Proxy by Run. A nil tracer is disabled.
+// The OpenTelemetry SDK is not used because it requires a newer Go than go.mod supports.
+type tracer struct {
+	client      *http.Client
+	url         string
+	headers     map[string]string
+	serviceName string
+	interval    time.Duration
+
+	mu      sync.Mutex
+	queue   []*span
+	flushch chan struct{}
+	donech  chan struct{}
+	stopped chan struct{}
+}
+
+func newTracer(c Trace) *tracer {
+	if c.Endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		url:         strings.TrimSuffix(c.Endpoint, "/") + "/v1/traces",
+		headers:     c.Headers,
+		serviceName: c.ServiceName,
+		interval:    c.FlushInterval,
+		flushch:     make(chan struct{}, 1),
+		donech:      make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartSpan starts a new span. If parent is not valid, the span starts a new trace.
+// When the tracer is disabled, the returned span passes parent through as is.
+func (t *tracer) StartSpan(name string, kind int, parent traceContext) *span {
+	if t == nil {
+		return &span{ctx: parent}
+	}
+	s := &span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Flags = parent.Flags
+		s.ctx.State = parent.State
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Flags = traceFlagSampled
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+func (t *tracer) enqueue(s *span) {
+	t.mu.Lock()
+	if len(t.queue) >= traceMaxQueueSize {
+		t.mu.Unlock()
+		Log.Warn("trace queue is full. drop span", zap.String("span", s.name))
+		return
+	}
+	t.queue = append(t.queue, s)
+	n := len(t.queue)
+	t.mu.Unlock()
+
+	if n >= traceMaxBatchSize {
+		select {
+		case t.flushch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flushch:
+		case <-t.donech:
+			t.flush(context.Background())
+			return
+		}
+		t.flush(context.Background())
+	}
+}
+
+func (t *tracer) flush(ctx context.Context) {
+	for {
+		t.mu.Lock()
+		batch := t.queue
+		if len(batch) > traceMaxBatchSize {
+			batch = batch[:traceMaxBatchSize]
+		}
+		t.queue = t.queue[len(batch):]
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			Log.Error("failed export spans",
+				zap.Error(err),
+				zap.Int("spans", len(batch)),
+			)
+			return
+		}
+	}
+}
+
+// Shutdown flushes queued spans and stops the tracer.
+func (t *tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.donech)
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal spans")
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "cannot create export request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed post export request")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrap(errCallbackResponseNotOK(resp.StatusCode), "unsuccessful post export request")
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpAttributes(attrs []spanAttribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var v map[string]interface{}
+		switch value := attr.Value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			continue
+		}
+		kvs = append(kvs, otlpKeyValue{Key: attr.Key, Value: v})
+	}
+	return kvs
+}
+
+func (t *tracer) otlpRequest(spans []*span) interface{} {
+	ss := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			TraceState:        s.ctx.State,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		ss = append(ss, o)
+	}
+
+	type scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	return struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{
+					Attributes: otlpAttributes([]spanAttribute{
+						{Key: "service.name", Value: t.serviceName},
+					}),
+				},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: scope{Name: "github.com/kuiperbelt/kuiperbelt", Version: Version},
+						Spans: ss,
+					},
+				},
+			},
+		},
+	}
+}
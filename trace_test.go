@@ -0,0 +1,221 @@
+package kuiperbelt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceContext(t *testing.T) {
+	h := http.Header{}
+	h.Set("traceparent", testTraceparent)
+	h.Add("tracestate", "rojo=00f067aa0ba902b7")
+	h.Add("tracestate", "congo=t61rcWkgMzE")
+
+	tc, ok := parseTraceContext(h)
+	if !ok {
+		t.Fatal("cannot parse traceparent")
+	}
+	if tc.Traceparent() != testTraceparent {
+		t.Errorf("unexpected traceparent: %s", tc.Traceparent())
+	}
+	if tc.State != "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE" {
+		t.Errorf("unexpected tracestate: %s", tc.State)
+	}
+	if !tc.IsSampled() {
+		t.Error("trace context must be sampled")
+	}
+
+	invalids := []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xxf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	for _, v := range invalids {
+		h := http.Header{}
+		h.Set("traceparent", v)
+		if _, ok := parseTraceContext(h); ok {
+			t.Errorf("invalid traceparent is parsed: %q", v)
+		}
+	}
+}
+
+func TestTracer__Disabled(t *testing.T) {
+	var tr *tracer
+	h := http.Header{}
+	h.Set("traceparent", testTraceparent)
+	parent, _ := parseTraceContext(h)
+
+	span := tr.StartSpan("send", spanKindServer, parent)
+	if span.ctx.Traceparent() != testTraceparent {
+		t.Errorf("disabled tracer must pass through the parent: %s", span.ctx.Traceparent())
+	}
+	span.End()
+}
+
+func TestTracer__Export(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		var b bytes.Buffer
+		b.ReadFrom(r.Body)
+		received <- b.Bytes()
+	}))
+	defer collector.Close()
+
+	tr := newTracer(Trace{
+		Endpoint:      collector.URL,
+		ServiceName:   "kuiperbelt-test",
+		FlushInterval: time.Hour,
+	})
+
+	h := http.Header{}
+	h.Set("traceparent", testTraceparent)
+	parent, _ := parseTraceContext(h)
+	span := tr.StartSpan("send", spanKindServer, parent)
+	span.SetAttribute("kuiperbelt.session", "hogehoge")
+	span.SetStatusCode(http.StatusOK)
+	span.End()
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error on shutdown: %s", err)
+	}
+
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case b := <-received:
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Fatalf("cannot unmarshal exported spans: %s", err)
+		}
+		if !strings.Contains(string(b), `"stringValue":"kuiperbelt-test"`) {
+			t.Errorf("service name is not exported: %s", string(b))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spans are not exported")
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("unexpected number of spans: %d", len(spans))
+	}
+	if spans[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span is not a child of the parent: %+v", spans[0])
+	}
+	if spans[0].Name != "send" || spans[0].Kind != spanKindServer {
+		t.Errorf("unexpected span: %+v", spans[0])
+	}
+}
+
+func TestProxySendHandlerFunc__TraceContext(t *testing.T) {
+	var pool SessionPool
+	s1 := &TestSession{
+		key:  "hogehoge",
+		send: make(chan Message, 4),
+	}
+	pool.Add(s1)
+
+	tc := TestConfig
+	p := NewProxy(tc, NewStats(), &pool)
+	ts := httptest.NewServer(http.HandlerFunc(p.SendHandlerFunc))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, bytes.NewBufferString("test message"))
+	if err != nil {
+		t.Fatal("proxy handler new request unexpected error:", err)
+	}
+	req.Header.Add(tc.SessionHeader, "hogehoge")
+	req.Header.Set("traceparent", testTraceparent)
+	req.Header.Set("tracestate", "rojo=00f067aa0ba902b7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("proxy handler request unexpected error:", err)
+	}
+	resp.Body.Close()
+
+	msg := <-s1.send
+	if msg.TraceParent != testTraceparent {
+		t.Errorf("traceparent is not propagated: %s", msg.TraceParent)
+	}
+	if msg.TraceState != "rojo=00f067aa0ba902b7" {
+		t.Errorf("tracestate is not propagated: %s", msg.TraceState)
+	}
+}
+
+func TestProxySendHandlerFunc__Tracer(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		b.ReadFrom(r.Body)
+		received <- b.Bytes()
+	}))
+	defer collector.Close()
+
+	var pool SessionPool
+	s1 := &TestSession{
+		key:  "hogehoge",
+		send: make(chan Message, 4),
+	}
+	pool.Add(s1)
+
+	tc := TestConfig
+	p := NewProxy(tc, NewStats(), &pool)
+	p.tracer = newTracer(Trace{
+		Endpoint:      collector.URL,
+		ServiceName:   "kuiperbelt-test",
+		FlushInterval: time.Hour,
+	})
+	ts := httptest.NewServer(http.HandlerFunc(p.SendHandlerFunc))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, bytes.NewBufferString("test message"))
+	if err != nil {
+		t.Fatal("proxy handler new request unexpected error:", err)
+	}
+	req.Header.Add(tc.SessionHeader, "hogehoge")
+	req.Header.Set("traceparent", testTraceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("proxy handler request unexpected error:", err)
+	}
+	resp.Body.Close()
+
+	// the message belongs to the span of the proxy.
+	msg := <-s1.send
+	if !strings.HasPrefix(msg.TraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || msg.TraceParent == testTraceparent {
+		t.Errorf("traceparent is not of the span: %s", msg.TraceParent)
+	}
+
+	if err := p.tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error on shutdown: %s", err)
+	}
+	select {
+	case b := <-received:
+		if !strings.Contains(string(b), `"name":"send"`) {
+			t.Errorf("span of the proxy is not exported: %s", string(b))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spans are not exported")
+	}
+}